@@ -2,4 +2,10 @@ module signal
 
 go 1.23.1
 
-require golang.org/x/crypto v0.28.0
+require (
+	filippo.io/edwards25519 v1.1.0
+	github.com/cloudflare/circl v1.6.1
+	golang.org/x/crypto v0.28.0
+)
+
+require golang.org/x/sys v0.26.0 // indirect
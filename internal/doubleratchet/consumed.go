@@ -0,0 +1,100 @@
+package doubleratchet
+
+// DefaultMaxConsumedKeys is the number of decrypted messages, which are remembered to detect duplicates
+const DefaultMaxConsumedKeys = 2 * MaxSkip
+
+// ConsumedKeys remembers the (chain, N) pairs of recently decrypted messages, so a redelivered message is reported
+// as ErrDuplicateMessage before it can touch the State. The chain is the ratchet public key, or the header key for header encryption.
+// An earlier message, which is neither in the set nor has a skipped message key, is reported as ErrMessageKeyExpired.
+// A limit of 0 disables the bound, otherwise the oldest pairs are forgotten first.
+type ConsumedKeys struct {
+	Max   int
+	order []SkippedKey // oldest first
+	index map[SkippedKey]bool
+}
+
+// NewConsumedKeys returns an empty set with the default limit.
+func NewConsumedKeys() *ConsumedKeys {
+	return &ConsumedKeys{
+		Max:   DefaultMaxConsumedKeys,
+		index: make(map[SkippedKey]bool),
+	}
+}
+
+// Add records a decrypted message.
+func (c *ConsumedKeys) Add(key SkippedKey) {
+	if c.index == nil {
+		c.index = make(map[SkippedKey]bool)
+	}
+	if c.index[key] {
+		return
+	}
+	c.index[key] = true
+	c.order = append(c.order, key)
+
+	if c.Max > 0 && len(c.order) > c.Max {
+		evicted := len(c.order) - c.Max
+		for _, old := range c.order[:evicted] {
+			delete(c.index, old)
+		}
+		c.order = append(c.order[:0], c.order[evicted:]...)
+	}
+}
+
+// Contains reports whether the message has already been decrypted. It is safe to call on a nil set.
+func (c *ConsumedKeys) Contains(key SkippedKey) bool {
+	return c != nil && c.index[key]
+}
+
+// Chains returns the distinct chains of the set, oldest first.
+func (c *ConsumedKeys) Chains() []string {
+	if c == nil {
+		return nil
+	}
+	var chains []string
+	seen := make(map[string]bool)
+	for _, key := range c.order {
+		if !seen[key.Chain] {
+			seen[key.Chain] = true
+			chains = append(chains, key.Chain)
+		}
+	}
+	return chains
+}
+
+// Keys returns all pairs, oldest first.
+func (c *ConsumedKeys) Keys() []SkippedKey {
+	if c == nil {
+		return nil
+	}
+	return append([]SkippedKey(nil), c.order...)
+}
+
+// Len returns the number of remembered pairs.
+func (c *ConsumedKeys) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.order)
+}
+
+// consume records a decrypted message of the State, the set is created on first use
+func (s *State) consume(key SkippedKey) {
+	if s.Consumed == nil {
+		s.Consumed = NewConsumedKeys()
+	}
+	s.Consumed.Add(key)
+}
+
+// consumedHE returns the consumed pair of an encrypted header, if one of the remembered header keys decrypts it
+func (s *State) consumedHE(encHeader []byte) (SkippedKey, bool) {
+	for _, chain := range s.Consumed.Chains() {
+		header, err := headerDecrypt(s.suite(), []byte(chain), encHeader)
+		if err != nil {
+			continue
+		}
+		key := SkippedKey{Chain: chain, N: header.N}
+		return key, s.Consumed.Contains(key)
+	}
+	return SkippedKey{}, false
+}
@@ -0,0 +1,82 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func marshalState(t *testing.T, s *State) []byte {
+	t.Helper()
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+	return data
+}
+
+func TestConsumedKeysAreBounded(t *testing.T) {
+	consumed := NewConsumedKeys()
+	consumed.Max = 3
+	for n := range 5 {
+		consumed.Add(SkippedKey{Chain: "chain", N: n})
+	}
+	if consumed.Len() != 3 {
+		t.Fatal("Expected 3 consumed keys, Actual:", consumed.Len())
+	}
+	if consumed.Contains(SkippedKey{Chain: "chain", N: 1}) || !consumed.Contains(SkippedKey{Chain: "chain", N: 2}) {
+		t.Fatal("The oldest consumed keys have to be forgotten first")
+	}
+}
+
+func TestDuplicateOfPreviousChainDoesNotChangeState(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2", "a3")
+	a1, a3 := *s.aliceSentMessages[0], *s.aliceSentMessages[2]
+	s.bobReceiveMessages(1, 3)
+
+	// Bob's receiving chain is replaced, the old messages can only be recognised by the consumed keys
+	s.bobSendMessages("b1")
+	s.aliceReceiveMessages(1)
+	s.aliceSendMessages("a4")
+	s.bobReceiveMessages(4)
+	s.bob = restoreState(t, s.bob)
+
+	before := marshalState(t, s.bob)
+	for _, msg := range []*message{&a1, &a3} {
+		if err := s.bobReceiveMessageUnsafe(msg); !errors.Is(err, ErrDuplicateMessage) {
+			t.Fatal("Expected ErrDuplicateMessage, Actual:", err)
+		}
+	}
+	if !bytes.Equal(before, marshalState(t, s.bob)) {
+		t.Fatal("A duplicate must not change the state")
+	}
+
+	// the skipped a2 is still accepted exactly once
+	a2 := *s.aliceSentMessages[1]
+	s.bobReceiveMessages(2)
+	if err := s.bobReceiveMessageUnsafe(&a2); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrDuplicateMessage, Actual:", err)
+	}
+}
+
+func TestDuplicateOfPreviousChainHE(t *testing.T) {
+	alice, bob := initTestHE(t)
+	a1 := sendMessageHE(t, alice, "a1")
+	a2 := sendMessageHE(t, alice, "a2")
+	receiveMessageHE(t, bob, a2)
+	receiveMessageHE(t, bob, a1)
+	receiveMessageHE(t, alice, sendMessageHE(t, bob, "b1"))
+	receiveMessageHE(t, bob, sendMessageHE(t, alice, "a3"))
+	bob = restoreState(t, bob)
+
+	before := marshalState(t, bob)
+	for _, msg := range []*messageHE{a1, a2} {
+		if _, err := bob.RatchetDecryptHE(msg.encHeader, msg.ciphertext, []byte("associatedData")); !errors.Is(err, ErrDuplicateMessage) {
+			t.Fatal("Expected ErrDuplicateMessage, Actual:", err)
+		}
+	}
+	if !bytes.Equal(before, marshalState(t, bob)) {
+		t.Fatal("A duplicate must not change the state")
+	}
+}
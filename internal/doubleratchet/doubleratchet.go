@@ -3,44 +3,65 @@ package doubleratchet
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/gob"
-	"errors"
-	"golang.org/x/crypto/hkdf"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"time"
 )
 
-type mkSkippedKey struct {
-	DH string
-	N  int
-}
-
 // State variables
 type State struct {
-	DHs       *ecdh.PrivateKey        // DH Ratchet key pair (sending)
-	DHr       *ecdh.PublicKey         // DH Ratchet public key (received)
-	RK        []byte                  // Root key
-	CKs       []byte                  // Chain key (sending)
-	CKr       []byte                  // Chain key (receiving)
-	Ns, Nr    int                     // Message numbers for sending and receiving
-	PN        int                     // Number of messages in the previous sending chain
-	MKSkipped map[mkSkippedKey][]byte // Skipped message keys
+	Suite     CryptoSuite      // Curve, KDFs and AEAD, DefaultSuite if nil
+	DHs       PrivateKey       // DH Ratchet key pair (sending)
+	DHr       PublicKey        // DH Ratchet public key (received)
+	RK        []byte           // Root key
+	CKs       []byte           // Chain key (sending)
+	CKr       []byte           // Chain key (receiving)
+	Ns, Nr    int              // Message numbers for sending and receiving
+	PN        int              // Number of messages in the previous sending chain
+	MKSkipped SkippedKeyStore  // Skipped message keys
+	Consumed  *ConsumedKeys    // Recently decrypted messages, which are rejected as duplicates
+	Step      int              // Number of DH ratchet steps, skipped message keys expire after a number of steps
+	Now       func() time.Time // Clock for the age of skipped message keys, time.Now if nil
+	KEM       *KEMRatchet      // Sparse ML-KEM ratchet, nil for classic sessions, see EnableKEMRatchet
+	Rand      io.Reader        // Entropy source of new key pairs and nonces, crypto/rand.Reader if nil
+
+	// header encryption, only used by the HE variant
+	HKs, HKr   []byte // Header keys for sending and receiving
+	NHKs, NHKr []byte // Next header keys for sending and receiving
+}
+
+func (s *State) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func (s *State) random() io.Reader {
+	if s.Rand == nil {
+		return rand.Reader
+	}
+	return s.Rand
 }
 
 // GenerateDH returns a new Diffie-Hellman key pair
 func GenerateDH() (*ecdh.PrivateKey, error) {
-	curve := ecdh.X25519()
-	pk, err := curve.GenerateKey(rand.Reader)
-	if err != nil {
+	return GenerateDHWithRandom(rand.Reader)
+}
+
+// GenerateDHWithRandom is GenerateDH with the private key read from random.
+// ecdh ignores custom readers in GenerateKey, so the 32 bytes are read directly and clamped by X25519.
+func GenerateDHWithRandom(random io.Reader) (*ecdh.PrivateKey, error) {
+	private := make([]byte, 32)
+	if _, err := io.ReadFull(random, private); err != nil {
 		return nil, err
 	}
-	return pk, nil
+	return ecdh.X25519().NewPrivateKey(private)
 }
 
 // DH returns the output from the Diffie-Hellman calculation between the private key from the DH key pair dhPair and the DH public key dhPub.
@@ -54,38 +75,13 @@ func DH(dhPair *ecdh.PrivateKey, dhPub *ecdh.PublicKey) ([]byte, error) {
 
 // KDFRootKey returns a pair (32-byte root key, 32-byte chain key) as the output of applying a KDF keyed by a 32-byte root key rk to a Diffie-Hellman output dhOut
 func KDFRootKey(rk, dhOut []byte) (rootKey, chainKey []byte, err error) {
-	// Underlying hash function for HMAC.
-	hash := sha256.New
-
-	// Cryptographically secure master secret.
-	secret := dhOut
-
-	// Salt
-	salt := rk
-
-	// Non-secret context info
-	info := []byte("doubleratchet.KDFRootKey")
-
-	kdf := hkdf.New(hash, secret, salt, info)
-
-	// Read two Keys
-	var keys [][]byte
-	for range 2 {
-		key := make([]byte, 32)
-		if _, err := io.ReadFull(kdf, key); err != nil {
-			return nil, nil, err
-		}
-		keys = append(keys, key)
-	}
-
-	return keys[0], keys[1], nil
+	return DefaultSuite.KDFRootKey(rk, dhOut)
 }
 
 // KDFChainKey returns a pair (32-byte chain key, 32-byte message key) as the output of applying a KDF keyed by a 32-byte chain key ck to some constant
-func KDFChainKey(ck []byte) (newChainKey, messageKey []byte) {
+func KDFChainKey(ck []byte) (newChainKey, messageKey []byte, err error) {
 	if len(ck) != 32 {
-		//log.Fatal("chain key must be 32 bytes. Actual:", len(ck))
-		panic("chain key must be 32 bytes. Actual:")
+		return nil, nil, fmt.Errorf("%w: chain key must be 32 bytes, Actual: %d", ErrInvalidKey, len(ck))
 	}
 	hash := sha256.New
 
@@ -100,54 +96,14 @@ func KDFChainKey(ck []byte) (newChainKey, messageKey []byte) {
 	newChainKey = hmacChainKey.Sum(nil)
 
 	// Both outputs are 32 bytes, as SHA-256 produces a 32-byte digest
-	return newChainKey, messageKey
+	return newChainKey, messageKey, nil
 }
 
 // Encrypt implements the encryption algorithm with AEAD based on AES-256-CBC + HMAC.
 // Encrypt returns an AEAD encryption of plaintext with message key mk. The associatedData is authenticated but is not included in the ciphertext.
+// Encryption key, authentication key and IV are derived from mk with HKDF-SHA512, the HMAC-SHA512 is appended to the ciphertext.
 func Encrypt(mk, plaintext, associatedData []byte) ([]byte, error) {
-	keySize := 32
-	authKeySize := 32
-	ivSize := 16 // IV size for AES-CBC
-	outputLength := keySize + authKeySize + ivSize
-	hash := sha512.New
-
-	// Step 1: Derive keys and IV using HKDF
-	info := []byte("doubleratchet.Encrypt")
-	salt := make([]byte, hash().Size())
-	kdf := hkdf.New(hash, mk, salt, info)
-
-	keyMaterial := make([]byte, outputLength)
-	if _, err := io.ReadFull(kdf, keyMaterial); err != nil {
-		return nil, err
-	}
-
-	// separate Key Material into the parts
-	encKey := keyMaterial[:keySize]
-	authKey := keyMaterial[keySize : keySize+authKeySize]
-	iv := keyMaterial[keySize+authKeySize:]
-
-	// Step 2: Encrypt plaintext using AES-256 in CBC mode
-	block, err := aes.NewCipher(encKey)
-	if err != nil {
-		return nil, err
-	}
-	block.BlockSize()
-
-	paddedPlaintext := padPKCS7(plaintext, block.BlockSize())
-	ciphertext := make([]byte, len(paddedPlaintext))
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext, paddedPlaintext)
-
-	// Step 3: Compute HMAC
-	mac := hmac.New(hash, authKey)
-	mac.Write(associatedData)
-	mac.Write(ciphertext)
-	hmacSum := mac.Sum(nil)
-
-	// Step 4: Return ciphertext with HMAC appended
-	return append(ciphertext, hmacSum...), nil
+	return defaultAEAD.encrypt(mk, plaintext, associatedData)
 }
 
 // PKCS7 padding for AES CBC mode
@@ -161,11 +117,11 @@ func padPKCS7(data []byte, blockSize int) []byte {
 func unpadPKCS7(data []byte) ([]byte, error) {
 	length := len(data)
 	if length == 0 {
-		return nil, errors.New("invalid padding size")
+		return nil, fmt.Errorf("%w: invalid padding size", ErrInvalidEncoding)
 	}
 	padLen := int(data[length-1])
 	if padLen > length {
-		return nil, errors.New("invalid padding")
+		return nil, fmt.Errorf("%w: invalid padding", ErrInvalidEncoding)
 	}
 	return data[:length-padLen], nil
 }
@@ -174,67 +130,14 @@ func unpadPKCS7(data []byte) ([]byte, error) {
 // Returns the AEAD decryption of ciphertext with message key mk.
 // If authentication fails, an error is returned.
 func Decrypt(mk, ciphertext, associatedData []byte) ([]byte, error) {
-	keySize := 32
-	authKeySize := 32
-	ivSize := 16 // IV size for AES-CBC
-	hash := sha512.New
-
-	// Step 1: Separate the HMAC from the ciphertext
-	if len(ciphertext) < keySize+authKeySize+ivSize {
-		return nil, errors.New("ciphertext too short")
-	}
-
-	// Extract the HMAC from the end of the ciphertext
-	hmacSum := ciphertext[len(ciphertext)-sha512.Size:]
-	ciphertextWithoutHMAC := ciphertext[:len(ciphertext)-sha512.Size]
-
-	// Step 2: Derive keys and IV using HKDF
-	info := []byte("doubleratchet.Encrypt") // has to be the same info as with encrypt
-	salt := make([]byte, hash().Size())
-	kdf := hkdf.New(hash, mk, salt, info)
-
-	keyMaterial := make([]byte, keySize+authKeySize+ivSize)
-	if _, err := io.ReadFull(kdf, keyMaterial); err != nil {
-		return nil, err
-	}
-
-	// Separate Key Material into the parts
-	encKey := keyMaterial[:keySize]
-	authKey := keyMaterial[keySize : keySize+authKeySize]
-	iv := keyMaterial[keySize+authKeySize:]
-
-	// Step 3: Verify HMAC
-	mac := hmac.New(hash, authKey)
-	mac.Write(associatedData)
-	mac.Write(ciphertextWithoutHMAC)
-	expectedHMAC := mac.Sum(nil)
-
-	if !hmac.Equal(hmacSum, expectedHMAC) {
-		return nil, errors.New("authentication failed")
-	}
-
-	// Step 4: Decrypt ciphertext using AES-256 in CBC mode
-	block, err := aes.NewCipher(encKey)
-	if err != nil {
-		return nil, err
-	}
-
-	mode := cipher.NewCBCDecrypter(block, iv)
-	paddedPlaintext := make([]byte, len(ciphertextWithoutHMAC))
-	mode.CryptBlocks(paddedPlaintext, ciphertextWithoutHMAC)
-
-	// Step 5: Unpad the plaintext
-	plaintext, err := unpadPKCS7(paddedPlaintext)
-	if err != nil {
-		return nil, err
-	}
-
-	return plaintext, nil
+	return defaultAEAD.decrypt(mk, ciphertext, associatedData)
 }
 
-func CreateHeader(dhPair *ecdh.PrivateKey, pn, n int) *MessageHeader {
+func CreateHeader(dhPair PrivateKey, pn, n int) *MessageHeader {
+	// a key pair without DH public key results in a header, which fails to encode
+	dh, _ := publicKey(dhPair)
 	return &MessageHeader{
-		DH: dhPair.PublicKey(),
+		DH: dh,
 		PN: pn,
 		N:  n,
 	}
@@ -243,49 +146,47 @@ func CreateHeader(dhPair *ecdh.PrivateKey, pn, n int) *MessageHeader {
 // Concat Encodes a message header into a parseable byte sequence, prepends the ad byte sequence, and returns the result.
 // If ad is not guaranteed to be a parseable byte sequence,
 // a length value should be prepended to the output to ensure that the output is parseable as a unique pair (ad, header).
+// The output is version || len(ad) || ad || DH || PN || N and the KEM ratchet data, see encoding.go.
 func Concat(ad []byte, header *MessageHeader) ([]byte, error) {
-	payload := ConcatenationPayload{
-		AD: ad,
-		Header: ConcatenationHeader{
-			DH: header.DH.Bytes(),
-			PN: header.PN,
-			N:  header.N,
-		},
-	}
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-
-	err := enc.Encode(payload)
-	if err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
+	buf := []byte{header.version()}
+	buf = binary.AppendUvarint(buf, uint64(len(ad)))
+	buf = append(buf, ad...)
+	return header.appendBinary(buf)
 }
 
+// Parse splits the output of Concat into the header and the associated data.
+// The header key is decoded as a DefaultSuite key, see ParseWithSuite.
 func Parse(data []byte) (header *MessageHeader, associatedData []byte, err error) {
-	buf := bytes.NewBuffer(data)
-
-	dec := gob.NewDecoder(buf)
+	return ParseWithSuite(DefaultSuite, data)
+}
 
-	var payload ConcatenationPayload
-	err = dec.Decode(&payload)
+// ParseWithSuite is Parse for a header with a public key of suite.
+func ParseWithSuite(suite CryptoSuite, data []byte) (header *MessageHeader, associatedData []byte, err error) {
+	r := bytes.NewReader(data)
+	version, err := readVersion(r)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	curve := ecdh.X25519()
-	dh, err := curve.NewPublicKey(payload.Header.DH)
+	adLen, err := readUvarint(r)
 	if err != nil {
 		return nil, nil, err
 	}
+	if adLen > r.Len() {
+		return nil, nil, fmt.Errorf("%w: associated data too short", ErrInvalidEncoding)
+	}
+	associatedData = make([]byte, adLen)
+	if _, err := io.ReadFull(r, associatedData); err != nil {
+		return nil, nil, err
+	}
 
-	header = &MessageHeader{
-		DH: dh,
-		PN: payload.Header.PN,
-		N:  payload.Header.N,
+	header = &MessageHeader{}
+	if err := header.readBinary(r, suite, version); err != nil {
+		return nil, nil, err
+	}
+	if r.Len() != 0 {
+		return nil, nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, r.Len())
 	}
 
-	return header, payload.AD, nil
+	return header, associatedData, nil
 }
@@ -71,7 +71,10 @@ func TestKDFChainKey(t *testing.T) {
 		t.Fatal("original chainKey length isn't 32, Actual:", len(key))
 	}
 
-	newChainKey, messageKey := KDFChainKey(key)
+	newChainKey, messageKey, err := KDFChainKey(key)
+	if err != nil {
+		t.Fatal("KDFChainKey failed:", err.Error())
+	}
 	if len(newChainKey) != 32 {
 		t.Fatal("new chainKey length isn't 32, Actual:", len(newChainKey))
 	}
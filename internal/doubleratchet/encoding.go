@@ -0,0 +1,156 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Wire format, all integers are unsigned varints (encoding/binary):
+//
+//	header = version (1 byte) || DH || PN || N [|| len(KEM PK) || KEM PK || len(KEM CT) || KEM CT]
+//	concat = version (1 byte) || len(AD) || AD || header without version
+//
+// DH has the fixed public key size of the CryptoSuite, 32 bytes for X25519.
+// The length prefix of AD makes the split between AD and header unambiguous.
+// Headers with KEM ratchet data have version EncodingVersionKEM, all others keep EncodingVersion,
+// so sessions without KEM ratchet stay readable by peers which only know EncodingVersion.
+// Both encodings are canonical: decoding rejects unknown versions, non-minimal varints, empty KEM data and trailing bytes.
+const (
+	EncodingVersion    = 1
+	EncodingVersionKEM = 2
+)
+
+// MarshalBinary encodes the header as version || DH || PN || N, followed by the KEM ratchet data if there is any.
+func (h *MessageHeader) MarshalBinary() ([]byte, error) {
+	return h.appendBinary([]byte{h.version()})
+}
+
+// version returns the encoding version of the header, EncodingVersionKEM only if it carries KEM ratchet data
+func (h *MessageHeader) version() byte {
+	if len(h.KEMPublicKey) != 0 || len(h.KEMCiphertext) != 0 {
+		return EncodingVersionKEM
+	}
+	return EncodingVersion
+}
+
+// UnmarshalBinary decodes a header with a DefaultSuite key encoded by MarshalBinary.
+// The encoding does not identify the suite, headers of other suites are decoded with ParseHeader.
+func (h *MessageHeader) UnmarshalBinary(data []byte) error {
+	return h.unmarshalBinary(DefaultSuite, data)
+}
+
+// ParseHeader decodes a header with a public key of suite encoded by MarshalBinary.
+func ParseHeader(suite CryptoSuite, data []byte) (*MessageHeader, error) {
+	h := &MessageHeader{}
+	if err := h.unmarshalBinary(suite, data); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *MessageHeader) unmarshalBinary(suite CryptoSuite, data []byte) error {
+	r := bytes.NewReader(data)
+	version, err := readVersion(r)
+	if err != nil {
+		return err
+	}
+	if err := h.readBinary(r, suite, version); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, r.Len())
+	}
+	return nil
+}
+
+// appendBinary appends DH || PN || N and the KEM ratchet data to b
+func (h *MessageHeader) appendBinary(b []byte) ([]byte, error) {
+	if h.DH == nil {
+		return nil, fmt.Errorf("%w: header.DH is nil", ErrInvalidEncoding)
+	}
+	dh := h.DH.Bytes()
+	if len(dh) == 0 {
+		return nil, fmt.Errorf("%w: header.DH is empty", ErrInvalidEncoding)
+	}
+	if h.PN < 0 || h.N < 0 {
+		return nil, fmt.Errorf("%w: header.PN and header.N must not be negative", ErrInvalidEncoding)
+	}
+
+	b = append(b, dh...)
+	b = binary.AppendUvarint(b, uint64(h.PN))
+	b = binary.AppendUvarint(b, uint64(h.N))
+	if h.version() == EncodingVersionKEM {
+		b = appendBytes(b, h.KEMPublicKey)
+		b = appendBytes(b, h.KEMCiphertext)
+	}
+	return b, nil
+}
+
+// readBinary reads DH || PN || N with a public key of suite and the KEM ratchet data of version from r
+func (h *MessageHeader) readBinary(r *bytes.Reader, suite CryptoSuite, version byte) error {
+	dh := make([]byte, suite.PublicKeySize())
+	if _, err := io.ReadFull(r, dh); err != nil {
+		return fmt.Errorf("%w: header too short", ErrInvalidEncoding)
+	}
+	key, err := suite.ParsePublicKey(dh)
+	if err != nil {
+		return err
+	}
+	pn, err := readUvarint(r)
+	if err != nil {
+		return err
+	}
+	n, err := readUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	var kemPublicKey, kemCiphertext []byte
+	if version == EncodingVersionKEM {
+		if kemPublicKey, err = readBytes(r); err != nil {
+			return err
+		}
+		if kemCiphertext, err = readBytes(r); err != nil {
+			return err
+		}
+		if kemPublicKey == nil && kemCiphertext == nil {
+			return fmt.Errorf("%w: KEM header without KEM data", ErrInvalidEncoding)
+		}
+	}
+
+	h.DH = key
+	h.PN = pn
+	h.N = n
+	h.KEMPublicKey = kemPublicKey
+	h.KEMCiphertext = kemCiphertext
+	return nil
+}
+
+func readVersion(r *bytes.Reader) (byte, error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: missing version", ErrInvalidEncoding)
+	}
+	if version != EncodingVersion && version != EncodingVersionKEM {
+		return 0, fmt.Errorf("%w: unknown version %d", ErrInvalidEncoding, version)
+	}
+	return version, nil
+}
+
+// readUvarint reads a minimally encoded varint, which fits into an int
+func readUvarint(r *bytes.Reader) (int, error) {
+	start := r.Len()
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidEncoding, err.Error())
+	}
+	if start-r.Len() != len(binary.AppendUvarint(nil, v)) {
+		return 0, fmt.Errorf("%w: non-minimal varint", ErrInvalidEncoding)
+	}
+	if v > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("%w: varint overflows int", ErrInvalidEncoding)
+	}
+	return int(v), nil
+}
@@ -0,0 +1,186 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// testDH is the public key 0x00 0x01 ... 0x1f of the golden vectors
+const testDH = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func goldenHeader(t *testing.T, pn, n int, kemPublicKey []byte) *MessageHeader {
+	t.Helper()
+	dh, err := hex.DecodeString(testDH)
+	if err != nil {
+		t.Fatal("DecodeString failed:", err.Error())
+	}
+	key, err := DefaultSuite.ParsePublicKey(dh)
+	if err != nil {
+		t.Fatal("ParsePublicKey failed:", err.Error())
+	}
+	return &MessageHeader{DH: key, PN: pn, N: n, KEMPublicKey: kemPublicKey}
+}
+
+func TestHeaderGoldenBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header *MessageHeader
+		want   string
+	}{
+		{"counters", goldenHeader(t, 0, 1, nil), "01" + testDH + "00" + "01"},
+		{"multi-byte varints", goldenHeader(t, 300, 128, nil), "01" + testDH + "ac02" + "8001"},
+		{"KEM ratchet", goldenHeader(t, 0, 0, []byte{0xaa, 0xbb}), "02" + testDH + "00" + "00" + "02aabb" + "00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := test.header.MarshalBinary()
+			if err != nil {
+				t.Fatal("MarshalBinary failed:", err.Error())
+			}
+			if hex.EncodeToString(encoded) != test.want {
+				t.Fatalf("Expected %s, Actual: %x", test.want, encoded)
+			}
+			var decoded MessageHeader
+			if err := decoded.UnmarshalBinary(encoded); err != nil {
+				t.Fatal("UnmarshalBinary failed:", err.Error())
+			}
+			if !decoded.Equals(test.header) || !bytes.Equal(decoded.KEMPublicKey, test.header.KEMPublicKey) {
+				t.Fatal("Decoded header differs")
+			}
+		})
+	}
+}
+
+func TestConcatGoldenBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		ad     []byte
+		header *MessageHeader
+		want   string
+	}{
+		{"associated data", []byte("ad"), goldenHeader(t, 0, 1, nil), "01" + "02" + "6164" + testDH + "00" + "01"},
+		{"empty associated data", nil, goldenHeader(t, 0, 1, nil), "01" + "00" + testDH + "00" + "01"},
+		{"KEM ratchet", []byte("ad"), goldenHeader(t, 0, 0, []byte{0xaa, 0xbb}), "02" + "02" + "6164" + testDH + "00" + "00" + "02aabb" + "00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := Concat(test.ad, test.header)
+			if err != nil {
+				t.Fatal("Concat failed:", err.Error())
+			}
+			if hex.EncodeToString(encoded) != test.want {
+				t.Fatalf("Expected %s, Actual: %x", test.want, encoded)
+			}
+			header, ad, err := Parse(encoded)
+			if err != nil {
+				t.Fatal("Parse failed:", err.Error())
+			}
+			if !header.Equals(test.header) || !bytes.Equal(ad, test.ad) {
+				t.Fatal("Parsed header or associated data differs")
+			}
+		})
+	}
+}
+
+func TestConcatEncryptedHeaderGoldenBytes(t *testing.T) {
+	encHeader := []byte{0xaa, 0xbb, 0xcc}
+	tests := []struct {
+		name string
+		ad   []byte
+		want string
+	}{
+		{"associated data", []byte("ad"), "01" + "02" + "6164" + "aabbcc"},
+		{"empty associated data", nil, "01" + "00" + "aabbcc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if encoded := hex.EncodeToString(concatEncryptedHeader(test.ad, encHeader)); encoded != test.want {
+				t.Fatalf("Expected %s, Actual: %s", test.want, encoded)
+			}
+		})
+	}
+}
+
+func TestHeaderEncodingRejectsMalformedInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"bad version", "03" + testDH + "00" + "01"},
+		{"non-minimal varint", "01" + testDH + "8000" + "01"},
+		{"trailing bytes", "01" + testDH + "00" + "01" + "ff"},
+		{"truncated key", "01" + testDH[:20]},
+		{"KEM version without KEM data", "02" + testDH + "00" + "00" + "00" + "00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.data)
+			var header MessageHeader
+			if err := header.UnmarshalBinary(data); !errors.Is(err, ErrInvalidEncoding) {
+				t.Fatal("Expected ErrInvalidEncoding, Actual:", err)
+			}
+		})
+	}
+}
+
+func TestParseRejectsMalformedInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"bad version", "00" + "00" + testDH + "00" + "01"},
+		{"non-minimal AD length", "01" + "8000" + testDH + "00" + "01"},
+		{"non-minimal header varint", "01" + "00" + testDH + "00" + "8100"},
+		{"truncated AD", "01" + "05" + "6164"},
+		{"trailing bytes", "01" + "00" + testDH + "00" + "01" + "ff"},
+		{"truncated header", "01" + "02" + "6164" + testDH[:20]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.data)
+			if _, _, err := Parse(data); !errors.Is(err, ErrInvalidEncoding) {
+				t.Fatal("Expected ErrInvalidEncoding, Actual:", err)
+			}
+		})
+	}
+}
+
+func TestHeaderOfOtherSuite(t *testing.T) {
+	dhPair, err := X448Suite.GenerateDH(rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateDH failed:", err.Error())
+	}
+	header := CreateHeader(dhPair, 2, 3)
+
+	encoded, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+	decoded, err := ParseHeader(X448Suite, encoded)
+	if err != nil {
+		t.Fatal("ParseHeader failed:", err.Error())
+	}
+	if !decoded.Equals(header) {
+		t.Fatal("Decoded header differs")
+	}
+
+	concatenated, err := Concat([]byte("ad"), header)
+	if err != nil {
+		t.Fatal("Concat failed:", err.Error())
+	}
+	parsed, ad, err := ParseWithSuite(X448Suite, concatenated)
+	if err != nil {
+		t.Fatal("ParseWithSuite failed:", err.Error())
+	}
+	if !parsed.Equals(header) || string(ad) != "ad" {
+		t.Fatal("Parsed header or associated data differs")
+	}
+
+	// the encoding does not identify the suite, a X448 header is no valid DefaultSuite header
+	if _, _, err := Parse(concatenated); err == nil {
+		t.Fatal("X448 header was parsed as DefaultSuite header")
+	}
+}
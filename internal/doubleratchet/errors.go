@@ -0,0 +1,55 @@
+package doubleratchet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of the Double Ratchet. All functions wrap them, so callers can tell the failures apart with errors.Is and errors.As.
+var (
+	// ErrAuthentication is returned if a message or an encrypted header does not authenticate under the derived key,
+	// the message was tampered with or was not encrypted for this session.
+	ErrAuthentication = errors.New("authentication failed")
+	// ErrDuplicateMessage is returned for a message which has already been decrypted, see ConsumedKeys.
+	ErrDuplicateMessage = errors.New("duplicate message")
+	// ErrMessageKeyExpired is returned for a skipped message whose message key has been evicted by the limits of the
+	// SkippedKeyStore before the message arrived.
+	ErrMessageKeyExpired = errors.New("message key expired")
+	// ErrMaxSkipExceeded is returned if a message is too far ahead of the receiving chain, see MaxSkipError.
+	ErrMaxSkipExceeded = errors.New("skipping too many messages (MaxSkip)")
+	// ErrInvalidEncoding is returned for headers, concatenations and persisted states which can not be decoded.
+	ErrInvalidEncoding = errors.New("invalid encoding")
+	// ErrInvalidKey is returned for keys of the wrong length or of another CryptoSuite.
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrNoSendingChain is returned if Bob encrypts before he received the first message of Alice.
+	ErrNoSendingChain = errors.New("no sending chain, Bob has to receive a message first")
+	// ErrKEMMismatch is returned for KEM ratchet data, which does not match the KEM ratchet of the session.
+	ErrKEMMismatch = errors.New("KEM ratchet data does not match the session")
+	// ErrKEMTooLate is returned by EnableKEMRatchet once the session sent or received a message.
+	ErrKEMTooLate = errors.New("the KEM ratchet has to be enabled before the first message")
+	// ErrStaleDecrypt is returned by PendingDecrypt.Commit if the state changed after PrepareDecrypt,
+	// or if the decryption has already been committed or discarded.
+	ErrStaleDecrypt = errors.New("state changed since the message was decrypted")
+	// ErrUnknownSuite is returned for a persisted state of a CryptoSuite which is not known.
+	ErrUnknownSuite = errors.New("unknown crypto suite")
+)
+
+// errNoSkippedMessageKey is returned by trySkippedMessageKeys if there is no skipped message key for a header,
+// the message is decrypted with the receiving chain then
+var errNoSkippedMessageKey = errors.New("no skipped message key")
+
+// MaxSkipError is returned if a message would require storing more than MaxSkip skipped message keys.
+// It wraps ErrMaxSkipExceeded.
+type MaxSkipError struct {
+	Nr      int // number of messages received in the current receiving chain
+	Until   int // message number of the header
+	MaxSkip int
+}
+
+func (e *MaxSkipError) Error() string {
+	return fmt.Sprintf("%s: %d messages received, message number %d", ErrMaxSkipExceeded.Error(), e.Nr, e.Until)
+}
+
+func (e *MaxSkipError) Unwrap() error {
+	return ErrMaxSkipExceeded
+}
@@ -0,0 +1,115 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMaxSkipError(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1")
+	s.aliceSentMessages[0].header.N = 3000
+
+	err := s.bobReceiveMessageUnsafe(s.aliceSentMessages[0])
+	if !errors.Is(err, ErrMaxSkipExceeded) {
+		t.Fatal("Expected ErrMaxSkipExceeded, Actual:", err)
+	}
+	var maxSkipErr *MaxSkipError
+	if !errors.As(err, &maxSkipErr) {
+		t.Fatal("Expected a MaxSkipError, Actual:", err)
+	}
+	if maxSkipErr.Until != 3000 || maxSkipErr.MaxSkip != MaxSkip {
+		t.Fatalf("Unexpected MaxSkipError: %+v", maxSkipErr)
+	}
+}
+
+func TestAuthenticationError(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+
+	// a1 is decrypted with a skipped message key, which must survive the forgery
+	a1 := s.aliceSentMessages[0]
+	tampered := bytes.Clone(a1.ciphertext)
+	tampered[len(tampered)-1] ^= 0x01
+	_, err := s.bob.RatchetDecrypt(a1.header, tampered, []byte("associatedData"))
+	if !errors.Is(err, ErrAuthentication) {
+		t.Fatal("Expected ErrAuthentication, Actual:", err)
+	}
+	s.bobReceiveMessages(1)
+}
+
+func TestDuplicateMessageError(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1")
+	a1 := *s.aliceSentMessages[0]
+	s.bobReceiveMessages(1)
+
+	if err := s.bobReceiveMessageUnsafe(&a1); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrDuplicateMessage, Actual:", err)
+	}
+
+	alice, bob := initTestHE(t)
+	a1HE := sendMessageHE(t, alice, "a1")
+	receiveMessageHE(t, bob, a1HE)
+	if _, err := bob.RatchetDecryptHE(a1HE.encHeader, a1HE.ciphertext, []byte("associatedData")); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrDuplicateMessage, Actual:", err)
+	}
+}
+
+func TestMessageKeyExpiredError(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.bob.MKSkipped.(*MemorySkippedKeyStore).MaxKeys = 1
+	s.aliceSendMessages("a1", "a2", "a3")
+	s.bobReceiveMessages(3)
+
+	// the skipped message key of a1 was evicted by the one of a2, a1 has never been decrypted
+	a1 := *s.aliceSentMessages[0]
+	err := s.bobReceiveMessageUnsafe(&a1)
+	if !errors.Is(err, ErrMessageKeyExpired) || errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrMessageKeyExpired, Actual:", err)
+	}
+	s.bobReceiveMessages(2)
+
+	alice, bob := initTestHE(t)
+	bob.MKSkipped.(*MemorySkippedKeyStore).MaxKeys = 1
+	a1HE := sendMessageHE(t, alice, "a1")
+	a2HE := sendMessageHE(t, alice, "a2")
+	receiveMessageHE(t, bob, sendMessageHE(t, alice, "a3"))
+	_, err = bob.RatchetDecryptHE(a1HE.encHeader, a1HE.ciphertext, []byte("associatedData"))
+	if !errors.Is(err, ErrMessageKeyExpired) || errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrMessageKeyExpired, Actual:", err)
+	}
+	receiveMessageHE(t, bob, a2HE)
+}
+
+func TestNoSendingChainError(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	if _, _, err := s.bob.RatchetEncrypt([]byte("b1"), nil); !errors.Is(err, ErrNoSendingChain) {
+		t.Fatal("Expected ErrNoSendingChain, Actual:", err)
+	}
+
+	_, bob := initTestHE(t)
+	if _, _, err := bob.RatchetEncryptHE([]byte("b1"), nil); !errors.Is(err, ErrNoSendingChain) {
+		t.Fatal("Expected ErrNoSendingChain, Actual:", err)
+	}
+}
+
+func TestInvalidKeyError(t *testing.T) {
+	if _, _, err := KDFChainKey([]byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey, Actual:", err)
+	}
+	if _, _, err := X448Suite.KDFChainKey([]byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey, Actual:", err)
+	}
+	if _, err := ParseHeader(DefaultSuite, []byte{EncodingVersion}); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatal("Expected ErrInvalidEncoding, Actual:", err)
+	}
+	if _, err := RatchetInitAlice(bytes.Repeat([]byte{0x01}, 32), nil); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey, Actual:", err)
+	}
+	if _, err := RatchetInitAliceHE(bytes.Repeat([]byte{0x01}, 32), nil, nil, nil); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey, Actual:", err)
+	}
+}
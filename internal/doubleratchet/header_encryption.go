@@ -0,0 +1,469 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+// Double Ratchet with header encryption as specified in https://signal.org/docs/specifications/doubleratchet/#double-ratchet-with-header-encryption
+// The header keys HKs, HKr, NHKs and NHKr are stored in State, skipped message keys are indexed by header key instead of ratchet key.
+
+/*
+def RatchetInitAliceHE(state, SK, bob_dh_public_key, shared_hka, shared_nhkb):
+    state.DHRs = GENERATE_DH()
+    state.DHRr = bob_dh_public_key
+    state.RK, state.CKs, state.NHKs = KDF_RK_HE(SK, DH(state.DHRs, state.DHRr))
+    state.CKr = None
+    state.Ns = 0
+    state.Nr = 0
+    state.PN = 0
+    state.MKSKIPPED = {}
+    state.HKs = shared_hka
+    state.HKr = None
+    state.NHKr = shared_nhkb
+*/
+
+// RatchetInitAliceHE is RatchetInitAlice with header encryption.
+// sharedHKa and sharedNHKb are two further 32-byte secrets agreed alongside secretKey.
+func RatchetInitAliceHE(secretKey []byte, bobDHPublicKey *ecdh.PublicKey, sharedHKa, sharedNHKb []byte) (s *State, err error) {
+	if bobDHPublicKey == nil {
+		return nil, fmt.Errorf("%w: bobDHPublicKey is nil", ErrInvalidKey)
+	}
+	return RatchetInitAliceHEWithSuite(DefaultSuite, secretKey, bobDHPublicKey, sharedHKa, sharedNHKb)
+}
+
+// RatchetInitAliceHEWithSuite is RatchetInitAliceHE for a State bound to suite.
+func RatchetInitAliceHEWithSuite(suite CryptoSuite, secretKey []byte, bobDHPublicKey PublicKey, sharedHKa, sharedNHKb []byte) (s *State, err error) {
+	return RatchetInitAliceHEWithRandom(suite, nil, secretKey, bobDHPublicKey, sharedHKa, sharedNHKb)
+}
+
+// RatchetInitAliceHEWithRandom is RatchetInitAliceHEWithSuite with random as entropy source of the State, crypto/rand.Reader if nil.
+func RatchetInitAliceHEWithRandom(suite CryptoSuite, random io.Reader, secretKey []byte, bobDHPublicKey PublicKey, sharedHKa, sharedNHKb []byte) (s *State, err error) {
+	s = &State{
+		Suite:     suite,
+		Rand:      random,
+		DHr:       bobDHPublicKey,
+		CKr:       nil,
+		Ns:        0,
+		Nr:        0,
+		PN:        0,
+		MKSkipped: NewMemorySkippedKeyStore(),
+		Consumed:  NewConsumedKeys(),
+		HKs:       sharedHKa,
+		HKr:       nil,
+		NHKr:      sharedNHKb,
+	}
+
+	s.DHs, err = s.suite().GenerateDH(s.random())
+	if err != nil {
+		return nil, err
+	}
+
+	dhOut, err := s.suite().DH(s.DHs, s.DHr)
+	if err != nil {
+		return nil, err
+	}
+	s.RK, s.CKs, s.NHKs, err = s.suite().KDFRootKeyHE(secretKey, dhOut)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+/*
+def RatchetInitBobHE(state, SK, bob_dh_key_pair, shared_hka, shared_nhkb):
+    state.DHRs = bob_dh_key_pair
+    state.DHRr = None
+    state.RK = SK
+    state.CKs = None
+    state.CKr = None
+    state.Ns = 0
+    state.Nr = 0
+    state.PN = 0
+    state.MKSKIPPED = {}
+    state.HKs = None
+    state.NHKs = shared_nhkb
+    state.HKr = None
+    state.NHKr = shared_hka
+*/
+
+// RatchetInitBobHE is RatchetInitBob with header encryption.
+func RatchetInitBobHE(secretKey []byte, bobDHKeyPair *ecdh.PrivateKey, sharedHKa, sharedNHKb []byte) *State {
+	return RatchetInitBobHEWithSuite(DefaultSuite, secretKey, bobDHKeyPair, sharedHKa, sharedNHKb)
+}
+
+// RatchetInitBobHEWithSuite is RatchetInitBobHE for a State bound to suite.
+func RatchetInitBobHEWithSuite(suite CryptoSuite, secretKey []byte, bobDHKeyPair PrivateKey, sharedHKa, sharedNHKb []byte) *State {
+	return &State{
+		Suite:     suite,
+		DHs:       bobDHKeyPair,
+		DHr:       nil,
+		RK:        secretKey,
+		CKs:       nil,
+		CKr:       nil,
+		Ns:        0,
+		Nr:        0,
+		PN:        0,
+		MKSkipped: NewMemorySkippedKeyStore(),
+		Consumed:  NewConsumedKeys(),
+		HKs:       nil,
+		NHKs:      sharedNHKb,
+		HKr:       nil,
+		NHKr:      sharedHKa,
+	}
+}
+
+/*
+def RatchetEncryptHE(state, plaintext, AD):
+    state.CKs, mk = KDF_CK(state.CKs)
+    header = HEADER(state.DHRs, state.PN, state.Ns)
+    enc_header = HENCRYPT(state.HKs, header)
+    state.Ns += 1
+    return enc_header, ENCRYPT(mk, plaintext, CONCAT(AD, enc_header))
+*/
+
+func (s *State) RatchetEncryptHE(plaintext, ad []byte) (encHeader, ciphertext []byte, err error) {
+	if len(s.HKs) == 0 || len(s.CKs) == 0 {
+		return nil, nil, ErrNoSendingChain
+	}
+
+	var mk []byte
+	s.CKs, mk, err = s.suite().KDFChainKey(s.CKs)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := CreateHeader(s.DHs, s.PN, s.Ns)
+	s.KEM.attach(header)
+
+	encHeader, err = headerEncrypt(s.random(), s.HKs, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.Ns++
+
+	ciphertext, err = s.suite().Encrypt(mk, plaintext, concatEncryptedHeader(ad, encHeader))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encHeader, ciphertext, nil
+}
+
+// RatchetDecryptHE decrypts a message with an encrypted header and updates the state at once,
+// see PrepareDecryptHE for a decryption which is only applied once the caller stored the plaintext.
+func (s *State) RatchetDecryptHE(encHeader, ciphertext, associatedData []byte) (plaintext []byte, err error) {
+	pending, err := s.PrepareDecryptHE(encHeader, ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if err := pending.Commit(); err != nil {
+		return nil, err
+	}
+	return pending.Plaintext, nil
+}
+
+/*
+def RatchetDecryptHE(state, enc_header, ciphertext, AD):
+    plaintext = TrySkippedMessageKeysHE(state, enc_header, ciphertext, AD)
+    if plaintext != None:
+        return plaintext
+    header, dh_ratchet = DecryptHeader(state, enc_header)
+    if dh_ratchet:
+        SkipMessageKeysHE(state, header.pn)
+        DHRatchetHE(state, header)
+    SkipMessageKeysHE(state, header.n)
+    state.CKr, mk = KDF_CK(state.CKr)
+    state.Nr += 1
+    return DECRYPT(mk, ciphertext, CONCAT(AD, enc_header))
+*/
+
+// ratchetDecryptHE is RatchetDecryptHE on a staged copy of the state, see PrepareDecryptHE.
+// It returns the (header key, N) pair of the message, which is remembered as consumed on commit.
+func (s *State) ratchetDecryptHE(encHeader, ciphertext, associatedData []byte) (plaintext []byte, consumed SkippedKey, err error) {
+	// keys expire with time as well, not only with DH ratchet steps
+	if err := s.MKSkipped.Expire(s.Step, s.now()); err != nil {
+		return nil, consumed, err
+	}
+	plaintext, consumed, err = s.trySkippedMessageKeysHE(encHeader, ciphertext, associatedData)
+	if !errors.Is(err, errNoSkippedMessageKey) {
+		return plaintext, consumed, err
+	}
+
+	// the header key of a previous chain can only decrypt the header of a duplicate
+	if duplicate, ok := s.consumedHE(encHeader); ok {
+		return nil, duplicate, fmt.Errorf("%w: message %d", ErrDuplicateMessage, duplicate.N)
+	}
+
+	header, dhRatchet, err := s.decryptHeader(encHeader)
+	if err != nil {
+		return nil, consumed, err
+	}
+	// consumed messages were caught above, so the skipped message key has been evicted
+	if !dhRatchet && header.N < s.Nr {
+		return nil, consumed, fmt.Errorf("%w: message %d", ErrMessageKeyExpired, header.N)
+	}
+
+	if dhRatchet {
+		if err := s.skipMessageKeysHE(header.PN); err != nil {
+			return nil, consumed, err
+		}
+		if err := s.dhRatchetHE(header); err != nil {
+			return nil, consumed, err
+		}
+	}
+
+	if err := s.skipMessageKeysHE(header.N); err != nil {
+		return nil, consumed, err
+	}
+
+	var mk []byte
+	s.CKr, mk, err = s.suite().KDFChainKey(s.CKr)
+	if err != nil {
+		return nil, consumed, err
+	}
+	s.Nr++
+
+	plaintext, err = s.suite().Decrypt(mk, ciphertext, concatEncryptedHeader(associatedData, encHeader))
+	if err != nil {
+		return nil, consumed, err
+	}
+	return plaintext, SkippedKey{Chain: string(s.HKr), N: header.N}, nil
+}
+
+/*
+def TrySkippedMessageKeysHE(state, enc_header, ciphertext, AD):
+    for ((hk, n), mk) in state.MKSKIPPED.items():
+        header = HDECRYPT(hk, enc_header)
+        if header != None and header.n == n:
+            del state.MKSKIPPED[hk, n]
+            return DECRYPT(mk, ciphertext, CONCAT(AD, enc_header))
+    return None
+*/
+
+func (s *State) trySkippedMessageKeysHE(encHeader, ciphertext, associatedData []byte) ([]byte, SkippedKey, error) {
+	keys, err := s.MKSkipped.Keys()
+	if err != nil {
+		return nil, SkippedKey{}, err
+	}
+
+	// a header key decrypts all headers of its chain, so every header key is only tried once
+	tried := make(map[string]bool)
+	for _, key := range keys {
+		if tried[key.Chain] {
+			continue
+		}
+		tried[key.Chain] = true
+
+		header, err := headerDecrypt(s.suite(), []byte(key.Chain), encHeader)
+		if err != nil {
+			continue
+		}
+		skippedKey := SkippedKey{Chain: key.Chain, N: header.N}
+		mk, ok, err := s.MKSkipped.Get(skippedKey)
+		if err != nil {
+			return nil, skippedKey, err
+		}
+		if !ok {
+			continue
+		}
+
+		plaintext, err := s.suite().Decrypt(mk, ciphertext, concatEncryptedHeader(associatedData, encHeader))
+		if err != nil {
+			return nil, skippedKey, err
+		}
+		if err := s.MKSkipped.Delete(skippedKey); err != nil {
+			return nil, skippedKey, err
+		}
+		return plaintext, skippedKey, nil
+	}
+	return nil, SkippedKey{}, errNoSkippedMessageKey
+}
+
+/*
+def DecryptHeader(state, enc_header):
+    header = HDECRYPT(state.HKr, enc_header)
+    if header != None:
+        return header, False
+    header = HDECRYPT(state.NHKr, enc_header)
+    if header != None:
+        return header, True
+    raise Error()
+*/
+
+func (s *State) decryptHeader(encHeader []byte) (header *MessageHeader, dhRatchet bool, err error) {
+	if len(s.HKr) != 0 {
+		header, err = headerDecrypt(s.suite(), s.HKr, encHeader)
+		if err == nil {
+			return header, false, nil
+		}
+	}
+	header, err = headerDecrypt(s.suite(), s.NHKr, encHeader)
+	if err == nil {
+		return header, true, nil
+	}
+	return nil, false, fmt.Errorf("%w: header could not be decrypted", ErrAuthentication)
+}
+
+/*
+def SkipMessageKeysHE(state, until):
+    if state.Nr + MAX_SKIP < until:
+        raise Error()
+    if state.CKr != None:
+        while state.Nr < until:
+            state.CKr, mk = KDF_CK(state.CKr)
+            state.MKSKIPPED[state.HKr, state.Nr] = mk
+            state.Nr += 1
+*/
+
+func (s *State) skipMessageKeysHE(until int) error {
+	if s.Nr+MaxSkip < until {
+		return &MaxSkipError{Nr: s.Nr, Until: until, MaxSkip: MaxSkip}
+	}
+	if len(s.CKr) != 0 {
+		for s.Nr < until {
+			var mk []byte
+			var err error
+			s.CKr, mk, err = s.suite().KDFChainKey(s.CKr)
+			if err != nil {
+				return err
+			}
+			err = s.MKSkipped.Put(SkippedMessageKey{
+				SkippedKey: SkippedKey{Chain: string(s.HKr), N: s.Nr},
+				MK:         mk,
+				Step:       s.Step,
+				StoredAt:   s.now(),
+			})
+			if err != nil {
+				return err
+			}
+			s.Nr++
+		}
+	}
+	return nil
+}
+
+/*
+def DHRatchetHE(state, header):
+    state.PN = state.Ns
+    state.Ns = 0
+    state.Nr = 0
+    state.HKs = state.NHKs
+    state.HKr = state.NHKr
+    state.DHRr = header.dh
+    state.RK, state.CKr, state.NHKr = KDF_RK_HE(state.RK, DH(state.DHRs, state.DHRr))
+    state.DHRs = GENERATE_DH()
+    state.RK, state.CKs, state.NHKs = KDF_RK_HE(state.RK, DH(state.DHRs, state.DHRr))
+*/
+
+func (s *State) dhRatchetHE(header *MessageHeader) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.HKs = s.NHKs
+	s.HKr = s.NHKr
+	s.DHr = header.DH
+
+	dhOut, err := s.suite().DH(s.DHs, s.DHr)
+	if err != nil {
+		return err
+	}
+	kemOut, err := s.kemReceive(header)
+	if err != nil {
+		return err
+	}
+	s.RK, s.CKr, s.NHKr, err = s.suite().KDFRootKeyHE(s.RK, append(dhOut, kemOut...))
+	if err != nil {
+		return err
+	}
+
+	s.DHs, err = s.suite().GenerateDH(s.random())
+	if err != nil {
+		return err
+	}
+
+	dhOut, err = s.suite().DH(s.DHs, s.DHr)
+	if err != nil {
+		return err
+	}
+	kemOut, err = s.kemSend(header)
+	if err != nil {
+		return err
+	}
+	s.RK, s.CKs, s.NHKs, err = s.suite().KDFRootKeyHE(s.RK, append(dhOut, kemOut...))
+	if err != nil {
+		return err
+	}
+
+	s.Step++
+	return s.MKSkipped.Expire(s.Step, s.now())
+}
+
+// KDFRootKeyHE returns a triple (32-byte root key, 32-byte chain key, 32-byte next header key)
+// as the output of applying a KDF keyed by a 32-byte root key rk to a Diffie-Hellman output dhOut
+func KDFRootKeyHE(rk, dhOut []byte) (rootKey, chainKey, nextHeaderKey []byte, err error) {
+	return DefaultSuite.KDFRootKeyHE(rk, dhOut)
+}
+
+// HeaderEncrypt returns the AEAD encryption of header with header key hk.
+// The same header key encrypts many headers, so XChaCha20-Poly1305 with a random 24-byte nonce is used,
+// the nonce is prepended to the output.
+func HeaderEncrypt(hk []byte, header *MessageHeader) ([]byte, error) {
+	return headerEncrypt(rand.Reader, hk, header)
+}
+
+func headerEncrypt(random io.Reader, hk []byte, header *MessageHeader) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(hk)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, encoded, nil), nil
+}
+
+// HeaderDecrypt returns the header of encHeader. If authentication with header key hk fails, an error is returned.
+// The header has to carry a DefaultSuite key.
+func HeaderDecrypt(hk, encHeader []byte) (*MessageHeader, error) {
+	return headerDecrypt(DefaultSuite, hk, encHeader)
+}
+
+func headerDecrypt(suite CryptoSuite, hk, encHeader []byte) (*MessageHeader, error) {
+	aead, err := chacha20poly1305.NewX(hk)
+	if err != nil {
+		return nil, err
+	}
+	if len(encHeader) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: encrypted header too short", ErrAuthentication)
+	}
+
+	encoded, err := aead.Open(nil, encHeader[:aead.NonceSize()], encHeader[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseHeader(suite, encoded)
+}
+
+// concatEncryptedHeader is Concat for an encrypted header: version || len(ad) || ad || enc_header
+func concatEncryptedHeader(ad, encHeader []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(EncodingVersion)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(ad))))
+	buf.Write(ad)
+	buf.Write(encHeader)
+	return buf.Bytes()
+}
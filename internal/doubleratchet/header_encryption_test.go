@@ -0,0 +1,127 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"testing"
+)
+
+type messageHE struct {
+	encHeader  []byte
+	ciphertext []byte
+	plaintext  []byte
+}
+
+func initTestHE(t *testing.T) (alice, bob *State) {
+	t.Helper()
+	sharedSecret := bytes.Repeat([]byte{0x01}, 32)
+	sharedHKa := bytes.Repeat([]byte{0x02}, 32)
+	sharedNHKb := bytes.Repeat([]byte{0x03}, 32)
+
+	bobKeyPair, err := GenerateDH()
+	if err != nil {
+		t.Fatal("Could not generate KeyPair", err.Error())
+	}
+	bob = RatchetInitBobHE(sharedSecret, bobKeyPair, sharedHKa, sharedNHKb)
+	alice, err = RatchetInitAliceHE(sharedSecret, bobKeyPair.PublicKey(), sharedHKa, sharedNHKb)
+	if err != nil {
+		t.Fatal("Could not init Alice", err.Error())
+	}
+	return alice, bob
+}
+
+func sendMessageHE(t *testing.T, s *State, msg string) *messageHE {
+	t.Helper()
+	encHeader, ciphertext, err := s.RatchetEncryptHE([]byte(msg), []byte("associatedData"))
+	if err != nil {
+		t.Fatal("Could not encrypt message", err.Error())
+	}
+	return &messageHE{
+		encHeader:  encHeader,
+		ciphertext: ciphertext,
+		plaintext:  []byte(msg),
+	}
+}
+
+func receiveMessageHE(t *testing.T, s *State, message *messageHE) {
+	t.Helper()
+	plaintext, err := s.RatchetDecryptHE(message.encHeader, message.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("Could not decrypt message", err.Error())
+	}
+	if !bytes.Equal(message.plaintext, plaintext) {
+		t.Fatal("Did not receive the correct plaintext")
+	}
+}
+
+func TestDoubleRatchetHEIntegration(t *testing.T) {
+	alice, bob := initTestHE(t)
+
+	if _, _, err := bob.RatchetEncryptHE([]byte("too early"), nil); err == nil {
+		t.Fatal("Bob should not be able to send before receiving a message")
+	}
+
+	a1 := sendMessageHE(t, alice, "a1")
+	a2 := sendMessageHE(t, alice, "a2")
+	a3 := sendMessageHE(t, alice, "a3")
+	receiveMessageHE(t, bob, a2)
+
+	b1 := sendMessageHE(t, bob, "b1")
+	receiveMessageHE(t, alice, b1)
+
+	// a1 and a3 were skipped in a previous receiving chain, their keys are indexed by the old header key
+	a4 := sendMessageHE(t, alice, "a4")
+	receiveMessageHE(t, bob, a4)
+	receiveMessageHE(t, bob, a3)
+	receiveMessageHE(t, bob, a1)
+	if n := skippedKeyCount(t, bob); n != 0 {
+		t.Fatalf("%d skipped message keys left", n)
+	}
+
+	for range 3 {
+		receiveMessageHE(t, alice, sendMessageHE(t, bob, "ping"))
+		receiveMessageHE(t, bob, sendMessageHE(t, alice, "pong"))
+	}
+}
+
+func TestDoubleRatchetHEHidesHeader(t *testing.T) {
+	alice, bob := initTestHE(t)
+	a1 := sendMessageHE(t, alice, "a1")
+
+	if bytes.Contains(a1.encHeader, alice.DHs.Public().(PublicKey).Bytes()) {
+		t.Fatal("Encrypted header contains the ratchet public key")
+	}
+	if _, err := HeaderDecrypt(bytes.Repeat([]byte{0x04}, 32), a1.encHeader); err == nil {
+		t.Fatal("Header decrypted with a wrong header key")
+	}
+
+	tampered := bytes.Clone(a1.encHeader)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := bob.RatchetDecryptHE(tampered, a1.ciphertext, []byte("associatedData")); err == nil {
+		t.Fatal("Tampered header should not be accepted")
+	}
+
+	// the encrypted header is part of the associated data of the message
+	a2 := sendMessageHE(t, alice, "a2")
+	if _, err := bob.RatchetDecryptHE(a2.encHeader, a1.ciphertext, []byte("associatedData")); err == nil {
+		t.Fatal("Ciphertext should not be accepted under another header")
+	}
+
+	receiveMessageHE(t, bob, a1)
+	receiveMessageHE(t, bob, a2)
+}
+
+func TestDoubleRatchetHEMaxSkip(t *testing.T) {
+	alice, bob := initTestHE(t)
+
+	header := CreateHeader(alice.DHs, 0, MaxSkip+1)
+	encHeader, err := HeaderEncrypt(alice.HKs, header)
+	if err != nil {
+		t.Fatal("HeaderEncrypt failed:", err.Error())
+	}
+	if _, err := bob.RatchetDecryptHE(encHeader, []byte("ciphertext"), nil); err == nil {
+		t.Fatal("Should not skip more than MaxSkip message keys")
+	}
+
+	// Bob's state has been restored
+	receiveMessageHE(t, bob, sendMessageHE(t, alice, "a1"))
+}
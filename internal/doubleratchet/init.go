@@ -5,7 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"maps"
+	"io"
 )
 
 /*
@@ -23,7 +23,13 @@ def RatchetInitBob(state, SK, bob_dh_key_pair):
 
 // secretKey is the shared secret
 func RatchetInitBob(secretKey []byte, bobDHKeyPair *ecdh.PrivateKey) *State {
+	return RatchetInitBobWithSuite(DefaultSuite, secretKey, bobDHKeyPair)
+}
+
+// RatchetInitBobWithSuite is RatchetInitBob for a State bound to suite, bobDHKeyPair has to be a key pair of suite.
+func RatchetInitBobWithSuite(suite CryptoSuite, secretKey []byte, bobDHKeyPair PrivateKey) *State {
 	return &State{
+		Suite:     suite,
 		DHs:       bobDHKeyPair,
 		DHr:       nil,
 		RK:        secretKey,
@@ -32,7 +38,8 @@ func RatchetInitBob(secretKey []byte, bobDHKeyPair *ecdh.PrivateKey) *State {
 		Ns:        0,
 		Nr:        0,
 		PN:        0,
-		MKSkipped: make(map[mkSkippedKey][]byte),
+		MKSkipped: NewMemorySkippedKeyStore(),
+		Consumed:  NewConsumedKeys(),
 	}
 }
 
@@ -50,25 +57,42 @@ def RatchetInitAlice(state, SK, bob_dh_public_key):
 
 // secretKey is the shared secret
 func RatchetInitAlice(secretKey []byte, bobDHPublicKey *ecdh.PublicKey) (s *State, err error) {
+	if bobDHPublicKey == nil {
+		return nil, fmt.Errorf("%w: bobDHPublicKey is nil", ErrInvalidKey)
+	}
+	return RatchetInitAliceWithSuite(DefaultSuite, secretKey, bobDHPublicKey)
+}
+
+// RatchetInitAliceWithSuite is RatchetInitAlice for a State bound to suite, bobDHPublicKey has to be a public key of suite.
+func RatchetInitAliceWithSuite(suite CryptoSuite, secretKey []byte, bobDHPublicKey PublicKey) (s *State, err error) {
+	return RatchetInitAliceWithRandom(suite, nil, secretKey, bobDHPublicKey)
+}
+
+// RatchetInitAliceWithRandom is RatchetInitAliceWithSuite with random as entropy source of the State, crypto/rand.Reader if nil.
+// Alice generates her first key pair during the initialization, Bob's entropy source can be set as State.Rand afterwards.
+func RatchetInitAliceWithRandom(suite CryptoSuite, random io.Reader, secretKey []byte, bobDHPublicKey PublicKey) (s *State, err error) {
 	s = &State{
+		Suite:     suite,
+		Rand:      random,
 		DHr:       bobDHPublicKey,
 		CKr:       nil,
 		Ns:        0,
 		Nr:        0,
 		PN:        0,
-		MKSkipped: make(map[mkSkippedKey][]byte),
+		MKSkipped: NewMemorySkippedKeyStore(),
+		Consumed:  NewConsumedKeys(),
 	}
 
-	s.DHs, err = GenerateDH()
+	s.DHs, err = s.suite().GenerateDH(s.random())
 	if err != nil {
 		return nil, err
 	}
 
-	dhOut, err := DH(s.DHs, s.DHr)
+	dhOut, err := s.suite().DH(s.DHs, s.DHr)
 	if err != nil {
 		return nil, err
 	}
-	s.RK, s.CKs, err = KDFRootKey(secretKey, dhOut)
+	s.RK, s.CKs, err = s.suite().KDFRootKey(secretKey, dhOut)
 	if err != nil {
 		return nil, err
 	}
@@ -85,18 +109,26 @@ def RatchetEncrypt(state, plaintext, AD):
 */
 
 func (s *State) RatchetEncrypt(plaintext, ad []byte) (header *MessageHeader, ciphertext []byte, err error) {
+	if len(s.CKs) == 0 {
+		return nil, nil, ErrNoSendingChain
+	}
+
 	var mk []byte
-	s.CKs, mk = KDFChainKey(s.CKs)
+	s.CKs, mk, err = s.suite().KDFChainKey(s.CKs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the header carries Ns before the increment, so the first message of a chain has N = 0 as in the specification
+	header = CreateHeader(s.DHs, s.PN, s.Ns)
+	s.KEM.attach(header)
 	s.Ns++
 
-	header = CreateHeader(s.DHs, s.PN, s.Ns)
 	data, err := Concat(ad, header)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	//fmt.Printf("Encrypt called with mk: %v\n plaintext:%v\n associatedData:%v", mk, plaintext, data)
-	ciphertext, err = Encrypt(mk, plaintext, data)
+	ciphertext, err = s.suite().Encrypt(mk, plaintext, data)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -104,6 +136,19 @@ func (s *State) RatchetEncrypt(plaintext, ad []byte) (header *MessageHeader, cip
 	return header, ciphertext, nil
 }
 
+// RatchetDecrypt decrypts a message and updates the state at once, see PrepareDecrypt for a decryption which is
+// only applied once the caller stored the plaintext.
+func (s *State) RatchetDecrypt(header *MessageHeader, ciphertext, associatedData []byte) (plaintext []byte, err error) {
+	pending, err := s.PrepareDecrypt(header, ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if err := pending.Commit(); err != nil {
+		return nil, err
+	}
+	return pending.Plaintext, nil
+}
+
 /*
 def RatchetDecrypt(state, header, ciphertext, AD):
     plaintext = TrySkippedMessageKeys(state, header, ciphertext, AD)
@@ -118,81 +163,60 @@ def RatchetDecrypt(state, header, ciphertext, AD):
     return DECRYPT(mk, ciphertext, CONCAT(AD, header))
 */
 
-func (s *State) RatchetDecrypt(header *MessageHeader, ciphertext, associatedData []byte) (plaintext []byte, err error) {
-	backup := *s
-
-	plaintext, err = s.trySkippedMessageKeys(header, ciphertext, associatedData)
-	if err == nil {
-		return plaintext, nil
-	} else {
-		//fmt.Printf("TrySkippedMessageKeys failed with error: %s\n", err.Error())
+// ratchetDecrypt is RatchetDecrypt on a staged copy of the state, see PrepareDecrypt.
+// It returns the (ratchet key, N) pair of the message, which is remembered as consumed on commit.
+func (s *State) ratchetDecrypt(header *MessageHeader, ciphertext, associatedData []byte) (plaintext []byte, consumed SkippedKey, err error) {
+	if header == nil || header.DH == nil {
+		return nil, consumed, fmt.Errorf("%w: header.DH is nil", ErrInvalidEncoding)
 	}
+	consumed = SkippedKey{Chain: string(header.DH.Bytes()), N: header.N}
 
-	if header.DH == nil {
-		return nil, errors.New("header.DH is nil")
+	// keys expire with time as well, not only with DH ratchet steps
+	if err := s.MKSkipped.Expire(s.Step, s.now()); err != nil {
+		return nil, consumed, err
 	}
-	if s.DHr == nil {
-		//fmt.Println("s.DHr is nil")
-		// TODO maybe s.DHr should be set to header.DH
-		s.DHr = header.DH
-		//return nil, errors.New("s.DHr is nil")
+	plaintext, err = s.trySkippedMessageKeys(header, ciphertext, associatedData)
+	if !errors.Is(err, errNoSkippedMessageKey) {
+		return plaintext, consumed, err
 	}
-
-	// make ratchet step if first message
-	if len(s.CKr) == 0 {
-		//fmt.Println("s.CKr is nil")
-		err = s.dhRatchet(header)
-		if err != nil {
-			//fmt.Println("Error in dhRatchet when CKr is nil")
-			*s = backup
-			return nil, err
-		}
+	if s.Consumed.Contains(consumed) {
+		return nil, consumed, fmt.Errorf("%w: message %d", ErrDuplicateMessage, header.N)
+	}
+	// an earlier message of the current receiving chain, whose skipped message key has been evicted
+	if s.DHr != nil && header.DH.Equal(s.DHr) && header.N < s.Nr {
+		return nil, consumed, fmt.Errorf("%w: message %d", ErrMessageKeyExpired, header.N)
 	}
-	//fmt.Println(s.toString())
 
-	//fmt.Printf("RatchetDecrypt header.DH: %s, s.DHr: %s\n", header.DH.Bytes(), s.DHr.Bytes())
-	if !header.DH.Equal(s.DHr) {
-		//fmt.Println("Header.DH isn't equal to s.DHr")
-		err = s.skipMessageKeys(header.PN)
-		if err != nil {
-			*s = backup
-			return nil, err
+	// s.DHr is nil for Bob until the first message arrived
+	if s.DHr == nil || !header.DH.Equal(s.DHr) {
+		if err := s.skipMessageKeys(header.PN); err != nil {
+			return nil, consumed, err
 		}
-		//fmt.Printf("Run s.dhRatchet\n")
-		err = s.dhRatchet(header)
-		if err != nil {
-			*s = backup
-			return nil, err
+		if err := s.dhRatchet(header); err != nil {
+			return nil, consumed, err
 		}
-	} else {
-		//fmt.Println("Header.DH is equal to s.DHr")
-		s.Nr++
-
 	}
 
-	//fmt.Println("Message Keys to be Skipped", header.N)
-	err = s.skipMessageKeys(header.N)
-	if err != nil {
-		*s = backup
-		return nil, err
+	if err := s.skipMessageKeys(header.N); err != nil {
+		return nil, consumed, err
 	}
 
 	var mk []byte
-	s.CKr, mk = KDFChainKey(s.CKr)
+	s.CKr, mk, err = s.suite().KDFChainKey(s.CKr)
+	if err != nil {
+		return nil, consumed, err
+	}
 	s.Nr++
 
 	data, err := Concat(associatedData, header)
 	if err != nil {
-		*s = backup
-		return nil, err
+		return nil, consumed, err
 	}
-
-	plaintext, err = Decrypt(mk, ciphertext, data)
+	plaintext, err = s.suite().Decrypt(mk, ciphertext, data)
 	if err != nil {
-		*s = backup
-		return nil, err
+		return nil, consumed, err
 	}
-	return plaintext, nil
+	return plaintext, consumed, nil
 }
 
 /*
@@ -206,35 +230,31 @@ def TrySkippedMessageKeys(state, header, ciphertext, AD):
 */
 
 func (s *State) trySkippedMessageKeys(header *MessageHeader, cypertext, associatedData []byte) ([]byte, error) {
-	key := mkSkippedKey{
-		DH: string(header.DH.Bytes()),
-		N:  header.N,
+	key := SkippedKey{
+		Chain: string(header.DH.Bytes()),
+		N:     header.N,
 	}
 
-	//fmt.Printf("TrySkippedMessageKey with key: %+v\n", key)
+	mk, ok, err := s.MKSkipped.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errNoSkippedMessageKey
+	}
 
-	if mk, ok := s.MKSkipped[key]; ok {
-		//fmt.Printf("Found Skipped Message Key: %+v\n", key)
-		//fmt.Printf("Found Message Key: %+v\n", mk)
-		delete(s.MKSkipped, key)
-		//fmt.Printf("Found Message Key after deleting entry: %+v\n", mk)
-		data, err := Concat(associatedData, header)
-		if err != nil {
-			return nil, err
-		}
-		if mk == nil {
-			return nil, errors.New("mk is nil, error with pointer or smth")
-		}
-		tempPlaintext, tempErr := Decrypt(mk, cypertext, data)
-		if tempErr != nil {
-			//fmt.Printf("Error Decrypting Message Key: %+v with error: %s\n", key, err.Error())
-			return nil, tempErr
-		}
-		//fmt.Printf("Decrypted Plaintext: %s with Skipped Message Key: %+v\n", tempPlaintext, key)
-		return tempPlaintext, nil
+	data, err := Concat(associatedData, header)
+	if err != nil {
+		return nil, err
 	}
-	//fmt.Printf("No Skipped Message Key Found with Key: %+v\n", key)
-	return nil, errors.New("no skipped message keys")
+	plaintext, err := s.suite().Decrypt(mk, cypertext, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.MKSkipped.Delete(key); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
 }
 
 /*
@@ -250,23 +270,28 @@ def SkipMessageKeys(state, until):
 
 func (s *State) skipMessageKeys(until int) error {
 	if s.Nr+MaxSkip < until {
-		return errors.New("skipping to many messages (MaxSkip)")
+		return &MaxSkipError{Nr: s.Nr, Until: until, MaxSkip: MaxSkip}
 	}
-	//fmt.Printf("s.CKr: %s; length: %d\n", s.CKr, len(s.CKr))
 	if len(s.CKr) != 0 {
 		for s.Nr < until {
 			var mk []byte
-			s.CKr, mk = KDFChainKey(s.CKr)
-			key := mkSkippedKey{
-				DH: string(s.DHr.Bytes()),
-				N:  s.Nr,
+			var err error
+			s.CKr, mk, err = s.suite().KDFChainKey(s.CKr)
+			if err != nil {
+				return err
+			}
+			err = s.MKSkipped.Put(SkippedMessageKey{
+				SkippedKey: SkippedKey{Chain: string(s.DHr.Bytes()), N: s.Nr},
+				MK:         mk,
+				Step:       s.Step,
+				StoredAt:   s.now(),
+			})
+			if err != nil {
+				return err
 			}
-			//fmt.Printf("Skipping MessageKey with key: %+v\n", key)
-			s.MKSkipped[key] = mk
 			s.Nr++
 		}
 	} else {
-		//fmt.Println("s.CKr is nil, cannot skip message keys")
 		/*dhOut, err := DH(s.DHs, s.DHr)
 		if err != nil {
 			return err
@@ -297,36 +322,51 @@ func (s *State) dhRatchet(header *MessageHeader) error {
 	s.Nr = 0
 	s.DHr = header.DH
 
-	// state.RK, state.CKr = KDF_RK(state.RK, DH(state.DHs, state.DHr))
-	dhOut, err := DH(s.DHs, s.DHr)
+	// state.RK, state.CKr = KDF_RK(state.RK, DH(state.DHs, state.DHr) || SS), SS only if the KEM ratchet is enabled
+	dhOut, err := s.suite().DH(s.DHs, s.DHr)
 	if err != nil {
 		return err
 	}
-	s.RK, s.CKr, err = KDFRootKey(s.RK, dhOut)
+	kemOut, err := s.kemReceive(header)
+	if err != nil {
+		return err
+	}
+	s.RK, s.CKr, err = s.suite().KDFRootKey(s.RK, append(dhOut, kemOut...))
 	if err != nil {
 		return err
 	}
 
-	s.DHs, err = GenerateDH()
+	s.DHs, err = s.suite().GenerateDH(s.random())
 	if err != nil {
 		return err
 	}
 
-	// state.RK, state.CKs = KDF_RK(state.RK, DH(state.DHs, state.DHr))
-	dhOut, err = DH(s.DHs, s.DHr)
+	// state.RK, state.CKs = KDF_RK(state.RK, DH(state.DHs, state.DHr) || SS)
+	dhOut, err = s.suite().DH(s.DHs, s.DHr)
 	if err != nil {
 		return err
 	}
-	s.RK, s.CKs, err = KDFRootKey(s.RK, dhOut)
+	kemOut, err = s.kemSend(header)
 	if err != nil {
 		return err
 	}
-	return nil
+	s.RK, s.CKs, err = s.suite().KDFRootKey(s.RK, append(dhOut, kemOut...))
+	if err != nil {
+		return err
+	}
+
+	// the previous receiving chain has been replaced, purge the keys of chains which are too many steps old
+	s.Step++
+	return s.MKSkipped.Expire(s.Step, s.now())
 }
 
 func (s *State) toString() string {
-	return fmt.Sprintf("State{DHs: %s, DHr: %s, RK: %s, CKs: %s, CKr: %s, Ns: %d, Nr: %d, PN: %d, MKSkipped: %v}",
-		byteSliceToBase64(s.DHs.PublicKey().Bytes()),
+	var dhs []byte
+	if pub, err := publicKey(s.DHs); err == nil {
+		dhs = pub.Bytes()
+	}
+	return fmt.Sprintf("State{DHs: %s, DHr: %s, RK: %s, CKs: %s, CKr: %s, Ns: %d, Nr: %d, PN: %d, Step: %d}",
+		byteSliceToBase64(dhs),
 		byteSliceToBase64(s.DHr.Bytes()),
 		byteSliceToBase64(s.RK),
 		byteSliceToBase64(s.CKs),
@@ -334,7 +374,7 @@ func (s *State) toString() string {
 		s.Ns,
 		s.Nr,
 		s.PN,
-		maps.Keys(s.MKSkipped),
+		s.Step,
 	)
 }
 
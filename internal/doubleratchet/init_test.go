@@ -56,6 +56,69 @@ func TestDoubleRatchetIntegrationSimple(t *testing.T) {
 	s.aliceReceiveMessages(1)
 }
 
+// TestMessageNumbering pins the numbering of the specification: N counts from 0 in every sending chain, PN is the
+// length of the previous one and the receiver starts with a DH ratchet step on the first message
+func TestMessageNumbering(t *testing.T) {
+	s := initTest(t, []byte("very secret"))
+
+	s.aliceSendMessages("a0", "a1")
+	for i, m := range s.aliceSentMessages {
+		if m.header.N != i || m.header.PN != 0 {
+			t.Fatalf("Expected N=%d, PN=0, Actual: N=%d, PN=%d", i, m.header.N, m.header.PN)
+		}
+	}
+
+	// Bob has no ratchet key of Alice yet, the second message skips the key of the first one
+	s.bobReceiveMessages(2)
+	if !s.bob.DHr.Equal(s.aliceSentMessages[0].header.DH) || s.bob.Nr != 2 {
+		t.Fatal("First message has to start a receiving chain with a DH ratchet step")
+	}
+	s.bobReceiveMessages(1)
+
+	s.bobSendMessages("b0")
+	if b0 := s.bobSentMessages[0].header; b0.N != 0 || b0.PN != 0 {
+		t.Fatalf("Expected N=0, PN=0, Actual: N=%d, PN=%d", b0.N, b0.PN)
+	}
+	s.aliceReceiveMessages(1)
+
+	s.aliceSendMessages("a2")
+	if a2 := s.aliceSentMessages[2].header; a2.N != 0 || a2.PN != 2 {
+		t.Fatalf("Expected N=0, PN=2, Actual: N=%d, PN=%d", a2.N, a2.PN)
+	}
+	s.bobReceiveMessages(3)
+}
+
+// TestMessageNumberingHE pins the same numbering for header encryption, the headers are decrypted with the header key
+// of the sender
+func TestMessageNumberingHE(t *testing.T) {
+	alice, bob := initTestHE(t)
+	send := func(s *State, msg string, n, pn int) *messageHE {
+		t.Helper()
+		hk := s.HKs
+		message := sendMessageHE(t, s, msg)
+		header, err := headerDecrypt(s.suite(), hk, message.encHeader)
+		if err != nil {
+			t.Fatal("headerDecrypt failed:", err.Error())
+		}
+		if header.N != n || header.PN != pn {
+			t.Fatalf("Expected N=%d, PN=%d, Actual: N=%d, PN=%d", n, pn, header.N, header.PN)
+		}
+		return message
+	}
+
+	a0 := send(alice, "a0", 0, 0)
+	a1 := send(alice, "a1", 1, 0)
+	// Bob has no ratchet key of Alice yet, the second message skips the key of the first one
+	receiveMessageHE(t, bob, a1)
+	if bob.DHr == nil || bob.Nr != 2 {
+		t.Fatal("First message has to start a receiving chain with a DH ratchet step")
+	}
+	receiveMessageHE(t, bob, a0)
+
+	receiveMessageHE(t, alice, send(bob, "b0", 0, 0))
+	receiveMessageHE(t, bob, send(alice, "a2", 0, 2))
+}
+
 func (s *testState) bobSendMessages(messages ...string) {
 	for _, msg := range messages {
 		s.bobSentMessages = append(s.bobSentMessages, sendMessage(s.t, s.bob, msg))
@@ -0,0 +1,190 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"signal/internal/testutil"
+	"strings"
+	"testing"
+)
+
+var updateKAT = flag.Bool("update", false, "rewrite the known-answer vectors in testdata")
+
+// katConversation drives Alice and Bob from seeded DRBGs, it is the same for all vectors:
+// Bob receives a2 before a1 and Alice receives b3 before b2, so skipped message keys are used in both directions.
+var katConversation = []struct {
+	from, name string
+	receive    bool
+}{
+	{"alice", "a1", false},
+	{"alice", "a2", false},
+	{"bob", "a2", true},
+	{"bob", "a1", true},
+	{"bob", "b1", false},
+	{"alice", "b1", true},
+	{"alice", "a3", false},
+	{"bob", "a3", true},
+	{"bob", "b2", false},
+	{"bob", "b3", false},
+	{"alice", "b3", true},
+	{"alice", "b2", true},
+}
+
+// katParty sends and receives the messages of one party of the conversation
+type katParty interface {
+	encrypt(plaintext []byte) (header, ciphertext []byte, err error)
+	decrypt(header, ciphertext []byte) ([]byte, error)
+}
+
+type katState struct {
+	*State
+}
+
+func (s katState) encrypt(plaintext []byte) ([]byte, []byte, error) {
+	header, ciphertext, err := s.RatchetEncrypt(plaintext, []byte("associatedData"))
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded, err := header.MarshalBinary()
+	return encoded, ciphertext, err
+}
+
+func (s katState) decrypt(encoded, ciphertext []byte) ([]byte, error) {
+	header, err := ParseHeader(s.suite(), encoded)
+	if err != nil {
+		return nil, err
+	}
+	return s.RatchetDecrypt(header, ciphertext, []byte("associatedData"))
+}
+
+type katStateHE struct {
+	*State
+}
+
+func (s katStateHE) encrypt(plaintext []byte) ([]byte, []byte, error) {
+	return s.RatchetEncryptHE(plaintext, []byte("associatedData"))
+}
+
+func (s katStateHE) decrypt(encHeader, ciphertext []byte) ([]byte, error) {
+	return s.RatchetDecryptHE(encHeader, ciphertext, []byte("associatedData"))
+}
+
+func initKAT(t *testing.T, suite CryptoSuite, he, kem bool) (alice, bob katParty) {
+	t.Helper()
+	aliceRand := testutil.NewDRBG("alice")
+	bobRand := testutil.NewDRBG("bob")
+	sharedSecret := bytes.Repeat([]byte{0x01}, 32)
+	sharedHKa := bytes.Repeat([]byte{0x02}, 32)
+	sharedNHKb := bytes.Repeat([]byte{0x03}, 32)
+
+	bobKeyPair, err := suite.GenerateDH(bobRand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPublicKey, err := publicKey(bobKeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var aliceState, bobState *State
+	if he {
+		bobState = RatchetInitBobHEWithSuite(suite, sharedSecret, bobKeyPair, sharedHKa, sharedNHKb)
+		aliceState, err = RatchetInitAliceHEWithRandom(suite, aliceRand, sharedSecret, bobPublicKey, sharedHKa, sharedNHKb)
+	} else {
+		bobState = RatchetInitBobWithSuite(suite, sharedSecret, bobKeyPair)
+		aliceState, err = RatchetInitAliceWithRandom(suite, aliceRand, sharedSecret, bobPublicKey)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobState.Rand = bobRand
+
+	if kem {
+		for _, s := range []*State{aliceState, bobState} {
+			if err := s.EnableKEMRatchet(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if he {
+		return katStateHE{aliceState}, katStateHE{bobState}
+	}
+	return katState{aliceState}, katState{bobState}
+}
+
+// runKAT plays katConversation and returns one line "name header ciphertext" per sent message
+func runKAT(t *testing.T, alice, bob katParty) []string {
+	t.Helper()
+	parties := map[string]katParty{"alice": alice, "bob": bob}
+	sent := make(map[string][2][]byte)
+
+	var lines []string
+	for _, step := range katConversation {
+		party := parties[step.from]
+		plaintext := []byte("message " + step.name)
+		if step.receive {
+			msg := sent[step.name]
+			decrypted, err := party.decrypt(msg[0], msg[1])
+			if err != nil {
+				t.Fatalf("%s could not decrypt %s: %s", step.from, step.name, err.Error())
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("%s did not receive the correct plaintext of %s", step.from, step.name)
+			}
+			continue
+		}
+
+		header, ciphertext, err := party.encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("%s could not encrypt %s: %s", step.from, step.name, err.Error())
+		}
+		sent[step.name] = [2][]byte{header, ciphertext}
+		lines = append(lines, fmt.Sprintf("%s %x %x", step.name, header, ciphertext))
+	}
+	return lines
+}
+
+// TestKnownAnswers compares the exact headers and ciphertexts of deterministic conversations with testdata/kat_*.txt.
+// Run go test -run TestKnownAnswers -update to rewrite the vectors after an intended change of the wire format or a KDF.
+func TestKnownAnswers(t *testing.T) {
+	tests := []struct {
+		name    string
+		suite   CryptoSuite
+		he, kem bool
+	}{
+		{"default", DefaultSuite, false, false},
+		{"x448", X448Suite, false, false},
+		{"signal", SignalSuite, false, false},
+		{"default_he", DefaultSuite, true, false},
+		{"default_kem", DefaultSuite, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alice, bob := initKAT(t, test.suite, test.he, test.kem)
+			actual := strings.Join(runKAT(t, alice, bob), "\n") + "\n"
+
+			// the same seeds have to result in the same conversation
+			alice, bob = initKAT(t, test.suite, test.he, test.kem)
+			if again := strings.Join(runKAT(t, alice, bob), "\n") + "\n"; again != actual {
+				t.Fatal("Conversation is not deterministic")
+			}
+
+			path := "testdata/kat_" + test.name + ".txt"
+			if *updateKAT {
+				if err := os.WriteFile(path, []byte(actual), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != string(expected) {
+				t.Fatalf("Conversation differs from %s", path)
+			}
+		})
+	}
+}
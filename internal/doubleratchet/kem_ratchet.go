@@ -0,0 +1,137 @@
+package doubleratchet
+
+import (
+	"fmt"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"io"
+)
+
+// The KEM ratchet is a sparse ML-KEM-768 ratchet which runs alongside the DH ratchet, so an adversary with a quantum computer
+// who recorded the messages can not derive the keys of a session from the DH outputs alone.
+// It takes turns like the DH ratchet, but a party only offers a new encapsulation key once per epoch of KEMEpochSteps DH ratchet steps:
+//
+//   - a party which has no unanswered encapsulation key generates a key pair in the sending step which starts an epoch
+//     and attaches the encapsulation key to every header of that sending chain
+//   - the peer encapsulates to it in its next sending step and mixes the shared secret into the root key:
+//     RK, CKs = KDF_RK(RK, DH(DHs, DHr) || SS), the ciphertext is attached to every header of the new sending chain
+//   - the party decapsulates the ciphertext in its receiving step: RK, CKr = KDF_RK(RK, DH(DHs, DHr) || SS)
+//
+// Headers of chains without KEM data keep the classic encoding, so only the chains which offer or answer a key in an epoch
+// carry the 1184 byte encapsulation key or the 1088 byte ciphertext, all other chains cost no more than in a classic session.
+// A key which is still unanswered at the start of an epoch stays attached, the party skips that epoch.
+// Both parties have to enable the KEM ratchet for a session, for example when the session was established with PQXDH.
+
+// KEMEpochSteps is the number of DH ratchet steps of a KEM epoch. A party offers at most one encapsulation key per epoch,
+// so the shared secret of the KEM is mixed into the root key at least every KEMEpochSteps steps of both parties.
+const KEMEpochSteps = 4
+
+// KEMRatchet is the state of the KEM ratchet of a session.
+type KEMRatchet struct {
+	DecapsulationKey *mlkem768.PrivateKey // key pair whose encapsulation key was sent and not answered yet, nil if none
+	Ciphertext       []byte               // ciphertext for the peer's last encapsulation key, attached to the current sending chain
+}
+
+// EnableKEMRatchet enables the KEM ratchet for the session. Both parties have to enable it right after the initialization,
+// before the first message is sent or received. A party with a sending chain, Alice, offers her first encapsulation key right away.
+func (s *State) EnableKEMRatchet() error {
+	if s.KEM != nil {
+		return nil
+	}
+	if s.Ns != 0 || s.Nr != 0 || s.Step != 0 {
+		return fmt.Errorf("%w: %d messages sent, %d received", ErrKEMTooLate, s.Ns, s.Nr)
+	}
+
+	kem := &KEMRatchet{}
+	if len(s.CKs) != 0 {
+		if err := kem.generate(s.random()); err != nil {
+			return err
+		}
+	}
+	s.KEM = kem
+	return nil
+}
+
+func (k *KEMRatchet) generate(random io.Reader) error {
+	_, private, err := mlkem768.GenerateKeyPair(random)
+	if err != nil {
+		return err
+	}
+	k.DecapsulationKey = private
+	return nil
+}
+
+// attach adds the KEM data of the current sending chain to header
+func (k *KEMRatchet) attach(header *MessageHeader) {
+	if k == nil {
+		return
+	}
+	if k.DecapsulationKey != nil {
+		header.KEMPublicKey = make([]byte, mlkem768.PublicKeySize)
+		k.DecapsulationKey.Public().(*mlkem768.PublicKey).Pack(header.KEMPublicKey)
+	}
+	header.KEMCiphertext = k.Ciphertext
+}
+
+// kemReceive returns the shared secret of the ciphertext in header for the receiving step of the DH ratchet, nil if there is none.
+// The KEM state is replaced instead of modified, so a failed decryption can restore the previous state.
+func (s *State) kemReceive(header *MessageHeader) ([]byte, error) {
+	if s.KEM == nil {
+		if header.KEMPublicKey != nil || header.KEMCiphertext != nil {
+			return nil, fmt.Errorf("%w: KEM ratchet is not enabled for this session", ErrKEMMismatch)
+		}
+		return nil, nil
+	}
+	if header.KEMCiphertext == nil {
+		return nil, nil
+	}
+	if s.KEM.DecapsulationKey == nil {
+		return nil, fmt.Errorf("%w: unexpected KEM ciphertext", ErrKEMMismatch)
+	}
+	if len(header.KEMCiphertext) != mlkem768.CiphertextSize {
+		return nil, fmt.Errorf("%w: KEM ciphertext has to be %d bytes, Actual: %d", ErrInvalidEncoding, mlkem768.CiphertextSize, len(header.KEMCiphertext))
+	}
+
+	sharedSecret := make([]byte, mlkem768.SharedKeySize)
+	s.KEM.DecapsulationKey.DecapsulateTo(sharedSecret, header.KEMCiphertext)
+
+	// the encapsulation key has been answered
+	next := *s.KEM
+	next.DecapsulationKey = nil
+	s.KEM = &next
+	return sharedSecret, nil
+}
+
+// kemSend returns the shared secret for the sending step of the DH ratchet, nil if the peer sent no encapsulation key.
+// It also generates a new key pair if the last one has been answered and the step starts a KEM epoch.
+func (s *State) kemSend(header *MessageHeader) ([]byte, error) {
+	if s.KEM == nil {
+		return nil, nil
+	}
+
+	next := *s.KEM
+	next.Ciphertext = nil
+	var sharedSecret []byte
+	if header.KEMPublicKey != nil {
+		if len(header.KEMPublicKey) != mlkem768.PublicKeySize {
+			return nil, fmt.Errorf("%w: KEM encapsulation key has to be %d bytes, Actual: %d", ErrInvalidKey, mlkem768.PublicKeySize, len(header.KEMPublicKey))
+		}
+		peerKey := &mlkem768.PublicKey{}
+		if err := peerKey.Unpack(header.KEMPublicKey); err != nil {
+			return nil, fmt.Errorf("%w: invalid KEM encapsulation key: %s", ErrInvalidKey, err.Error())
+		}
+		seed := make([]byte, mlkem768.EncapsulationSeedSize)
+		if _, err := io.ReadFull(s.random(), seed); err != nil {
+			return nil, err
+		}
+		next.Ciphertext = make([]byte, mlkem768.CiphertextSize)
+		sharedSecret = make([]byte, mlkem768.SharedKeySize)
+		peerKey.EncapsulateTo(next.Ciphertext, sharedSecret, seed)
+	}
+	if next.DecapsulationKey == nil && s.Step%KEMEpochSteps == 0 {
+		if err := next.generate(s.random()); err != nil {
+			return nil, err
+		}
+	}
+	s.KEM = &next
+	return sharedSecret, nil
+}
@@ -0,0 +1,245 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"testing"
+)
+
+func initTestKEM(t *testing.T) *testState {
+	t.Helper()
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	if err := s.alice.EnableKEMRatchet(); err != nil {
+		t.Fatal("EnableKEMRatchet failed:", err.Error())
+	}
+	if err := s.bob.EnableKEMRatchet(); err != nil {
+		t.Fatal("EnableKEMRatchet failed:", err.Error())
+	}
+	return s
+}
+
+func TestKEMRatchet(t *testing.T) {
+	s := initTestKEM(t)
+
+	// Alice offers an encapsulation key, there is nothing to answer yet
+	s.aliceSendMessages("a1", "a2")
+	firstKey := s.aliceSentMessages[0].header.KEMPublicKey
+	if firstKey == nil || s.aliceSentMessages[0].header.KEMCiphertext != nil {
+		t.Fatal("Alice's first chain has to carry only her encapsulation key")
+	}
+	s.bobReceiveMessages(2)
+
+	// Bob answers with a ciphertext and offers his own encapsulation key
+	s.bobSendMessages("b1", "b2")
+	if b1 := s.bobSentMessages[0].header; b1.KEMPublicKey == nil || b1.KEMCiphertext == nil {
+		t.Fatal("Bob's chain has to carry a ciphertext and his encapsulation key")
+	}
+	s.aliceReceiveMessages(2)
+	s.bobReceiveMessages(1)
+
+	// Alice's first DH ratchet step starts a KEM epoch
+	s.aliceSendMessages("a3")
+	if a3 := s.aliceSentMessages[2].header; a3.KEMPublicKey == nil || a3.KEMCiphertext == nil {
+		t.Fatal("Alice's second chain has to carry a ciphertext and a new encapsulation key")
+	}
+	if bytes.Equal(s.aliceSentMessages[2].header.KEMPublicKey, firstKey) {
+		t.Fatal("Alice reused her answered encapsulation key")
+	}
+
+	// restored states keep the KEM ratchet
+	s.alice = restoreState(t, s.alice)
+	s.bob = restoreState(t, s.bob)
+	if s.alice.KEM == nil || s.bob.KEM == nil {
+		t.Fatal("Restored state lost the KEM ratchet")
+	}
+
+	s.bobReceiveMessages(3)
+	s.aliceReceiveMessages(1)
+	s.bobSendMessages("b3")
+	s.aliceReceiveMessages(3)
+}
+
+// TestKEMRatchetIsSparse checks that a party offers one encapsulation key per KEM epoch and answers it with one ciphertext,
+// all other chains carry no KEM data
+func TestKEMRatchetIsSparse(t *testing.T) {
+	s := initTestKEM(t)
+	s.aliceSendMessages("a0")
+	for i := 0; i < 2*KEMEpochSteps; i++ {
+		s.bobReceiveMessages(i + 1)
+		s.bobSendMessages(fmt.Sprintf("b%d", i))
+
+		// Bob answers Alice's first key and the keys she offers in the first step of her epochs
+		b := s.bobSentMessages[i].header
+		if (b.KEMPublicKey != nil) != (i%KEMEpochSteps == 0) || (b.KEMCiphertext != nil) != (i == 0 || i%KEMEpochSteps == 1) {
+			t.Fatalf("Unexpected KEM data in Bob's chain %d: key %t, ciphertext %t", i, b.KEMPublicKey != nil, b.KEMCiphertext != nil)
+		}
+		s.aliceReceiveMessages(i + 1)
+		s.aliceSendMessages(fmt.Sprintf("a%d", i+1))
+
+		// Alice answers Bob's key in the same chain, in which she offers her own
+		a := s.aliceSentMessages[i+1].header
+		if (a.KEMPublicKey != nil) != (i%KEMEpochSteps == 0) || (a.KEMCiphertext != nil) != (i%KEMEpochSteps == 0) {
+			t.Fatalf("Unexpected KEM data in Alice's chain %d: key %t, ciphertext %t", i, a.KEMPublicKey != nil, a.KEMCiphertext != nil)
+		}
+	}
+}
+
+// TestKEMRatchetMixesSharedSecret checks that the receiving chain key is derived from DH(DHs, DHr) || SS
+func TestKEMRatchetMixesSharedSecret(t *testing.T) {
+	s := initTestKEM(t)
+	s.aliceSendMessages("a1")
+	s.bobReceiveMessages(1)
+	s.bobSendMessages("b1")
+
+	rk, dhs, dk := s.alice.RK, s.alice.DHs, s.alice.KEM.DecapsulationKey
+	b1 := s.bobSentMessages[0].header
+	s.aliceReceiveMessages(1)
+
+	dhOut, err := DefaultSuite.DH(dhs, b1.DH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedSecret := make([]byte, mlkem768.SharedKeySize)
+	dk.DecapsulateTo(sharedSecret, b1.KEMCiphertext)
+
+	_, classicCKr, err := KDFRootKey(rk, dhOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expectedCKr, err := KDFRootKey(rk, append(dhOut, sharedSecret...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Alice already derived the message key of b1, so her receiving chain key is one step further
+	expectedCKr, _, _ = KDFChainKey(expectedCKr)
+	classicCKr, _, _ = KDFChainKey(classicCKr)
+	if !bytes.Equal(s.alice.CKr, expectedCKr) {
+		t.Fatal("Receiving chain key is not derived from the DH output and the KEM shared secret")
+	}
+	if bytes.Equal(s.alice.CKr, classicCKr) {
+		t.Fatal("Receiving chain key is derived from the DH output alone")
+	}
+}
+
+func TestKEMRatchetIsNegotiatedPerSession(t *testing.T) {
+	// classic sessions keep the classic header encoding
+	classic := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	classic.aliceSendMessages("a1")
+	encoded, err := classic.aliceSentMessages[0].header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[0] != EncodingVersion {
+		t.Fatalf("Expected header version %d, Actual: %d", EncodingVersion, encoded[0])
+	}
+
+	// a peer without KEM ratchet rejects KEM headers and keeps its state
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	if err := s.alice.EnableKEMRatchet(); err != nil {
+		t.Fatal(err)
+	}
+	s.aliceSendMessages("a1")
+	before, err := s.bob.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.bobReceiveMessageUnsafe(s.aliceSentMessages[0]); err == nil {
+		t.Fatal("Session without KEM ratchet accepted a KEM header")
+	}
+	after, err := s.bob.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("Rejected message changed the state")
+	}
+
+	// the KEM ratchet can not be enabled in the middle of a session
+	classic.bobReceiveMessages(1)
+	if err := classic.bob.EnableKEMRatchet(); !errors.Is(err, ErrKEMTooLate) {
+		t.Fatal("Expected ErrKEMTooLate, Actual:", err)
+	}
+}
+
+func TestKEMRatchetRejectsTamperedCiphertext(t *testing.T) {
+	s := initTestKEM(t)
+	s.aliceSendMessages("a1")
+	s.bobReceiveMessages(1)
+	s.bobSendMessages("b1", "b2")
+
+	tampered := *s.bobSentMessages[0]
+	tampered.header = &MessageHeader{
+		DH:            tampered.header.DH,
+		PN:            tampered.header.PN,
+		N:             tampered.header.N,
+		KEMPublicKey:  tampered.header.KEMPublicKey,
+		KEMCiphertext: bytes.Clone(tampered.header.KEMCiphertext),
+	}
+	tampered.header.KEMCiphertext[0] ^= 0xff
+	if _, err := s.alice.RatchetDecrypt(tampered.header, tampered.ciphertext, []byte("associatedData")); err == nil {
+		t.Fatal("Message with a tampered KEM ciphertext was accepted")
+	}
+
+	// the encapsulation key is only answered by the valid ciphertext
+	if s.alice.KEM.DecapsulationKey == nil {
+		t.Fatal("Rejected message consumed the decapsulation key")
+	}
+	s.aliceReceiveMessages(2, 1)
+}
+
+func TestKEMRatchetHE(t *testing.T) {
+	alice, bob := initTestHE(t)
+	for _, s := range []*State{alice, bob} {
+		if err := s.EnableKEMRatchet(); err != nil {
+			t.Fatal("EnableKEMRatchet failed:", err.Error())
+		}
+	}
+
+	a1 := sendMessageHE(t, alice, "a1")
+	receiveMessageHE(t, bob, sendMessageHE(t, alice, "a2"))
+	receiveMessageHE(t, alice, sendMessageHE(t, bob, "b1"))
+	alice = restoreState(t, alice)
+	receiveMessageHE(t, bob, sendMessageHE(t, alice, "a3"))
+	receiveMessageHE(t, bob, a1)
+	receiveMessageHE(t, alice, sendMessageHE(t, bob, "b2"))
+}
+
+func TestKEMHeaderEncoding(t *testing.T) {
+	dhKP, err := GenerateDH()
+	if err != nil {
+		t.Fatal("GenerateDH failed:", err.Error())
+	}
+	header := &MessageHeader{
+		DH:            dhKP.PublicKey(),
+		PN:            2,
+		N:             7,
+		KEMCiphertext: bytes.Repeat([]byte{0x05}, mlkem768.CiphertextSize),
+	}
+
+	concatenated, err := Concat([]byte("ad"), header)
+	if err != nil {
+		t.Fatal("Concat failed:", err.Error())
+	}
+	if concatenated[0] != EncodingVersionKEM {
+		t.Fatalf("Expected version %d, Actual: %d", EncodingVersionKEM, concatenated[0])
+	}
+	parsed, _, err := Parse(concatenated)
+	if err != nil {
+		t.Fatal("Parse failed:", err.Error())
+	}
+	if !header.Equals(parsed) || parsed.KEMPublicKey != nil {
+		t.Fatal("Parsed header is not same as header")
+	}
+
+	// a KEM header without KEM data is not canonical
+	encoded, err := (&MessageHeader{DH: header.DH, PN: 2, N: 7}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded[0] = EncodingVersionKEM
+	if err := new(MessageHeader).UnmarshalBinary(append(encoded, 0x00, 0x00)); err == nil {
+		t.Fatal("KEM header without KEM data was accepted")
+	}
+}
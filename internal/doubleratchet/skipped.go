@@ -0,0 +1,125 @@
+package doubleratchet
+
+import (
+	"container/list"
+	"time"
+)
+
+const (
+	DefaultMaxSkippedKeys  = 2 * MaxSkip         // skipped message keys kept over all chains
+	DefaultMaxSkippedSteps = 10                  // DH ratchet steps after which the keys of a receiving chain are purged
+	DefaultMaxSkippedAge   = 30 * 24 * time.Hour // time after which a skipped message key is purged
+)
+
+// SkippedKey identifies a skipped message key.
+type SkippedKey struct {
+	Chain string // ratchet public key of the receiving chain, or its header key for header encryption
+	N     int    // message number
+}
+
+// SkippedMessageKey is a stored skipped message key.
+type SkippedMessageKey struct {
+	SkippedKey
+	MK       []byte
+	Step     int       // State.Step when the key was stored, all keys of a receiving chain share the step
+	StoredAt time.Time // wall-clock time when the key was stored
+}
+
+// SkippedKeyStore holds the skipped message keys of a State (MKSKIPPED in the spec).
+// MaxSkip only bounds a single jump, so a store has to bound the total number of keys and their age on its own.
+// Implementations may keep the keys outside of memory, e.g. on disk.
+type SkippedKeyStore interface {
+	// Put stores a key. If the store is full, the oldest keys are evicted.
+	Put(key SkippedMessageKey) error
+	// Get returns the message key of key, ok is false if it is not stored.
+	Get(key SkippedKey) (mk []byte, ok bool, err error)
+	// Delete removes the message key of key.
+	Delete(key SkippedKey) error
+	// Expire is called on every decryption and after every DH ratchet step with the current State.Step.
+	// Keys of abandoned receiving chains, which are too many steps old, and keys older than the maximum age are purged.
+	Expire(step int, now time.Time) error
+	// Keys returns all stored keys, oldest first.
+	Keys() ([]SkippedMessageKey, error)
+}
+
+// MemorySkippedKeyStore is an in-memory SkippedKeyStore.
+// A limit of 0 disables the respective bound.
+type MemorySkippedKeyStore struct {
+	MaxKeys  int
+	MaxSteps int
+	MaxAge   time.Duration
+	order    *list.List // of SkippedMessageKey, oldest first
+	index    map[SkippedKey]*list.Element
+}
+
+// NewMemorySkippedKeyStore returns an empty store with the default limits.
+func NewMemorySkippedKeyStore() *MemorySkippedKeyStore {
+	return &MemorySkippedKeyStore{
+		MaxKeys:  DefaultMaxSkippedKeys,
+		MaxSteps: DefaultMaxSkippedSteps,
+		MaxAge:   DefaultMaxSkippedAge,
+		order:    list.New(),
+		index:    make(map[SkippedKey]*list.Element),
+	}
+}
+
+func (m *MemorySkippedKeyStore) Put(key SkippedMessageKey) error {
+	if element, ok := m.index[key.SkippedKey]; ok {
+		m.order.Remove(element)
+	}
+	m.index[key.SkippedKey] = m.order.PushBack(key)
+
+	for m.MaxKeys > 0 && m.order.Len() > m.MaxKeys {
+		m.remove(m.order.Front())
+	}
+	return nil
+}
+
+func (m *MemorySkippedKeyStore) Get(key SkippedKey) ([]byte, bool, error) {
+	element, ok := m.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	return element.Value.(SkippedMessageKey).MK, true, nil
+}
+
+func (m *MemorySkippedKeyStore) Delete(key SkippedKey) error {
+	if element, ok := m.index[key]; ok {
+		m.remove(element)
+	}
+	return nil
+}
+
+func (m *MemorySkippedKeyStore) Expire(step int, now time.Time) error {
+	for element := m.order.Front(); element != nil; {
+		next := element.Next()
+		if m.expired(element.Value.(SkippedMessageKey), step, now) {
+			m.remove(element)
+		}
+		element = next
+	}
+	return nil
+}
+
+// expired reports whether Expire purges key
+func (m *MemorySkippedKeyStore) expired(key SkippedMessageKey, step int, now time.Time) bool {
+	return (m.MaxSteps > 0 && step-key.Step >= m.MaxSteps) || (m.MaxAge > 0 && now.Sub(key.StoredAt) > m.MaxAge)
+}
+
+func (m *MemorySkippedKeyStore) Keys() ([]SkippedMessageKey, error) {
+	keys := make([]SkippedMessageKey, 0, m.order.Len())
+	for element := m.order.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(SkippedMessageKey))
+	}
+	return keys, nil
+}
+
+// Len returns the number of stored keys.
+func (m *MemorySkippedKeyStore) Len() int {
+	return m.order.Len()
+}
+
+func (m *MemorySkippedKeyStore) remove(element *list.Element) {
+	delete(m.index, element.Value.(SkippedMessageKey).SkippedKey)
+	m.order.Remove(element)
+}
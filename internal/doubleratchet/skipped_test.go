@@ -0,0 +1,173 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func putSkippedKeys(t *testing.T, store SkippedKeyStore, chain string, step int, storedAt time.Time, n int) {
+	t.Helper()
+	for i := range n {
+		err := store.Put(SkippedMessageKey{
+			SkippedKey: SkippedKey{Chain: chain, N: i},
+			MK:         []byte{byte(i)},
+			Step:       step,
+			StoredAt:   storedAt,
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err.Error())
+		}
+	}
+}
+
+func TestMemorySkippedKeyStoreEvictsOldest(t *testing.T) {
+	store := NewMemorySkippedKeyStore()
+	store.MaxKeys = 5
+	now := time.Now()
+
+	putSkippedKeys(t, store, "old", 0, now, 3)
+	putSkippedKeys(t, store, "new", 1, now, 3)
+
+	if store.Len() != 5 {
+		t.Fatalf("Expected 5 keys, Actual: %d", store.Len())
+	}
+	if _, ok, _ := store.Get(SkippedKey{Chain: "old", N: 0}); ok {
+		t.Fatal("Oldest key was not evicted")
+	}
+	for _, key := range []SkippedKey{{Chain: "old", N: 1}, {Chain: "new", N: 2}} {
+		if _, ok, _ := store.Get(key); !ok {
+			t.Fatalf("Key %+v was evicted", key)
+		}
+	}
+}
+
+func TestMemorySkippedKeyStoreExpire(t *testing.T) {
+	store := NewMemorySkippedKeyStore()
+	store.MaxSteps = 2
+	store.MaxAge = time.Hour
+	now := time.Now()
+
+	putSkippedKeys(t, store, "abandoned", 0, now, 2)
+	putSkippedKeys(t, store, "stale", 2, now.Add(-2*time.Hour), 2)
+	putSkippedKeys(t, store, "recent", 2, now, 2)
+
+	if err := store.Expire(3, now); err != nil {
+		t.Fatal("Expire failed:", err.Error())
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, Actual: %d", len(keys))
+	}
+	for _, key := range keys {
+		if key.Chain != "recent" {
+			t.Fatalf("Key of chain %s was not purged", key.Chain)
+		}
+	}
+}
+
+func TestSkippedKeysAreBounded(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	store := NewMemorySkippedKeyStore()
+	store.MaxSteps = 0
+	s.bob.MKSkipped = store
+
+	// Alice lets Bob skip MaxSkip keys in every of her sending chains
+	for range 4 {
+		s.aliceSentMessages = nil
+		for range MaxSkip + 1 {
+			s.aliceSendMessages("skip")
+		}
+		s.bobReceiveMessages(MaxSkip + 1)
+		s.bobSendMessages("b")
+		s.aliceReceiveMessages(len(s.bobSentMessages))
+	}
+
+	if store.Len() != DefaultMaxSkippedKeys {
+		t.Fatalf("Expected %d skipped message keys, Actual: %d", DefaultMaxSkippedKeys, store.Len())
+	}
+}
+
+func TestSkippedKeysOfAbandonedChainsArePurged(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	now := time.Now()
+	s.bob.Now = func() time.Time { return now }
+
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+
+	// every round trip is one DH ratchet step of Bob
+	for range DefaultMaxSkippedSteps {
+		if skippedKeyCount(t, s.bob) != 1 {
+			t.Fatal("Skipped message key was purged too early")
+		}
+		s.bobSendMessages("b")
+		s.aliceReceiveMessages(len(s.bobSentMessages))
+		s.aliceSendMessages("a")
+		s.bobReceiveMessages(len(s.aliceSentMessages))
+	}
+	if n := skippedKeyCount(t, s.bob); n != 0 {
+		t.Fatalf("Skipped message key of the abandoned chain was not purged, %d keys left", n)
+	}
+}
+
+func TestSkippedKeysExpireWithoutRatchetStep(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	now := time.Now()
+	s.bob.Now = func() time.Time { return now }
+
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+	a1 := *s.aliceSentMessages[0]
+
+	// the next message of the same chain purges the key of a1, Bob takes no DH ratchet step
+	now = now.Add(DefaultMaxSkippedAge + time.Second)
+	s.aliceSendMessages("a3")
+	s.bobReceiveMessages(3)
+	if n := skippedKeyCount(t, s.bob); n != 0 {
+		t.Fatalf("Expired skipped message key was not purged, %d keys left", n)
+	}
+	if err := s.bobReceiveMessageUnsafe(&a1); !errors.Is(err, ErrMessageKeyExpired) {
+		t.Fatal("Expected ErrMessageKeyExpired, Actual:", err)
+	}
+}
+
+func TestExpiredSkippedKeyDoesNotDecrypt(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	now := time.Now()
+	s.bob.Now = func() time.Time { return now }
+
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+
+	// a1 arrives after its key expired, before any other message purged it
+	now = now.Add(DefaultMaxSkippedAge + time.Second)
+	a1 := *s.aliceSentMessages[0]
+	if err := s.bobReceiveMessageUnsafe(&a1); !errors.Is(err, ErrMessageKeyExpired) {
+		t.Fatal("Expected ErrMessageKeyExpired, Actual:", err)
+	}
+}
+
+func TestSkippedKeysExpireByAge(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	now := time.Now()
+	s.bob.Now = func() time.Time { return now }
+
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+
+	now = now.Add(DefaultMaxSkippedAge + time.Second)
+	s.bobSendMessages("b1")
+	s.aliceReceiveMessages(1)
+	s.aliceSendMessages("a3")
+	s.bobReceiveMessages(3)
+
+	if n := skippedKeyCount(t, s.bob); n != 0 {
+		t.Fatalf("Expired skipped message key was not purged, %d keys left", n)
+	}
+}
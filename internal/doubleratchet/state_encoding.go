@@ -0,0 +1,381 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"io"
+	"time"
+)
+
+// Persistence format of State, all integers are unsigned varints and all byte strings are length prefixed (len || bytes):
+//
+//	state    = version (1 byte) || suite ID (1 byte) || DHs || DHr || RK || CKs || CKr || Ns || Nr || PN
+//	           || HKs || HKr || NHKs || NHKr || Step || skipped || kem || consumed
+//	skipped  = count || count * (chain || N || MK || step || stored at (unix seconds)), oldest first
+//	kem      = 0x00 if the KEM ratchet is disabled, otherwise 0x01 || decapsulation key || ciphertext
+//	consumed = count || count * (chain || N), oldest first
+//
+// Keys which are not set are encoded as empty byte strings.
+const StateVersion = 1
+
+// StateMigration rewrites the encoding of a state of one version into the encoding of the next version.
+type StateMigration func(data []byte) ([]byte, error)
+
+// stateMigrations holds the migration from every old version to its successor.
+// When the format changes, StateVersion is incremented and a migration from the previous version is added here,
+// so states stored by an older release can still be loaded.
+var stateMigrations = map[byte]StateMigration{}
+
+// MarshalBinary encodes the full state including skipped message keys, so a session survives a restart.
+func (s *State) MarshalBinary() ([]byte, error) {
+	b := []byte{StateVersion, s.suite().ID()}
+
+	var dhs []byte
+	if s.DHs != nil {
+		dhs = s.DHs.Bytes()
+	}
+	var dhr []byte
+	if s.DHr != nil {
+		dhr = s.DHr.Bytes()
+	}
+	if s.Ns < 0 || s.Nr < 0 || s.PN < 0 || s.Step < 0 {
+		return nil, fmt.Errorf("%w: negative counter", ErrInvalidEncoding)
+	}
+
+	b = appendBytes(b, dhs)
+	b = appendBytes(b, dhr)
+	b = appendBytes(b, s.RK)
+	b = appendBytes(b, s.CKs)
+	b = appendBytes(b, s.CKr)
+	b = binary.AppendUvarint(b, uint64(s.Ns))
+	b = binary.AppendUvarint(b, uint64(s.Nr))
+	b = binary.AppendUvarint(b, uint64(s.PN))
+	b = appendBytes(b, s.HKs)
+	b = appendBytes(b, s.HKr)
+	b = appendBytes(b, s.NHKs)
+	b = appendBytes(b, s.NHKr)
+	b = binary.AppendUvarint(b, uint64(s.Step))
+
+	var skipped []SkippedMessageKey
+	if s.MKSkipped != nil {
+		var err error
+		skipped, err = s.MKSkipped.Keys()
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := appendSkipped(b, skipped)
+	if err != nil {
+		return nil, err
+	}
+	b = appendKEM(b, s.KEM)
+	return appendConsumed(b, s.Consumed.Keys())
+}
+
+// UnmarshalBinary decodes a state encoded by MarshalBinary.
+// States of an older version are migrated first, unknown versions and truncated data are rejected.
+// s.Now and s.Rand are kept, as is the limit of s.Consumed. The skipped message keys are put into s.MKSkipped, which should be empty. If it is nil, a MemorySkippedKeyStore is used.
+// A custom suite has to be set as s.Suite beforehand, shipped suites are looked up by their ID.
+func (s *State) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: missing version", ErrInvalidEncoding)
+	}
+	data, err := migrateState(data)
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(data[1:])
+	decoded := State{
+		Suite:     s.Suite,
+		MKSkipped: s.MKSkipped,
+		Now:       s.Now,
+		Rand:      s.Rand,
+	}
+	if decoded.MKSkipped == nil {
+		decoded.MKSkipped = NewMemorySkippedKeyStore()
+	}
+	decoded.Consumed = NewConsumedKeys()
+	if s.Consumed != nil {
+		decoded.Consumed.Max = s.Consumed.Max
+	}
+
+	suiteID, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: missing suite", ErrInvalidEncoding)
+	}
+	if decoded.Suite == nil || decoded.Suite.ID() != suiteID {
+		decoded.Suite, err = SuiteByID(suiteID)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidEncoding, err.Error())
+		}
+	}
+
+	dhs, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	if len(dhs) != 0 {
+		decoded.DHs, err = decoded.Suite.ParsePrivateKey(dhs)
+		if err != nil {
+			return err
+		}
+	}
+	dhr, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	if len(dhr) != 0 {
+		decoded.DHr, err = decoded.Suite.ParsePublicKey(dhr)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []*[]byte{&decoded.RK, &decoded.CKs, &decoded.CKr} {
+		if *key, err = readBytes(r); err != nil {
+			return err
+		}
+	}
+	for _, n := range []*int{&decoded.Ns, &decoded.Nr, &decoded.PN} {
+		if *n, err = readUvarint(r); err != nil {
+			return err
+		}
+	}
+	for _, key := range []*[]byte{&decoded.HKs, &decoded.HKr, &decoded.NHKs, &decoded.NHKr} {
+		if *key, err = readBytes(r); err != nil {
+			return err
+		}
+	}
+	if decoded.Step, err = readUvarint(r); err != nil {
+		return err
+	}
+
+	skipped, err := readSkipped(r)
+	if err != nil {
+		return err
+	}
+	if decoded.KEM, err = readKEM(r); err != nil {
+		return err
+	}
+	consumed, err := readConsumed(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, r.Len())
+	}
+
+	for _, key := range skipped {
+		if err := decoded.MKSkipped.Put(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range consumed {
+		decoded.Consumed.Add(key)
+	}
+	*s = decoded
+	return nil
+}
+
+// migrateState applies the migrations from the version of data up to StateVersion
+func migrateState(data []byte) ([]byte, error) {
+	for data[0] != StateVersion {
+		version := data[0]
+		if version > StateVersion {
+			return nil, fmt.Errorf("%w: unknown state version %d", ErrInvalidEncoding, version)
+		}
+		migrate, ok := stateMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no migration from state version %d", ErrInvalidEncoding, version)
+		}
+
+		var err error
+		data, err = migrate(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 || data[0] != version+1 {
+			return nil, fmt.Errorf("%w: migration from state version %d failed", ErrInvalidEncoding, version)
+		}
+	}
+	return data, nil
+}
+
+// appendSkipped appends count || (chain || N || MK || step || stored at)*
+func appendSkipped(b []byte, skipped []SkippedMessageKey) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(skipped)))
+	for _, key := range skipped {
+		if key.N < 0 || key.Step < 0 {
+			return nil, fmt.Errorf("%w: negative counter", ErrInvalidEncoding)
+		}
+		b = appendBytes(b, []byte(key.Chain))
+		b = binary.AppendUvarint(b, uint64(key.N))
+		b = appendBytes(b, key.MK)
+		b = binary.AppendUvarint(b, uint64(key.Step))
+		b = binary.AppendUvarint(b, uint64(max(key.StoredAt.Unix(), 0)))
+	}
+	return b, nil
+}
+
+func readSkipped(r *bytes.Reader) ([]SkippedMessageKey, error) {
+	count, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// every entry takes at least 5 bytes, this bounds the allocation by the input size
+	if count > r.Len()/5 {
+		return nil, fmt.Errorf("%w: too many skipped message keys", ErrInvalidEncoding)
+	}
+
+	seen := make(map[SkippedKey]bool, count)
+	skipped := make([]SkippedMessageKey, 0, count)
+	for range count {
+		chain, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		mk, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		step, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		storedAt, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		key := SkippedKey{Chain: string(chain), N: n}
+		if seen[key] {
+			return nil, fmt.Errorf("%w: duplicate skipped message key", ErrInvalidEncoding)
+		}
+		seen[key] = true
+		skipped = append(skipped, SkippedMessageKey{
+			SkippedKey: key,
+			MK:         mk,
+			Step:       step,
+			StoredAt:   time.Unix(int64(storedAt), 0),
+		})
+	}
+	return skipped, nil
+}
+
+// appendKEM appends the enabled flag || decapsulation key || ciphertext
+func appendKEM(b []byte, kem *KEMRatchet) []byte {
+	if kem == nil {
+		return append(b, 0x00)
+	}
+	var dk []byte
+	if kem.DecapsulationKey != nil {
+		dk = make([]byte, mlkem768.PrivateKeySize)
+		kem.DecapsulationKey.Pack(dk)
+	}
+	b = append(b, 0x01)
+	b = appendBytes(b, dk)
+	return appendBytes(b, kem.Ciphertext)
+}
+
+func readKEM(r *bytes.Reader) (*KEMRatchet, error) {
+	enabled, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing KEM ratchet", ErrInvalidEncoding)
+	}
+	switch enabled {
+	case 0x00:
+		return nil, nil
+	case 0x01:
+	default:
+		return nil, fmt.Errorf("%w: invalid KEM ratchet flag %d", ErrInvalidEncoding, enabled)
+	}
+
+	kem := &KEMRatchet{}
+	dk, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	if dk != nil {
+		if len(dk) != mlkem768.PrivateKeySize {
+			return nil, fmt.Errorf("%w: invalid KEM decapsulation key", ErrInvalidEncoding)
+		}
+		kem.DecapsulationKey = &mlkem768.PrivateKey{}
+		if err := kem.DecapsulationKey.Unpack(dk); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidEncoding, err.Error())
+		}
+	}
+	if kem.Ciphertext, err = readBytes(r); err != nil {
+		return nil, err
+	}
+	return kem, nil
+}
+
+// appendConsumed appends count || (chain || N)*
+func appendConsumed(b []byte, consumed []SkippedKey) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(consumed)))
+	for _, key := range consumed {
+		if key.N < 0 {
+			return nil, fmt.Errorf("%w: negative counter", ErrInvalidEncoding)
+		}
+		b = appendBytes(b, []byte(key.Chain))
+		b = binary.AppendUvarint(b, uint64(key.N))
+	}
+	return b, nil
+}
+
+func readConsumed(r *bytes.Reader) ([]SkippedKey, error) {
+	count, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// every entry takes at least 2 bytes, this bounds the allocation by the input size
+	if count > r.Len()/2 {
+		return nil, fmt.Errorf("%w: too many consumed message keys", ErrInvalidEncoding)
+	}
+
+	consumed := make([]SkippedKey, 0, count)
+	for range count {
+		chain, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		consumed = append(consumed, SkippedKey{Chain: string(chain), N: n})
+	}
+	return consumed, nil
+}
+
+// appendBytes appends len(v) || v to b
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// readBytes reads len || v from r, an empty byte string is returned as nil
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > r.Len() {
+		return nil, fmt.Errorf("%w: truncated data", ErrInvalidEncoding)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	v := make([]byte, n)
+	if _, err := io.ReadFull(r, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
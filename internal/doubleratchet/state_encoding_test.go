@@ -0,0 +1,153 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// restoreState simulates a restart by encoding and decoding s
+func restoreState(t *testing.T, s *State) *State {
+	t.Helper()
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+	restored := &State{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal("UnmarshalBinary failed:", err.Error())
+	}
+
+	again, err := restored.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+	if !bytes.Equal(data, again) {
+		t.Fatal("Encoding of the restored state differs")
+	}
+	return restored
+}
+
+func TestStateMarshalBinaryRestoresSessions(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+
+	// fresh Bob without DHr and chain keys
+	s.bob = restoreState(t, s.bob)
+
+	s.aliceSendMessages("a1", "a2", "a3")
+	s.bobReceiveMessages(3)
+	s.bobSendMessages("b1")
+	s.aliceReceiveMessages(1)
+
+	// Bob has skipped message keys for a1 and a2
+	if n := skippedKeyCount(t, s.bob); n != 2 {
+		t.Fatalf("Expected 2 skipped message keys, Actual: %d", n)
+	}
+	s.alice = restoreState(t, s.alice)
+	s.bob = restoreState(t, s.bob)
+
+	s.bobReceiveMessages(1, 2)
+	s.aliceSendMessages("a4")
+	s.bobReceiveMessages(4)
+	s.bobSendMessages("b2")
+	s.aliceReceiveMessages(2)
+}
+
+func TestStateMarshalBinaryRestoresHESessions(t *testing.T) {
+	alice, bob := initTestHE(t)
+	bob = restoreState(t, bob)
+
+	a1 := sendMessageHE(t, alice, "a1")
+	a2 := sendMessageHE(t, alice, "a2")
+	receiveMessageHE(t, bob, a2)
+	receiveMessageHE(t, alice, sendMessageHE(t, bob, "b1"))
+
+	alice = restoreState(t, alice)
+	bob = restoreState(t, bob)
+	if n := skippedKeyCount(t, bob); n != 1 {
+		t.Fatalf("Expected 1 skipped message key, Actual: %d", n)
+	}
+
+	receiveMessageHE(t, bob, a1)
+	receiveMessageHE(t, bob, sendMessageHE(t, alice, "a3"))
+	receiveMessageHE(t, alice, sendMessageHE(t, bob, "b2"))
+}
+
+func TestStateUnmarshalBinaryRejectsInvalidData(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+
+	data, err := s.bob.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+
+	for i := range len(data) {
+		if err := (&State{}).UnmarshalBinary(data[:i]); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("Truncated state of %d bytes was not rejected: %v", i, err)
+		}
+	}
+
+	unknownVersion := append([]byte{StateVersion + 1}, data[1:]...)
+	if err := (&State{}).UnmarshalBinary(unknownVersion); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatal("Unknown version was not rejected:", err)
+	}
+
+	trailing := append(bytes.Clone(data), 0x00)
+	if err := (&State{}).UnmarshalBinary(trailing); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatal("Trailing bytes were not rejected:", err)
+	}
+}
+
+// TestStateMigration registers a migration from the synthetic version StateVersion-1,
+// which lacks the consumed message keys of the current format.
+func TestStateMigration(t *testing.T) {
+	previous := byte(StateVersion - 1)
+	stateMigrations[previous] = func(data []byte) ([]byte, error) {
+		return append(append([]byte{previous + 1}, data[1:]...), 0x00), nil
+	}
+	t.Cleanup(func() { delete(stateMigrations, previous) })
+
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2")
+	s.bobReceiveMessages(2)
+
+	// the consumed message keys are the last field, an empty set is encoded as a zero count
+	s.bob.Consumed = NewConsumedKeys()
+	data, err := s.bob.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+	old := append([]byte{previous}, data[1:len(data)-1]...)
+
+	migrated := &State{}
+	if err := migrated.UnmarshalBinary(old); err != nil {
+		t.Fatal("Migration failed:", err.Error())
+	}
+	s.bob = migrated
+	s.aliceSendMessages("a3")
+	s.bobReceiveMessages(3)
+
+	// a migrated state is stored in the current version
+	restoreState(t, s.bob)
+
+	// a migration has to produce the next version
+	stateMigrations[previous] = func(data []byte) ([]byte, error) { return data, nil }
+	if err := (&State{}).UnmarshalBinary(old); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatal("Expected ErrInvalidEncoding, Actual:", err)
+	}
+	delete(stateMigrations, previous)
+	if err := (&State{}).UnmarshalBinary(old); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatal("Expected ErrInvalidEncoding, Actual:", err)
+	}
+}
+
+func skippedKeyCount(t *testing.T, s *State) int {
+	t.Helper()
+	keys, err := s.MKSkipped.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(keys)
+}
@@ -0,0 +1,270 @@
+package doubleratchet
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+)
+
+// PublicKey is a DH public key of a CryptoSuite. *ecdh.PublicKey implements it.
+type PublicKey interface {
+	Bytes() []byte
+	Equal(x crypto.PublicKey) bool
+}
+
+// PrivateKey is a DH key pair of a CryptoSuite. *ecdh.PrivateKey implements it.
+// Public has to return a PublicKey of the same suite.
+type PrivateKey interface {
+	Bytes() []byte
+	Public() crypto.PublicKey
+}
+
+// CryptoSuite holds the external functions of the Double Ratchet, see https://signal.org/docs/specifications/doubleratchet/#external-functions
+// Every State is bound to one suite, which is stored with the state.
+type CryptoSuite interface {
+	// ID identifies the suite in persisted states
+	ID() byte
+	GenerateDH(random io.Reader) (PrivateKey, error)
+	DH(dhPair PrivateKey, dhPub PublicKey) ([]byte, error)
+	// PublicKeySize is the size of an encoded public key, which is part of every message header
+	PublicKeySize() int
+	ParsePublicKey(b []byte) (PublicKey, error)
+	ParsePrivateKey(b []byte) (PrivateKey, error)
+	KDFRootKey(rk, dhOut []byte) (rootKey, chainKey []byte, err error)
+	KDFRootKeyHE(rk, dhOut []byte) (rootKey, chainKey, nextHeaderKey []byte, err error)
+	KDFChainKey(ck []byte) (newChainKey, messageKey []byte, err error)
+	Encrypt(mk, plaintext, associatedData []byte) ([]byte, error)
+	Decrypt(mk, ciphertext, associatedData []byte) ([]byte, error)
+}
+
+// Suite IDs of the shipped suites
+const (
+	SuiteIDDefault byte = 1 // X25519, HKDF-SHA256, AES-256-CBC + HMAC-SHA512
+	SuiteIDX448    byte = 2 // X448, HKDF-SHA512, ChaCha20-Poly1305
+	SuiteIDSignal  byte = 3 // X25519, HKDF-SHA256, AES-256-CBC + HMAC-SHA256 with libsignal's key derivation
+)
+
+var (
+	// DefaultSuite uses the package level functions GenerateDH, DH, KDFRootKey, KDFChainKey, Encrypt and Decrypt.
+	DefaultSuite CryptoSuite = &x25519Suite{
+		id:           SuiteIDDefault,
+		rootKeyInfo:  "doubleratchet.KDFRootKey",
+		rootKeyHInfo: "doubleratchet.KDFRootKeyHE",
+		aead:         defaultAEAD,
+	}
+	// SignalSuite derives root, chain and message keys like libsignal: root and chain keys with HKDF-SHA256 and
+	// "WhisperRatchet", message keys with "WhisperMessageKeys". It authenticates with a HMAC-SHA256 truncated to 8 bytes
+	// like libsignal, but over AD || ciphertext of this package, so its messages are not readable by libsignal.
+	// libsignal has no header encryption, "WhisperRatchetHE" is a string of this package.
+	SignalSuite CryptoSuite = &x25519Suite{
+		id:           SuiteIDSignal,
+		rootKeyInfo:  "WhisperRatchet",
+		rootKeyHInfo: "WhisperRatchetHE",
+		aead: cbcHMAC{
+			kdfHash: sha256.New,
+			info:    "WhisperMessageKeys",
+			macHash: sha256.New,
+			macSize: 8,
+		},
+	}
+)
+
+var defaultAEAD = cbcHMAC{
+	kdfHash: sha512.New,
+	info:    "doubleratchet.Encrypt",
+	macHash: sha512.New,
+	macSize: sha512.Size,
+}
+
+// SuiteByID returns the shipped suite with id.
+func SuiteByID(id byte) (CryptoSuite, error) {
+	switch id {
+	case SuiteIDDefault:
+		return DefaultSuite, nil
+	case SuiteIDX448:
+		return X448Suite, nil
+	case SuiteIDSignal:
+		return SignalSuite, nil
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownSuite, id)
+}
+
+func (s *State) suite() CryptoSuite {
+	if s.Suite == nil {
+		return DefaultSuite
+	}
+	return s.Suite
+}
+
+// publicKey returns the public half of the key pair dhPair
+func publicKey(dhPair PrivateKey) (PublicKey, error) {
+	pub, ok := dhPair.Public().(PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: key pair has no DH public key", ErrInvalidKey)
+	}
+	return pub, nil
+}
+
+// x25519Suite is a suite with X25519, HKDF-SHA256 root keys and HMAC-SHA256 chain keys.
+type x25519Suite struct {
+	id           byte
+	rootKeyInfo  string
+	rootKeyHInfo string
+	aead         cbcHMAC
+}
+
+func (x *x25519Suite) ID() byte {
+	return x.id
+}
+
+func (x *x25519Suite) GenerateDH(random io.Reader) (PrivateKey, error) {
+	return GenerateDHWithRandom(random)
+}
+
+func (x *x25519Suite) DH(dhPair PrivateKey, dhPub PublicKey) ([]byte, error) {
+	private, ok := dhPair.(*ecdh.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a X25519 key pair", ErrInvalidKey)
+	}
+	public, ok := dhPub.(*ecdh.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a X25519 public key", ErrInvalidKey)
+	}
+	return DH(private, public)
+}
+
+func (x *x25519Suite) PublicKeySize() int {
+	return 32
+}
+
+func (x *x25519Suite) ParsePublicKey(b []byte) (PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+func (x *x25519Suite) ParsePrivateKey(b []byte) (PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+func (x *x25519Suite) KDFRootKey(rk, dhOut []byte) (rootKey, chainKey []byte, err error) {
+	keys, err := hkdfKeys(sha256.New, dhOut, rk, x.rootKeyInfo, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[0], keys[1], nil
+}
+
+func (x *x25519Suite) KDFRootKeyHE(rk, dhOut []byte) (rootKey, chainKey, nextHeaderKey []byte, err error) {
+	keys, err := hkdfKeys(sha256.New, dhOut, rk, x.rootKeyHInfo, 3)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0], keys[1], keys[2], nil
+}
+
+func (x *x25519Suite) KDFChainKey(ck []byte) (newChainKey, messageKey []byte, err error) {
+	return KDFChainKey(ck)
+}
+
+func (x *x25519Suite) Encrypt(mk, plaintext, associatedData []byte) ([]byte, error) {
+	return x.aead.encrypt(mk, plaintext, associatedData)
+}
+
+func (x *x25519Suite) Decrypt(mk, ciphertext, associatedData []byte) ([]byte, error) {
+	return x.aead.decrypt(mk, ciphertext, associatedData)
+}
+
+// hkdfKeys reads n 32-byte keys from HKDF
+func hkdfKeys(hash func() hash.Hash, secret, salt []byte, info string, n int) ([][]byte, error) {
+	kdf := hkdf.New(hash, secret, salt, []byte(info))
+
+	var keys [][]byte
+	for range n {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(kdf, key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// cbcHMAC is the AEAD recommended by the spec: AES-256-CBC with PKCS#7 padding and HMAC, keys and IV are derived from the message key with HKDF.
+type cbcHMAC struct {
+	kdfHash func() hash.Hash
+	info    string
+	macHash func() hash.Hash
+	macSize int // the HMAC is truncated to macSize bytes
+}
+
+// keys derives the encryption key, authentication key and IV from mk
+func (c cbcHMAC) keys(mk []byte) (encKey, authKey, iv []byte, err error) {
+	keySize := 32
+	authKeySize := 32
+	ivSize := aes.BlockSize
+
+	salt := make([]byte, c.kdfHash().Size())
+	kdf := hkdf.New(c.kdfHash, mk, salt, []byte(c.info))
+
+	keyMaterial := make([]byte, keySize+authKeySize+ivSize)
+	if _, err := io.ReadFull(kdf, keyMaterial); err != nil {
+		return nil, nil, nil, err
+	}
+	return keyMaterial[:keySize], keyMaterial[keySize : keySize+authKeySize], keyMaterial[keySize+authKeySize:], nil
+}
+
+func (c cbcHMAC) mac(authKey, associatedData, ciphertext []byte) []byte {
+	mac := hmac.New(c.macHash, authKey)
+	mac.Write(associatedData)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)[:c.macSize]
+}
+
+func (c cbcHMAC) encrypt(mk, plaintext, associatedData []byte) ([]byte, error) {
+	encKey, authKey, iv, err := c.keys(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	paddedPlaintext := padPKCS7(plaintext, block.BlockSize())
+	ciphertext := make([]byte, len(paddedPlaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, paddedPlaintext)
+
+	return append(ciphertext, c.mac(authKey, associatedData, ciphertext)...), nil
+}
+
+func (c cbcHMAC) decrypt(mk, ciphertext, associatedData []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+c.macSize || (len(ciphertext)-c.macSize)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrAuthentication)
+	}
+	macSum := ciphertext[len(ciphertext)-c.macSize:]
+	ciphertextWithoutMAC := ciphertext[:len(ciphertext)-c.macSize]
+
+	encKey, authKey, iv, err := c.keys(mk)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(macSum, c.mac(authKey, associatedData, ciphertextWithoutMAC)) {
+		return nil, ErrAuthentication
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	paddedPlaintext := make([]byte, len(ciphertextWithoutMAC))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(paddedPlaintext, ciphertextWithoutMAC)
+
+	return unpadPKCS7(paddedPlaintext)
+}
@@ -0,0 +1,144 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"testing"
+)
+
+var testSuites = map[string]CryptoSuite{
+	"default": DefaultSuite,
+	"x448":    X448Suite,
+	"signal":  SignalSuite,
+}
+
+func initTestWithSuite(t *testing.T, suite CryptoSuite) *testState {
+	t.Helper()
+	sharedSecret := bytes.Repeat([]byte{0x01}, 32)
+	bobKeyPair, err := suite.GenerateDH(rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate KeyPair", err.Error())
+	}
+	bobPublicKey, err := publicKey(bobKeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testState{t: t}
+	s.bob = RatchetInitBobWithSuite(suite, sharedSecret, bobKeyPair)
+	s.alice, err = RatchetInitAliceWithSuite(suite, sharedSecret, bobPublicKey)
+	if err != nil {
+		t.Fatal("Could not init Alice", err.Error())
+	}
+	return s
+}
+
+func TestCryptoSuites(t *testing.T) {
+	for name, suite := range testSuites {
+		t.Run(name, func(t *testing.T) {
+			s := initTestWithSuite(t, suite)
+
+			s.aliceSendMessages("a1", "a2", "a3")
+			s.bobReceiveMessages(3, 1)
+			s.bobSendMessages("b1", "b2")
+			s.aliceReceiveMessages(2, 1)
+
+			// restored states keep their suite
+			s.alice = restoreState(t, s.alice)
+			s.bob = restoreState(t, s.bob)
+			if s.alice.Suite.ID() != suite.ID() || s.bob.Suite.ID() != suite.ID() {
+				t.Fatal("Restored state lost its suite")
+			}
+
+			s.bobReceiveMessages(2)
+			s.aliceSendMessages("a4")
+			s.bobReceiveMessages(4)
+		})
+	}
+}
+
+func TestCryptoSuitesHE(t *testing.T) {
+	for name, suite := range testSuites {
+		t.Run(name, func(t *testing.T) {
+			sharedSecret := bytes.Repeat([]byte{0x01}, 32)
+			sharedHKa := bytes.Repeat([]byte{0x02}, 32)
+			sharedNHKb := bytes.Repeat([]byte{0x03}, 32)
+
+			bobKeyPair, err := suite.GenerateDH(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bobPublicKey, err := publicKey(bobKeyPair)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob := RatchetInitBobHEWithSuite(suite, sharedSecret, bobKeyPair, sharedHKa, sharedNHKb)
+			alice, err := RatchetInitAliceHEWithSuite(suite, sharedSecret, bobPublicKey, sharedHKa, sharedNHKb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a1 := sendMessageHE(t, alice, "a1")
+			receiveMessageHE(t, bob, sendMessageHE(t, alice, "a2"))
+			receiveMessageHE(t, alice, sendMessageHE(t, bob, "b1"))
+			receiveMessageHE(t, bob, sendMessageHE(t, alice, "a3"))
+			receiveMessageHE(t, bob, a1)
+		})
+	}
+}
+
+func TestCryptoSuitesAreNotInterchangeable(t *testing.T) {
+	s := initTestWithSuite(t, X448Suite)
+	s.aliceSendMessages("a1")
+	s.alice.Suite = SignalSuite
+	s.aliceSendMessages("a2")
+
+	// a X448 key pair can not be used with a X25519 suite
+	if _, err := SignalSuite.DH(s.bob.DHs, s.alice.DHr); err == nil {
+		t.Fatal("X25519 suite accepted a X448 key pair")
+	}
+
+	s.bobReceiveMessages(1)
+	if err := s.bobReceiveMessageUnsafe(s.aliceSentMessages[1]); err == nil {
+		t.Fatal("Message encrypted with another suite was accepted")
+	}
+}
+
+// TestSignalSuiteInfoStrings checks that the Signal suite derives its root and chain keys like libsignal:
+// HKDF-SHA256 with the root key as salt and "WhisperRatchet" as info.
+func TestSignalSuiteInfoStrings(t *testing.T) {
+	rk := bytes.Repeat([]byte{0x0a}, 32)
+	dhOut := bytes.Repeat([]byte{0x0b}, 32)
+
+	expected := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rk, []byte("WhisperRatchet")), expected); err != nil {
+		t.Fatal(err)
+	}
+	rootKey, chainKey, err := SignalSuite.KDFRootKey(rk, dhOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rootKey, expected[:32]) || !bytes.Equal(chainKey, expected[32:]) {
+		t.Fatal("Root and chain key do not match libsignal's derivation")
+	}
+
+	defaultRootKey, _, err := DefaultSuite.KDFRootKey(rk, dhOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rootKey, defaultRootKey) {
+		t.Fatal("Signal suite derived the same root key as the default suite")
+	}
+
+	// 16 byte block and 8 byte truncated HMAC
+	ciphertext, err := SignalSuite.Encrypt(bytes.Repeat([]byte{0x0c}, 32), []byte("hi"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphertext) != 16+8 {
+		t.Fatalf("Expected a 24 byte ciphertext, Actual: %d", len(ciphertext))
+	}
+}
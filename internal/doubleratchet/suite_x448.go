@@ -0,0 +1,175 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"fmt"
+	"github.com/cloudflare/circl/dh/x448"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// X448Suite uses X448 for the DH ratchet, HKDF-SHA512 for root keys, HMAC-SHA512 for chain keys and ChaCha20-Poly1305 as AEAD.
+// Root, chain and message keys stay 32 bytes, so the suite can be seeded with the 32-byte X3DH secret.
+var X448Suite CryptoSuite = x448Suite{}
+
+// X448PrivateKey is a X448 key pair of X448Suite.
+type X448PrivateKey struct {
+	private x448.Key
+	public  X448PublicKey
+}
+
+// X448PublicKey is a X448 public key of X448Suite.
+type X448PublicKey struct {
+	key x448.Key
+}
+
+func (k *X448PrivateKey) Bytes() []byte {
+	return bytes.Clone(k.private[:])
+}
+
+func (k *X448PrivateKey) Public() crypto.PublicKey {
+	return &k.public
+}
+
+func (k *X448PublicKey) Bytes() []byte {
+	return bytes.Clone(k.key[:])
+}
+
+func (k *X448PublicKey) Equal(x crypto.PublicKey) bool {
+	other, ok := x.(*X448PublicKey)
+	return ok && other != nil && k.key == other.key
+}
+
+type x448Suite struct{}
+
+func (x448Suite) ID() byte {
+	return SuiteIDX448
+}
+
+func (x448Suite) GenerateDH(random io.Reader) (PrivateKey, error) {
+	var private x448.Key
+	if _, err := io.ReadFull(random, private[:]); err != nil {
+		return nil, err
+	}
+	return newX448PrivateKey(private), nil
+}
+
+func newX448PrivateKey(private x448.Key) *X448PrivateKey {
+	key := &X448PrivateKey{private: private}
+	x448.KeyGen(&key.public.key, &key.private)
+	return key
+}
+
+func (x448Suite) DH(dhPair PrivateKey, dhPub PublicKey) ([]byte, error) {
+	private, ok := dhPair.(*X448PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a X448 key pair", ErrInvalidKey)
+	}
+	public, ok := dhPub.(*X448PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not a X448 public key", ErrInvalidKey)
+	}
+
+	var shared x448.Key
+	if !x448.Shared(&shared, &private.private, &public.key) {
+		return nil, fmt.Errorf("%w: X448 public key of low order", ErrInvalidKey)
+	}
+	return shared[:], nil
+}
+
+func (x448Suite) PublicKeySize() int {
+	return x448.Size
+}
+
+func (x448Suite) ParsePublicKey(b []byte) (PublicKey, error) {
+	if len(b) != x448.Size {
+		return nil, fmt.Errorf("%w: X448 public key has to be %d bytes, Actual: %d", ErrInvalidKey, x448.Size, len(b))
+	}
+	key := &X448PublicKey{}
+	copy(key.key[:], b)
+	return key, nil
+}
+
+func (x448Suite) ParsePrivateKey(b []byte) (PrivateKey, error) {
+	if len(b) != x448.Size {
+		return nil, fmt.Errorf("%w: X448 private key has to be %d bytes, Actual: %d", ErrInvalidKey, x448.Size, len(b))
+	}
+	var private x448.Key
+	copy(private[:], b)
+	return newX448PrivateKey(private), nil
+}
+
+func (x448Suite) KDFRootKey(rk, dhOut []byte) (rootKey, chainKey []byte, err error) {
+	keys, err := hkdfKeys(sha512.New, dhOut, rk, "doubleratchet.X448.KDFRootKey", 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[0], keys[1], nil
+}
+
+func (x448Suite) KDFRootKeyHE(rk, dhOut []byte) (rootKey, chainKey, nextHeaderKey []byte, err error) {
+	keys, err := hkdfKeys(sha512.New, dhOut, rk, "doubleratchet.X448.KDFRootKeyHE", 3)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0], keys[1], keys[2], nil
+}
+
+// KDFChainKey uses HMAC-SHA512 with the constants 0x01 and 0x02 like KDFChainKey, truncated to 32 bytes.
+func (x448Suite) KDFChainKey(ck []byte) (newChainKey, messageKey []byte, err error) {
+	if len(ck) != 32 {
+		return nil, nil, fmt.Errorf("%w: chain key must be 32 bytes, Actual: %d", ErrInvalidKey, len(ck))
+	}
+
+	hmacMessageKey := hmac.New(sha512.New, ck)
+	hmacMessageKey.Write([]byte{0x01})
+	messageKey = hmacMessageKey.Sum(nil)[:32]
+
+	hmacChainKey := hmac.New(sha512.New, ck)
+	hmacChainKey.Write([]byte{0x02})
+	newChainKey = hmacChainKey.Sum(nil)[:32]
+
+	return newChainKey, messageKey, nil
+}
+
+// aead derives the ChaCha20-Poly1305 key and nonce from mk.
+// Every message key encrypts a single message, so the derived nonce is never reused.
+func (x448Suite) aead(mk []byte) (cipher.AEAD, []byte, error) {
+	salt := make([]byte, sha512.Size)
+	kdf := hkdf.New(sha512.New, mk, salt, []byte("doubleratchet.X448.Encrypt"))
+
+	keyMaterial := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSize)
+	if _, err := io.ReadFull(kdf, keyMaterial); err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.New(keyMaterial[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, keyMaterial[chacha20poly1305.KeySize:], nil
+}
+
+func (x x448Suite) Encrypt(mk, plaintext, associatedData []byte) ([]byte, error) {
+	aead, nonce, err := x.aead(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, associatedData), nil
+}
+
+func (x x448Suite) Decrypt(mk, ciphertext, associatedData []byte) ([]byte, error) {
+	aead, nonce, err := x.aead(mk)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plaintext, nil
+}
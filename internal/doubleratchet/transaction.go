@@ -0,0 +1,243 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"time"
+)
+
+// PendingDecrypt is a decrypted message, whose state changes have not been applied yet.
+// The caller stores the plaintext durably and calls Commit afterwards, or Discard if it could not be stored.
+// Until Commit the State and its SkippedKeyStore are untouched, so a crash in between never loses a message key:
+// the message can simply be decrypted again.
+type PendingDecrypt struct {
+	Plaintext []byte
+
+	state    *State
+	base     State // the state at PrepareDecrypt, Commit fails if it changed in between
+	next     State // the state after the decryption, its MKSkipped is the staging store
+	staged   *stagedSkippedKeys
+	consumed SkippedKey
+	done     bool
+}
+
+// PrepareDecrypt decrypts a message like RatchetDecrypt, but the state changes are only applied by Commit.
+// A failed decryption leaves no trace in the state.
+func (s *State) PrepareDecrypt(header *MessageHeader, ciphertext, associatedData []byte) (*PendingDecrypt, error) {
+	p := s.prepare()
+	plaintext, consumed, err := p.next.ratchetDecrypt(header, ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	p.Plaintext, p.consumed = plaintext, consumed
+	return p, nil
+}
+
+// PrepareDecryptHE is PrepareDecrypt for a message with an encrypted header, see RatchetDecryptHE.
+func (s *State) PrepareDecryptHE(encHeader, ciphertext, associatedData []byte) (*PendingDecrypt, error) {
+	p := s.prepare()
+	plaintext, consumed, err := p.next.ratchetDecryptHE(encHeader, ciphertext, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	p.Plaintext, p.consumed = plaintext, consumed
+	return p, nil
+}
+
+// prepare returns a PendingDecrypt whose next state is a copy of s writing to a staging store.
+// The copy may share byte slices and keys with s, the ratchet only ever replaces them.
+func (s *State) prepare() *PendingDecrypt {
+	p := &PendingDecrypt{
+		state:  s,
+		base:   *s,
+		next:   *s,
+		staged: &stagedSkippedKeys{base: s.MKSkipped},
+	}
+	p.next.MKSkipped = p.staged
+	return p
+}
+
+// Commit applies the state changes of the decryption: the skipped message keys are stored and deleted
+// in the order of the decryption, the message is remembered as consumed and the ratchet advances.
+// ErrStaleDecrypt is returned if the state has been changed since PrepareDecrypt, e.g. by another decryption or an encryption,
+// the message has to be prepared again then.
+func (p *PendingDecrypt) Commit() error {
+	if p.done || !p.state.sameRatchet(&p.base) {
+		return ErrStaleDecrypt
+	}
+	if err := p.staged.apply(); err != nil {
+		return err
+	}
+	p.done = true
+
+	consumed := p.state.Consumed
+	*p.state = p.next
+	p.state.MKSkipped = p.staged.base
+	p.state.Consumed = consumed
+	p.state.consume(p.consumed)
+	return nil
+}
+
+// MarshalBinary encodes the state as Commit will leave it, including the skipped message keys and the consumed message.
+// The caller can persist the state before Commit and Discard the decryption if the write fails.
+// A custom SkippedKeyStore is encoded with the limits of a MemorySkippedKeyStore.
+func (p *PendingDecrypt) MarshalBinary() ([]byte, error) {
+	skipped := NewMemorySkippedKeyStore()
+	if base, ok := p.staged.base.(*MemorySkippedKeyStore); ok {
+		skipped.MaxKeys, skipped.MaxSteps, skipped.MaxAge = base.MaxKeys, base.MaxSteps, base.MaxAge
+	}
+	keys, err := p.staged.base.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := skipped.Put(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := (&stagedSkippedKeys{base: skipped, ops: p.staged.ops}).apply(); err != nil {
+		return nil, err
+	}
+
+	next := p.next
+	next.MKSkipped = skipped
+	next.Consumed = NewConsumedKeys()
+	if p.state.Consumed != nil {
+		next.Consumed.Max = p.state.Consumed.Max
+	}
+	for _, key := range p.state.Consumed.Keys() {
+		next.Consumed.Add(key)
+	}
+	next.Consumed.Add(p.consumed)
+	return next.MarshalBinary()
+}
+
+// Discard drops the decryption, the state stays as it was before PrepareDecrypt.
+func (p *PendingDecrypt) Discard() {
+	p.done = true
+}
+
+// sameRatchet reports whether s is still in the ratchet position of other
+func (s *State) sameRatchet(other *State) bool {
+	if s.Ns != other.Ns || s.Nr != other.Nr || s.PN != other.PN || s.Step != other.Step {
+		return false
+	}
+	return bytes.Equal(s.RK, other.RK) && bytes.Equal(s.CKs, other.CKs) && bytes.Equal(s.CKr, other.CKr) &&
+		bytes.Equal(s.HKs, other.HKs) && bytes.Equal(s.HKr, other.HKr) && bytes.Equal(s.NHKs, other.NHKs) && bytes.Equal(s.NHKr, other.NHKr)
+}
+
+// stagedSkippedKeys records the changes of a decryption to a SkippedKeyStore and applies them on commit.
+// Reads see the store as if the changes had been applied already.
+type stagedSkippedKeys struct {
+	base    SkippedKeyStore
+	ops     []skippedKeyOp
+	put     map[SkippedKey]SkippedMessageKey
+	deleted map[SkippedKey]bool
+}
+
+// skippedKeyOp is a Put, a Delete or an Expire on the staged store
+type skippedKeyOp struct {
+	put    *SkippedMessageKey
+	delete *SkippedKey
+	step   int
+	now    time.Time
+}
+
+func (st *stagedSkippedKeys) Put(key SkippedMessageKey) error {
+	if st.put == nil {
+		st.put = make(map[SkippedKey]SkippedMessageKey)
+	}
+	st.ops = append(st.ops, skippedKeyOp{put: &key})
+	st.put[key.SkippedKey] = key
+	delete(st.deleted, key.SkippedKey)
+	return nil
+}
+
+func (st *stagedSkippedKeys) Get(key SkippedKey) ([]byte, bool, error) {
+	if st.deleted[key] {
+		return nil, false, nil
+	}
+	if staged, ok := st.put[key]; ok {
+		return staged.MK, true, nil
+	}
+	return st.base.Get(key)
+}
+
+func (st *stagedSkippedKeys) Delete(key SkippedKey) error {
+	if st.deleted == nil {
+		st.deleted = make(map[SkippedKey]bool)
+	}
+	st.ops = append(st.ops, skippedKeyOp{delete: &key})
+	st.deleted[key] = true
+	delete(st.put, key)
+	return nil
+}
+
+// Expire is applied on commit only. The staged view hides the keys a MemorySkippedKeyStore purges right away,
+// so a key which expired before the decryption can not decrypt the message.
+func (st *stagedSkippedKeys) Expire(step int, now time.Time) error {
+	st.ops = append(st.ops, skippedKeyOp{step: step, now: now})
+
+	memory, ok := st.base.(*MemorySkippedKeyStore)
+	if !ok {
+		return nil
+	}
+	keys, err := st.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !memory.expired(key, step, now) {
+			continue
+		}
+		if st.deleted == nil {
+			st.deleted = make(map[SkippedKey]bool)
+		}
+		st.deleted[key.SkippedKey] = true
+		delete(st.put, key.SkippedKey)
+	}
+	return nil
+}
+
+func (st *stagedSkippedKeys) Keys() ([]SkippedMessageKey, error) {
+	base, err := st.base.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]SkippedMessageKey, 0, len(base)+len(st.put))
+	for _, key := range base {
+		if _, replaced := st.put[key.SkippedKey]; !st.deleted[key.SkippedKey] && !replaced {
+			keys = append(keys, key)
+		}
+	}
+	emitted := make(map[SkippedKey]bool, len(st.put))
+	for _, op := range st.ops {
+		if op.put == nil || emitted[op.put.SkippedKey] {
+			continue
+		}
+		if staged, ok := st.put[op.put.SkippedKey]; ok {
+			emitted[op.put.SkippedKey] = true
+			keys = append(keys, staged)
+		}
+	}
+	return keys, nil
+}
+
+// apply replays the recorded changes on the underlying store. All changes are idempotent,
+// so a commit which failed in between can be retried.
+func (st *stagedSkippedKeys) apply() error {
+	for _, op := range st.ops {
+		var err error
+		switch {
+		case op.put != nil:
+			err = st.base.Put(*op.put)
+		case op.delete != nil:
+			err = st.base.Delete(*op.delete)
+		default:
+			err = st.base.Expire(op.step, op.now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package doubleratchet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPrepareDecryptCommit(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2", "a3")
+	a3 := s.aliceSentMessages[2]
+
+	before := marshalState(t, s.bob)
+	pending, err := s.bob.PrepareDecrypt(a3.header, a3.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecrypt failed:", err.Error())
+	}
+	if !bytes.Equal(pending.Plaintext, a3.plaintext) {
+		t.Fatal("Did not receive the correct plaintext")
+	}
+	if !bytes.Equal(before, marshalState(t, s.bob)) {
+		t.Fatal("PrepareDecrypt must not change the state")
+	}
+
+	if err := pending.Commit(); err != nil {
+		t.Fatal("Commit failed:", err.Error())
+	}
+	if skippedKeyCount(t, s.bob) != 2 || s.bob.Nr != 3 {
+		t.Fatalf("Commit did not apply the decryption, skipped keys: %d, Nr: %d", skippedKeyCount(t, s.bob), s.bob.Nr)
+	}
+	if err := pending.Commit(); !errors.Is(err, ErrStaleDecrypt) {
+		t.Fatal("Expected ErrStaleDecrypt for a second commit, Actual:", err)
+	}
+
+	s.aliceSentMessages[2] = nil
+	s.bobReceiveMessages(2, 1)
+}
+
+func TestPendingDecryptMarshalBinary(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2", "a3")
+	s.bobReceiveMessages(1)
+	s.bobSendMessages("b1")
+	s.aliceReceiveMessages(1)
+	s.aliceSendMessages("a4", "a5")
+	a5 := s.aliceSentMessages[4]
+
+	pending, err := s.bob.PrepareDecrypt(a5.header, a5.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecrypt failed:", err.Error())
+	}
+	encoded, err := pending.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary failed:", err.Error())
+	}
+	if err := pending.Commit(); err != nil {
+		t.Fatal("Commit failed:", err.Error())
+	}
+	if !bytes.Equal(encoded, marshalState(t, s.bob)) {
+		t.Fatal("MarshalBinary has to encode the state after Commit")
+	}
+}
+
+func TestPrepareDecryptDiscard(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2")
+	a2 := s.aliceSentMessages[1]
+
+	before := marshalState(t, s.bob)
+	pending, err := s.bob.PrepareDecrypt(a2.header, a2.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecrypt failed:", err.Error())
+	}
+	pending.Discard()
+	if err := pending.Commit(); !errors.Is(err, ErrStaleDecrypt) {
+		t.Fatal("Expected ErrStaleDecrypt after Discard, Actual:", err)
+	}
+	if !bytes.Equal(before, marshalState(t, s.bob)) {
+		t.Fatal("Discard must not change the state")
+	}
+
+	// the message can be decrypted again, e.g. after a crash before it was stored
+	s.bobReceiveMessages(2, 1)
+}
+
+// TestFailedDecryptLeavesNoSkippedKeys checks that the skipped message keys of a failed decryption are not stored,
+// the old backup of the State shared the store with the failed attempt.
+func TestFailedDecryptLeavesNoSkippedKeys(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2", "a3")
+	a3 := s.aliceSentMessages[2]
+
+	tampered := bytes.Clone(a3.ciphertext)
+	tampered[0] ^= 0x01
+	if _, err := s.bob.RatchetDecrypt(a3.header, tampered, []byte("associatedData")); !errors.Is(err, ErrAuthentication) {
+		t.Fatal("Expected ErrAuthentication, Actual:", err)
+	}
+	if count := skippedKeyCount(t, s.bob); count != 0 {
+		t.Fatal("Failed decryption stored skipped message keys:", count)
+	}
+	s.bobReceiveMessages(3, 1, 2)
+}
+
+func TestCommitOfStaleDecrypt(t *testing.T) {
+	s := initTest(t, bytes.Repeat([]byte{0x01}, 32))
+	s.aliceSendMessages("a1", "a2")
+	a1, a2 := s.aliceSentMessages[0], s.aliceSentMessages[1]
+
+	first, err := s.bob.PrepareDecrypt(a1.header, a1.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecrypt failed:", err.Error())
+	}
+	second, err := s.bob.PrepareDecrypt(a2.header, a2.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecrypt failed:", err.Error())
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatal("Commit failed:", err.Error())
+	}
+	if err := second.Commit(); !errors.Is(err, ErrStaleDecrypt) {
+		t.Fatal("Expected ErrStaleDecrypt, Actual:", err)
+	}
+	s.bobReceiveMessages(2)
+
+	// an encryption between prepare and commit changes the sending chain
+	s.aliceSendMessages("a3")
+	a3 := s.aliceSentMessages[2]
+	pending, err := s.bob.PrepareDecrypt(a3.header, a3.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecrypt failed:", err.Error())
+	}
+	s.bobSendMessages("b1")
+	if err := pending.Commit(); !errors.Is(err, ErrStaleDecrypt) {
+		t.Fatal("Expected ErrStaleDecrypt, Actual:", err)
+	}
+}
+
+func TestPrepareDecryptHE(t *testing.T) {
+	alice, bob := initTestHE(t)
+	a1 := sendMessageHE(t, alice, "a1")
+	a2 := sendMessageHE(t, alice, "a2")
+
+	before := marshalState(t, bob)
+	pending, err := bob.PrepareDecryptHE(a2.encHeader, a2.ciphertext, []byte("associatedData"))
+	if err != nil {
+		t.Fatal("PrepareDecryptHE failed:", err.Error())
+	}
+	if !bytes.Equal(before, marshalState(t, bob)) {
+		t.Fatal("PrepareDecryptHE must not change the state")
+	}
+	if err := pending.Commit(); err != nil {
+		t.Fatal("Commit failed:", err.Error())
+	}
+	receiveMessageHE(t, bob, a1)
+}
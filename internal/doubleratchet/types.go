@@ -1,17 +1,19 @@
 package doubleratchet
 
-import (
-	"crypto/ecdh"
-)
+import "bytes"
 
 const MaxSkip = 1000
 
 // MessageHeader holds the Double Ratchet message header.
 // has to stay public for parsing
 type MessageHeader struct {
-	DH *ecdh.PublicKey // Ratchet public key
-	PN int             // Previous chain length
-	N  int             // Message number
+	DH PublicKey // Ratchet public key
+	PN int       // Previous chain length
+	N  int       // Message number
+
+	// KEM ratchet, only set in chains which take part in it
+	KEMPublicKey  []byte // ML-KEM-768 encapsulation key of the sender
+	KEMCiphertext []byte // ML-KEM-768 ciphertext for the receiver's last encapsulation key
 }
 
 func (h *MessageHeader) Equals(other *MessageHeader) bool {
@@ -27,17 +29,8 @@ func (h *MessageHeader) Equals(other *MessageHeader) bool {
 	if !h.DH.Equal(other.DH) {
 		return false
 	}
+	if !bytes.Equal(h.KEMPublicKey, other.KEMPublicKey) || !bytes.Equal(h.KEMCiphertext, other.KEMCiphertext) {
+		return false
+	}
 	return true
 }
-
-// has to stay public for parsing
-type ConcatenationPayload struct {
-	AD     []byte
-	Header ConcatenationHeader
-}
-
-type ConcatenationHeader struct {
-	DH []byte
-	PN int
-	N  int
-}
@@ -0,0 +1,166 @@
+// Package fingerprint derives safety numbers as specified by libsignal's NumericFingerprintGenerator,
+// so two users can verify each other's identity keys out of band by comparing digits or scanning a QR code.
+package fingerprint
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"signal/internal/x3dh"
+	"strings"
+)
+
+const (
+	// Iterations of SHA-512 over the identity key, libsignal uses 5200
+	Iterations = 5200
+	// ScannableVersion is the first byte of a scannable payload
+	ScannableVersion byte = 1
+
+	fingerprintVersion uint16 = 0
+	chunkCount                = 6  // chunks of 5 digits per party
+	scannableSize             = 32 // bytes of the hash per party in a scannable payload
+	payloadSize               = 1 + 2*scannableSize
+)
+
+var (
+	// ErrInvalidPayload is returned for a scanned payload which is not a scannable fingerprint.
+	ErrInvalidPayload = errors.New("invalid fingerprint payload")
+	// ErrVersionMismatch is returned for a scanned payload of another version, the other party has to update.
+	ErrVersionMismatch = errors.New("fingerprint version mismatch")
+	// ErrMismatch is returned if the scanned payload was not derived from the same identity keys and identifiers.
+	ErrMismatch = errors.New("fingerprint mismatch")
+)
+
+// Fingerprint is the combined fingerprint of a local and a remote identity.
+type Fingerprint struct {
+	local  []byte // hash of the local identity
+	remote []byte // hash of the remote identity
+}
+
+// New derives the fingerprint of the conversation between the local and the remote party.
+// The stable identifiers are the user names, both parties compute the same safety number.
+func New(localIdentifier string, localKey *ecdh.PublicKey, remoteIdentifier string, remoteKey *ecdh.PublicKey) *Fingerprint {
+	return &Fingerprint{
+		local:  hashIdentity(localIdentifier, localKey),
+		remote: hashIdentity(remoteIdentifier, remoteKey),
+	}
+}
+
+// hashIdentity iterates SHA-512 over the encoded identity key:
+// hash_0 = version || Encode(IK) || identifier, hash_i+1 = SHA-512(hash_i || Encode(IK))
+func hashIdentity(identifier string, key *ecdh.PublicKey) []byte {
+	encoded := x3dh.EncodePublicKey(key)
+	hash := binary.BigEndian.AppendUint16(nil, fingerprintVersion)
+	hash = append(hash, encoded...)
+	hash = append(hash, identifier...)
+	for range Iterations {
+		digest := sha512.New()
+		digest.Write(hash)
+		digest.Write(encoded)
+		hash = digest.Sum(hash[:0])
+	}
+	return hash
+}
+
+// displayable returns the 30 digits of one party: six chunks of 5 bytes, each reduced modulo 100000
+func displayable(hash []byte) string {
+	var digits []byte
+	for i := range chunkCount {
+		chunk := hash[i*5 : i*5+5]
+		var n uint64
+		for _, b := range chunk {
+			n = n<<8 | uint64(b)
+		}
+		digits = fmt.Appendf(digits, "%05d", n%100000)
+	}
+	return string(digits)
+}
+
+// SafetyNumber returns the 60 digit safety number. The digits of both parties are sorted,
+// so both sides display the same number.
+func (f *Fingerprint) SafetyNumber() string {
+	local, remote := displayable(f.local), displayable(f.remote)
+	if local <= remote {
+		return local + remote
+	}
+	return remote + local
+}
+
+// String returns the safety number in 12 groups of 5 digits, the way it is displayed to users.
+func (f *Fingerprint) String() string {
+	number := f.SafetyNumber()
+	var groups []string
+	for i := 0; i < len(number); i += 5 {
+		groups = append(groups, number[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+// ScannablePayload returns the payload to encode in a QR code: the version byte followed by
+// the first 32 bytes of the local and of the remote hash.
+func (f *Fingerprint) ScannablePayload() []byte {
+	payload := make([]byte, 0, payloadSize)
+	payload = append(payload, ScannableVersion)
+	payload = append(payload, f.local[:scannableSize]...)
+	return append(payload, f.remote[:scannableSize]...)
+}
+
+// Compare checks a payload scanned from the other party. Its local hash has to be our remote hash and vice versa.
+func (f *Fingerprint) Compare(scanned []byte) error {
+	if len(scanned) == 0 {
+		return ErrInvalidPayload
+	}
+	if scanned[0] != ScannableVersion {
+		return fmt.Errorf("%w: version %d, expected %d", ErrVersionMismatch, scanned[0], ScannableVersion)
+	}
+	if len(scanned) != payloadSize {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidPayload, len(scanned))
+	}
+	theirLocal, theirRemote := scanned[1:1+scannableSize], scanned[1+scannableSize:]
+	if subtle.ConstantTimeCompare(theirLocal, f.remote[:scannableSize])&subtle.ConstantTimeCompare(theirRemote, f.local[:scannableSize]) != 1 {
+		if bytes.Equal(theirLocal, f.local[:scannableSize]) {
+			return fmt.Errorf("%w: scanned our own payload", ErrMismatch)
+		}
+		return ErrMismatch
+	}
+	return nil
+}
+
+// ForContact returns the fingerprint of client with the identity key recorded in its trust store for userName.
+func ForContact(client *x3dh.Client, userName string) (*Fingerprint, error) {
+	f, _, err := forContact(client, userName)
+	return f, err
+}
+
+func forContact(client *x3dh.Client, userName string) (*Fingerprint, *ecdh.PublicKey, error) {
+	identity, ok, err := client.Trust.Identity(userName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: no identity key recorded for %s", x3dh.ErrUnknownPeer, userName)
+	}
+	if identity.Status == x3dh.TrustChanged {
+		return nil, nil, &x3dh.IdentityChanged{UserName: userName, OldKey: identity.IdentityKey, NewKey: identity.ChangedKey}
+	}
+	return New(client.UserName, client.IdentityKey.PublicKey(), userName, identity.IdentityKey), identity.IdentityKey, nil
+}
+
+// VerifyScanned compares a payload scanned from userName with the fingerprint of the recorded identity key
+// and marks the contact as verified in the trust store of client if they match.
+// x3dh.ErrIdentityMismatch is returned if the recorded key was replaced while the payload was compared.
+func VerifyScanned(client *x3dh.Client, userName string, scanned []byte) error {
+	f, identityKey, err := forContact(client, userName)
+	if err != nil {
+		return err
+	}
+	if err := f.Compare(scanned); err != nil {
+		return err
+	}
+	// VerifyIdentity fails with x3dh.ErrIdentityMismatch if the recorded key changed in the meantime
+	return client.VerifyIdentity(userName, identityKey)
+}
@@ -0,0 +1,160 @@
+package fingerprint
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
+	"signal/internal/x3dh"
+	"testing"
+)
+
+// Vector from libsignal's NumericFingerprintGeneratorTest, the identifiers are phone numbers there.
+const (
+	vectorAliceIdentity     = "06863bc66d02b40d27b8d49ca7c09e9239236f9d7d25d6fcca5ce13c7064d868"
+	vectorBobIdentity       = "f781b6fb32fed9ba1cf2de978d4d5da28dc34046ae814402b5c0dbd96fda907b"
+	vectorAliceIdentifier   = "+14152222222"
+	vectorBobIdentifier     = "+14153333333"
+	vectorDisplayableNumber = "300354477692869396892869876765458257569162576843440918079131"
+)
+
+func decodeKey(t *testing.T, s string) *ecdh.PublicKey {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal("DecodeString failed:", err.Error())
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		t.Fatal("NewPublicKey failed:", err.Error())
+	}
+	return key
+}
+
+func TestSafetyNumberVector(t *testing.T) {
+	alice, bob := decodeKey(t, vectorAliceIdentity), decodeKey(t, vectorBobIdentity)
+	aliceFingerprint := New(vectorAliceIdentifier, alice, vectorBobIdentifier, bob)
+	bobFingerprint := New(vectorBobIdentifier, bob, vectorAliceIdentifier, alice)
+
+	if number := aliceFingerprint.SafetyNumber(); number != vectorDisplayableNumber {
+		t.Fatal("Expected", vectorDisplayableNumber, "Actual:", number)
+	}
+	if bobFingerprint.SafetyNumber() != vectorDisplayableNumber {
+		t.Fatal("Both parties have to display the same safety number")
+	}
+	if s := aliceFingerprint.String(); len(s) != 71 || s[:11] != "30035 44776" {
+		t.Fatal("Expected 12 groups of 5 digits, Actual:", s)
+	}
+}
+
+func TestCompareScannablePayload(t *testing.T) {
+	alice, bob := decodeKey(t, vectorAliceIdentity), decodeKey(t, vectorBobIdentity)
+	aliceFingerprint := New("alice", alice, "bob", bob)
+	bobFingerprint := New("bob", bob, "alice", alice)
+
+	if err := aliceFingerprint.Compare(bobFingerprint.ScannablePayload()); err != nil {
+		t.Fatal("Compare failed:", err.Error())
+	}
+	if err := bobFingerprint.Compare(aliceFingerprint.ScannablePayload()); err != nil {
+		t.Fatal("Compare failed:", err.Error())
+	}
+	if err := aliceFingerprint.Compare(aliceFingerprint.ScannablePayload()); !errors.Is(err, ErrMismatch) {
+		t.Fatal("Expected ErrMismatch for our own payload, Actual:", err)
+	}
+
+	// mallory claims to be bob
+	mallory := New("bob", alice, "alice", alice)
+	if err := aliceFingerprint.Compare(mallory.ScannablePayload()); !errors.Is(err, ErrMismatch) {
+		t.Fatal("Expected ErrMismatch, Actual:", err)
+	}
+
+	payload := bobFingerprint.ScannablePayload()
+	payload[0]++
+	if err := aliceFingerprint.Compare(payload); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatal("Expected ErrVersionMismatch, Actual:", err)
+	}
+	if err := aliceFingerprint.Compare(bobFingerprint.ScannablePayload()[:10]); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatal("Expected ErrInvalidPayload, Actual:", err)
+	}
+}
+
+// replacingTrustStore replaces the identity key of a contact after it has been read once
+type replacingTrustStore struct {
+	x3dh.TrustStore
+	userName string
+	key      *ecdh.PublicKey
+}
+
+func (s *replacingTrustStore) Identity(userName string) (x3dh.TrustedIdentity, bool, error) {
+	identity, ok, err := s.TrustStore.Identity(userName)
+	if err != nil || !ok || userName != s.userName || s.key == nil {
+		return identity, ok, err
+	}
+	replaced := identity
+	replaced.IdentityKey, s.key = s.key, nil
+	return identity, ok, s.TrustStore.SaveIdentity(userName, replaced)
+}
+
+func TestVerifyScanned(t *testing.T) {
+	alice, bob := newTestClient(t, "alice"), newTestClient(t, "bob")
+	server := newTestServer(t)
+	for _, c := range []*x3dh.Client{alice, bob} {
+		if err := c.PublishKeyBundle(server); err != nil {
+			t.Fatal("PublishKeyBundle failed:", err.Error())
+		}
+	}
+	if err := VerifyScanned(alice, "bob", nil); !errors.Is(err, x3dh.ErrUnknownPeer) {
+		t.Fatal("Expected ErrUnknownPeer before the identity key is known, Actual:", err)
+	}
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if _, err := bob.GetKeyBundle(server, "alice"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+
+	aliceFingerprint, err := ForContact(alice, "bob")
+	if err != nil {
+		t.Fatal("ForContact failed:", err.Error())
+	}
+	bobFingerprint, err := ForContact(bob, "alice")
+	if err != nil {
+		t.Fatal("ForContact failed:", err.Error())
+	}
+	if aliceFingerprint.SafetyNumber() != bobFingerprint.SafetyNumber() {
+		t.Fatal("Both parties have to display the same safety number")
+	}
+
+	if err := VerifyScanned(alice, "bob", aliceFingerprint.ScannablePayload()); !errors.Is(err, ErrMismatch) {
+		t.Fatal("Expected ErrMismatch, Actual:", err)
+	}
+	if identity, _, _ := alice.Trust.Identity("bob"); identity.Status != x3dh.TrustUnverified {
+		t.Fatal("A mismatch must not verify the contact, Actual:", identity.Status)
+	}
+	if err := VerifyScanned(alice, "bob", bobFingerprint.ScannablePayload()); err != nil {
+		t.Fatal("VerifyScanned failed:", err.Error())
+	}
+	if identity, _, _ := alice.Trust.Identity("bob"); identity.Status != x3dh.TrustVerified {
+		t.Fatal("Expected verified, Actual:", identity.Status)
+	}
+}
+
+func TestVerifyScannedDetectsReplacedKey(t *testing.T) {
+	alice, bob := newTestClient(t, "alice"), newTestClient(t, "bob")
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	scanned := New("bob", bob.IdentityKey.PublicKey(), "alice", alice.IdentityKey.PublicKey()).ScannablePayload()
+
+	// the recorded key is replaced between the comparison and the verification
+	mallory := newTestClient(t, "mallory")
+	alice.Trust = &replacingTrustStore{TrustStore: alice.Trust, userName: "bob", key: mallory.IdentityKey.PublicKey()}
+	if err := VerifyScanned(alice, "bob", scanned); !errors.Is(err, x3dh.ErrIdentityMismatch) {
+		t.Fatal("Expected ErrIdentityMismatch, Actual:", err)
+	}
+	if identity, _, _ := alice.Trust.Identity("bob"); identity.Status == x3dh.TrustVerified {
+		t.Fatal("A replaced identity key must not be verified")
+	}
+}
@@ -0,0 +1,23 @@
+package fingerprint
+
+import (
+	"signal/internal/x3dh"
+	"testing"
+)
+
+// newTestClient returns a client acting for a new user with one one-time prekey
+func newTestClient(t *testing.T, name string) *x3dh.Client {
+	user, err := x3dh.NewUser(name, 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	return x3dh.NewClientFromUser(user)
+}
+
+func newTestServer(t *testing.T) *x3dh.Server {
+	server, err := x3dh.NewServer()
+	if err != nil {
+		t.Fatal("NewServer failed:", err.Error())
+	}
+	return server
+}
@@ -0,0 +1,31 @@
+// Package testutil holds the helpers shared by the tests of several packages. It is only imported by tests.
+package testutil
+
+import (
+	"crypto/sha256"
+	"golang.org/x/crypto/chacha20"
+	"io"
+)
+
+// DRBG is a deterministic entropy source: the ChaCha20 keystream under SHA-256(seed).
+// The known-answer vectors are generated from it, so its output must never change.
+type DRBG struct {
+	cipher *chacha20.Cipher
+}
+
+// NewDRBG returns the DRBG for seed.
+func NewDRBG(seed string) io.Reader {
+	key := sha256.Sum256([]byte(seed))
+	c, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		// key and nonce have the fixed sizes of ChaCha20
+		panic(err)
+	}
+	return &DRBG{cipher: c}
+}
+
+func (d *DRBG) Read(p []byte) (int, error) {
+	clear(p)
+	d.cipher.XORKeyStream(p, p)
+	return len(p), nil
+}
@@ -4,15 +4,15 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
-	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
 	"golang.org/x/crypto/hkdf"
 	"io"
 	"signal/internal/doubleratchet"
+	"signal/internal/xeddsa"
 	"strings"
+	"sync"
 )
 
 const KDFLen = 32
@@ -22,12 +22,32 @@ var (
 	KDFF    = strings.Repeat("\xff", KDFLen)
 )
 
+// PreKeyType marks which kind of prekey of the responder was used for DH4.
+type PreKeyType byte
+
+const (
+	PreKeyNone       PreKeyType = iota // 3-DH handshake, no prekey was available and DH4 is omitted
+	PreKeyOneTime                      // DH4 with a one-time prekey, which is deleted by the responder
+	PreKeyLastResort                   // DH4 with the reusable last-resort prekey
+)
+
+// PreKey is the public half of a one-time prekey together with the ID the owner stores the private half under.
+type PreKey struct {
+	ID  uint32
+	Key *ecdh.PublicKey
+}
+
 // TODO Split in two structs one for receiving and one for sending (different keys)
 type KeyBundleSending struct {
 	IdentityKey        *ecdh.PublicKey
 	SignedPreKey       *ecdh.PublicKey
 	SignedPreKeySigned []byte
-	OneTimePreKeys     []*ecdh.PublicKey
+	SignedPreKeyID     uint32
+	OneTimePreKeys     []PreKey
+	LastResortPreKey   *ecdh.PublicKey // handed out by the server instead of a one-time prekey once the pool is empty
+	PQPreKey           *PQPreKey       // signed ML-KEM-768 prekey for PQXDH, nil falls back to X3DH
+	Sequence           uint64          // increases with every published bundle, so the directory accepts a bundle once
+	Signature          []byte          // SIG(IK_s, bundleMessage), set by User.Publish for the upload
 }
 
 type KeyBundleReceiving struct {
@@ -36,56 +56,186 @@ type KeyBundleReceiving struct {
 	IdentityKey        *ecdh.PublicKey
 	SignedPreKey       *ecdh.PublicKey
 	SignedPreKeySigned []byte
-	OneTimePreKeys     []*ecdh.PublicKey
-	OneTimePreKey      *ecdh.PublicKey
+	SignedPreKeyID     uint32
+	OneTimePreKeys     []PreKey
+	OneTimePreKey      *ecdh.PublicKey // prekey used for DH4, nil for a 3-DH handshake
+	OneTimePreKeyID    uint32
+	PreKeyType         PreKeyType
+	PQPreKey           *PQPreKey // nil for a classic X3DH handshake
+	PQCiphertext       []byte    // ML-KEM ciphertext of the shared secret mixed into SK
+}
+
+// InitialMessage is the X3DH hello Alice sends to Bob.
+// It carries everything Bob needs to recompute the shared secret, plus an AEAD ciphertext under that secret.
+type InitialMessage struct {
+	IdentityKey     *ecdh.PublicKey // Alice's identity key IK_A
+	EphemeralKey    *ecdh.PublicKey // Alice's ephemeral key EK_A
+	SignedPreKeyID  uint32          // identifies which of Bob's signed prekeys was used
+	PreKeyType      PreKeyType      // marks whether DH4 was computed and with which kind of prekey
+	OneTimePreKeyID uint32          // identifies which of Bob's one-time prekeys was used, only set for PreKeyOneTime
+	PQPreKeyID      uint32          // identifies which of Bob's PQ prekeys was used, only set for PQXDH
+	PQCiphertext    []byte          // ML-KEM-768 ciphertext encapsulated to Bob's PQ prekey, nil for X3DH
+	Nonce           []byte          // 16 byte aes nonce
+	Ciphertext      []byte          // AES-GCM of the Envelope under SK with AD = Encode(IK_A) || Encode(IK_B)
 }
 
-type AssociatedData struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Message string `json:"message"`
+// Envelope is the plaintext of the initial ciphertext. The usernames are authenticated together with the message
+// by the AEAD, the identity keys are bound by AD.
+type Envelope struct {
+	From    string
+	To      string
+	Message string
 }
 
 type Client struct {
 	UserName    string
 	IdentityKey *ecdh.PrivateKey
-	keyBundles  map[string]KeyBundleReceiving
-	drKeys      map[string]struct{}
+	user        *User // private keys to accept sessions, may be nil for a client which only initiates
+	// OneTimePreKeyThreshold is the low watermark of one-time prekeys on the server, below it a new batch
+	// of OneTimePreKeyBatch prekeys is uploaded by ReplenishOneTimePreKeys
+	OneTimePreKeyThreshold int
+	OneTimePreKeyBatch     int
+	// Rand is the entropy source of ephemeral keys, nonces, signatures and sessions, crypto/rand.Reader if nil.
+	// It has to be safe for concurrent use if sessions are used concurrently.
+	Rand io.Reader
+	// Trust records the identity keys of contacts on first use. It is the store of the user for NewClientFromUser
+	// and an in-memory store for NewClient, unless replaced by a FileTrustStore
+	Trust TrustStore
+	// OnIdentityChanged is called if a contact shows up with another identity key, it may be nil.
+	// It is called while the client is locked and must not call back into the client.
+	OnIdentityChanged func(*IdentityChanged)
+	// LogKey is the key the transparency log of the directory signs its tree heads with. If nil, the key of the
+	// first directory with a log is pinned. Bundles of directories without a log are not checked.
+	LogKey     *ecdh.PublicKey
+	mu         sync.Mutex // guards keyBundles, the trust decisions and the private keys of user during handshakes
+	keyBundles map[string]*KeyBundleReceiving
+	sessions   *sessionTable
+	logMu      sync.Mutex      // serializes the checks against the transparency log, guards LogKey, treeHead and monitored
+	treeHead   *SignedTreeHead // latest verified tree head of the log
+	monitored  merkleFrontier  // the log entries checked by MonitorLog
 }
 
 func NewClient() *Client {
-	return &Client{
-		keyBundles: make(map[string]KeyBundleReceiving),
-		drKeys:     make(map[string]struct{}),
+	c := &Client{
+		OneTimePreKeyThreshold: DefaultOneTimePreKeyThreshold,
+		OneTimePreKeyBatch:     DefaultOneTimePreKeyBatch,
+		Trust:                  NewMemoryTrustStore(),
+		keyBundles:             make(map[string]*KeyBundleReceiving),
 	}
+	c.sessions = newSessionTable(nil, c.random)
+	return c
 }
 
-func (c *Client) GetKeyBundle(server Server, userName string) bool {
-	if _, ok := c.keyBundles[userName]; ok {
-		if _, ok := c.drKeys[userName]; ok {
-			fmt.Println("Already stored " + userName + " locally, no need handshake again")
-			return false
+// NewClientFromUser returns a client acting as user, which can initiate and accept sessions.
+// The client shares the entropy source of user and its store, which records the trusted identity keys
+// and the sessions, so a client of a user restored with LoadUser continues its sessions.
+func NewClientFromUser(user *User) *Client {
+	c := NewClient()
+	c.UserName = user.name
+	c.IdentityKey = user.IdentityKey
+	c.Rand = user.Rand
+	c.user = user
+	c.Trust = user.store
+	c.sessions = newSessionTable(user.store, c.random)
+	return c
+}
+
+func (c *Client) random() io.Reader {
+	if c.Rand == nil {
+		return rand.Reader
+	}
+	return c.Rand
+}
+
+func (c *Client) GetKeyBundle(directory KeyDirectory, userName string) (bool, error) {
+	c.mu.Lock()
+	_, ok := c.keyBundles[userName]
+	c.mu.Unlock()
+	if ok {
+		if _, ok, err := c.sessions.get(userName); err != nil {
+			return false, err
+		} else if ok {
+			// there is a session with userName already, no new handshake is needed
+			return false, nil
+		}
+	}
+
+	bundle, err := directory.GetKeyBundle(userName)
+	if err != nil {
+		return false, err
+	}
+	if log, ok := directory.(TransparencyLog); ok {
+		if err := c.verifyPublication(log, userName, bundle.IdentityKey); err != nil {
+			return false, err
 		}
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkIdentity(userName, bundle.IdentityKey); err != nil {
+		return false, err
+	}
+	c.setKeyBundle(userName, bundle)
+	return true, nil
+}
 
-	c.keyBundles[userName] = server.GetKeyBundle(userName)
-	return true
+// setKeyBundle stores a fetched bundle of userName and picks the one-time prekey to use for the handshake.
+// c.mu has to be held.
+func (c *Client) setKeyBundle(userName string, bundle KeyBundleSending) {
+	keyBundle := &KeyBundleReceiving{
+		IdentityKey:        bundle.IdentityKey,
+		SignedPreKey:       bundle.SignedPreKey,
+		SignedPreKeySigned: bundle.SignedPreKeySigned,
+		SignedPreKeyID:     bundle.SignedPreKeyID,
+		OneTimePreKeys:     bundle.OneTimePreKeys,
+		PQPreKey:           bundle.PQPreKey,
+	}
+	switch {
+	case len(bundle.OneTimePreKeys) > 0:
+		keyBundle.OneTimePreKey = bundle.OneTimePreKeys[0].Key
+		keyBundle.OneTimePreKeyID = bundle.OneTimePreKeys[0].ID
+		keyBundle.PreKeyType = PreKeyOneTime
+	case bundle.LastResortPreKey != nil:
+		keyBundle.OneTimePreKey = bundle.LastResortPreKey
+		keyBundle.PreKeyType = PreKeyLastResort
+	default:
+		keyBundle.PreKeyType = PreKeyNone
+	}
+	c.keyBundles[userName] = keyBundle
 }
 
-func (c *Client) InitialHandshake(server Server, userName string) error {
-	if c.GetKeyBundle(server, userName) {
+func (c *Client) InitialHandshake(directory KeyDirectory, userName string) error {
+	fetched, err := c.GetKeyBundle(directory, userName)
+	if err != nil {
+		return err
+	}
+	if fetched {
 		// Generate Ephemeral Key Pair
-		ek, err := doubleratchet.GenerateDH()
+		ek, err := doubleratchet.GenerateDHWithRandom(c.random())
 		if err != nil {
-			fmt.Println("Error generating ephemeral key:", err)
 			return err
 		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
 		c.keyBundles[userName].EphemeralKey = ek
 		return nil
 	}
 	return nil
 }
 
+// PublishKeyBundle uploads the key bundle of the client's user to directory.
+func (c *Client) PublishKeyBundle(directory KeyDirectory) error {
+	if c.user == nil {
+		return fmt.Errorf("%w to publish", ErrNoUser)
+	}
+	c.mu.Lock()
+	bundle, err := c.user.Publish()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return directory.UploadKeyBundle(c.UserName, bundle)
+}
+
 func x3dhKDF(keyMaterial []byte) ([]byte, error) {
 	km := append([]byte(KDFF), keyMaterial...)
 	salt := []byte(KDFSalt)
@@ -100,9 +250,26 @@ func x3dhKDF(keyMaterial []byte) ([]byte, error) {
 }
 
 func (c *Client) GenerateSendSecretKey(userName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	keyBundle, ok := c.keyBundles[userName]
 	if !ok {
-		return fmt.Errorf("key bundle for user %s not found", userName)
+		return fmt.Errorf("%w: no key bundle for %s", ErrUnknownPeer, userName)
+	}
+
+	if c.IdentityKey == nil {
+		return fmt.Errorf("%w to initiate a handshake", ErrNoUser)
+	}
+	if keyBundle.EphemeralKey == nil {
+		return fmt.Errorf("%w for %s", ErrNoEphemeralKey, userName)
+	}
+	if keyBundle.IdentityKey == nil || keyBundle.SignedPreKey == nil || (keyBundle.PreKeyType != PreKeyNone && keyBundle.OneTimePreKey == nil) {
+		return fmt.Errorf("%w: missing keys in the bundle of %s", ErrInvalidBundle, userName)
+	}
+	// the signed prekey is only used once it is proven to belong to the identity key
+	if !xeddsa.Verify(keyBundle.IdentityKey, keyBundle.SignedPreKey.Bytes(), keyBundle.SignedPreKeySigned) {
+		return fmt.Errorf("%w: signed prekey of %s", ErrInvalidSignature, userName)
 	}
 
 	DH1, err := doubleratchet.DH(c.IdentityKey, keyBundle.SignedPreKey)
@@ -117,16 +284,32 @@ func (c *Client) GenerateSendSecretKey(userName string) error {
 	if err != nil {
 		return err
 	}
-	DH4, err := doubleratchet.DH(keyBundle.EphemeralKey, keyBundle.OneTimePreKey)
-	if err != nil {
-		return err
+	keyMaterial := append(append(DH1, DH2...), DH3...)
+
+	// without any prekey the spec allows to omit DH4
+	if keyBundle.PreKeyType != PreKeyNone {
+		DH4, err := doubleratchet.DH(keyBundle.EphemeralKey, keyBundle.OneTimePreKey)
+		if err != nil {
+			return err
+		}
+		keyMaterial = append(keyMaterial, DH4...)
 	}
 
-	if !ed25519.Verify(c.IdentityKey.PublicKey().Bytes(), keyBundle.SignedPreKey.Bytes(), keyBundle.SignedPreKeySigned) {
-		return fmt.Errorf("unable to verify signed prekey")
+	// PQXDH: SS is appended after the DHs, bundles without PQ prekey fall back to X3DH
+	keyBundle.PQCiphertext = nil
+	if keyBundle.PQPreKey != nil {
+		if !verifyPQPreKey(keyBundle.IdentityKey, keyBundle.PQPreKey) {
+			return fmt.Errorf("%w: PQ prekey of %s", ErrInvalidSignature, userName)
+		}
+		ciphertext, SS, err := pqEncapsulate(c.random(), keyBundle.PQPreKey)
+		if err != nil {
+			return err
+		}
+		keyMaterial = append(keyMaterial, SS...)
+		keyBundle.PQCiphertext = ciphertext
 	}
 
-	sk, err := x3dhKDF(append(append(append(DH1, DH2...), DH3...), DH4...))
+	sk, err := x3dhKDF(keyMaterial)
 	if err != nil {
 		return err
 	}
@@ -135,41 +318,61 @@ func (c *Client) GenerateSendSecretKey(userName string) error {
 	return nil
 }
 
-func (c *Client) BuildX3DHHello(userName string, ad string) (*KeyBundleSending, error) {
-	// TODO may not be correct implementation, likely to be a failure point
-	binaryAd, err := json.Marshal(AssociatedData{
-		From:    c.UserName,
-		To:      userName,
-		Message: ad,
-	})
+// BuildX3DHHello builds the initial message for userName. GenerateSendSecretKey has to be called beforehand.
+// The usernames and message are sent in the encrypted Envelope.
+func (c *Client) BuildX3DHHello(userName string, message string) (*InitialMessage, error) {
+	envelope, err := (&Envelope{From: c.UserName, To: userName, Message: message}).MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	keyBundle, ok := c.keyBundles[userName]
 	if !ok {
-		return nil, fmt.Errorf("key bundle for user %s not found", userName)
+		return nil, fmt.Errorf("%w: no key bundle for %s", ErrUnknownPeer, userName)
+	}
+	if len(keyBundle.SecretKey) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoSecretKey, userName)
 	}
-
-	// 64 byte signature
-	key_comb := append(append(c.IdentityKey.PublicKey().Bytes(), keyBundle.EphemeralKey.PublicKey().Bytes()...), keyBundle.OneTimePreKey.Bytes()...)
-	signature := ed25519.Sign(c.IdentityKey.Bytes(), append(key_comb, binaryAd...))
 
 	// 16 byte random aes nonce
 	nonce := make([]byte, aes.BlockSize)
-	_, err = rand.Read(nonce)
+	_, err = io.ReadFull(c.random(), nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newHelloAEAD(keyBundle.SecretKey)
 	if err != nil {
 		return nil, err
 	}
 
-	cipherBlock, err := aes.NewCipher(keyBundle.SecretKey)
-	// 32 + 32 + len(ad) byte cipher text
-	cipherText, err := cipher.NewGCM(cipherBlock)
+	ad := associatedData(c.IdentityKey.PublicKey(), keyBundle.IdentityKey)
+	cipherText := aead.Seal(nil, nonce, envelope, ad)
 
-	return &KeyBundleSending{
-		IdentityKey:        c.IdentityKey.PublicKey(),
-		SignedPreKey:       keyBundle.SignedPreKey,
-		SignedPreKeySigned: keyBundle.SignedPreKeySigned,
-		OneTimePreKeys:     keyBundle.OneTimePreKeys,
-	}, nil
+	hello := &InitialMessage{
+		IdentityKey:     c.IdentityKey.PublicKey(),
+		EphemeralKey:    keyBundle.EphemeralKey.PublicKey(),
+		SignedPreKeyID:  keyBundle.SignedPreKeyID,
+		PreKeyType:      keyBundle.PreKeyType,
+		OneTimePreKeyID: keyBundle.OneTimePreKeyID,
+		Nonce:           nonce,
+		Ciphertext:      cipherText,
+	}
+	if keyBundle.PQCiphertext != nil {
+		hello.PQPreKeyID = keyBundle.PQPreKey.ID
+		hello.PQCiphertext = keyBundle.PQCiphertext
+	}
+	return hello, nil
+}
+
+// newHelloAEAD returns the AES-GCM instance used for the initial message, keyed with the X3DH shared secret.
+func newHelloAEAD(secretKey []byte) (cipher.AEAD, error) {
+	cipherBlock, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(cipherBlock, aes.BlockSize)
 }
@@ -0,0 +1,117 @@
+package x3dh
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// stressMessages is the number of messages sent in each direction by the stress tests
+func stressMessages() int {
+	if testing.Short() {
+		return 200
+	}
+	return 2000
+}
+
+// sendConcurrently encrypts n messages for to with the given number of goroutines and delivers them on the returned channel.
+// Goroutines race for the sending chain, so messages may arrive slightly out of order.
+func sendConcurrently(t *testing.T, from *Client, to string, senders, n int) <-chan *Message {
+	out := make(chan *Message, n)
+	var wg sync.WaitGroup
+	for g := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := g; i < n; i += senders {
+				msg, err := from.EncryptMessage(to, []byte(fmt.Sprintf("%s %d", from.UserName, i)))
+				if err != nil {
+					t.Error("EncryptMessage failed:", err.Error())
+					return
+				}
+				out <- msg
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// receiveConcurrently decrypts all messages of in from the peer and sends the number of decrypted messages on done
+func receiveConcurrently(t *testing.T, c *Client, from string, in <-chan *Message, done chan<- int) {
+	received := 0
+	for msg := range in {
+		if _, err := c.DecryptMessage(from, msg); err != nil {
+			t.Error("DecryptMessage failed:", err.Error())
+			continue
+		}
+		received++
+	}
+	done <- received
+}
+
+// TestSessionConcurrentSendReceive interleaves sends and receives of both parties on the same sessions.
+// Run with -race.
+func TestSessionConcurrentSendReceive(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	startTestSession(t, alice, bobUser)
+	decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "Hello Bob"), "Hello Bob")
+
+	n := stressMessages()
+	done := make(chan int, 2)
+	go receiveConcurrently(t, bob, "alice", sendConcurrently(t, alice, "bob", 4, n), done)
+	go receiveConcurrently(t, alice, "bob", sendConcurrently(t, bob, "alice", 4, n), done)
+	for range 2 {
+		if received := <-done; received != n {
+			t.Fatalf("Expected %d messages, Actual: %d", n, received)
+		}
+	}
+}
+
+// TestClientConcurrentPeers establishes sessions of many peers with bob at the same time.
+// Every initiator delivers its first messages with the hello from two goroutines, so bob races to establish the session.
+func TestClientConcurrentPeers(t *testing.T) {
+	const peers = 8
+	bobUser, bob := newTestUserClient(t, "bob", peers)
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+
+	n := stressMessages() / peers
+	var wg sync.WaitGroup
+	for i := range peers {
+		name := fmt.Sprintf("alice%d", i)
+		_, alice := newTestUserClient(t, name, 0)
+		handshakeWithDirectory(t, alice, server, "bob")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			messages := sendConcurrently(t, alice, "bob", 2, n)
+			done := make(chan int, 2)
+			go receiveConcurrently(t, bob, name, messages, done)
+			go receiveConcurrently(t, bob, name, messages, done)
+			if received := <-done + <-done; received != n {
+				t.Errorf("%s: expected %d messages, Actual: %d", name, n, received)
+			}
+			reply, err := bob.EncryptMessage(name, []byte("Hello "+name))
+			if err != nil {
+				t.Error("EncryptMessage failed:", err.Error())
+				return
+			}
+			if _, err := alice.DecryptMessage("bob", reply); err != nil {
+				t.Error("DecryptMessage failed:", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(bobUser.OKPs) != 0 {
+		t.Fatal("Every session has to consume exactly one one-time prekey, remaining:", len(bobUser.OKPs))
+	}
+}
@@ -0,0 +1,21 @@
+package x3dh
+
+import "crypto/ecdh"
+
+// KeyDirectory is the prekey directory a client fetches bundles from and publishes its own keys to.
+// Server is the in-memory implementation, HTTPDirectory talks to Server.Handler over HTTP
+// and FileDirectory persists the directory in a JSON file.
+type KeyDirectory interface {
+	// GetKeyBundle returns the bundle of userName with at most one one-time prekey, which is removed from the pool.
+	GetKeyBundle(userName string) (KeyBundleSending, error)
+	// UploadKeyBundle publishes the bundle of userName and replaces a previously published one with the same identity key.
+	UploadKeyBundle(userName string, bundle KeyBundleSending) error
+	// UploadSignedPreKey atomically replaces the published signed prekey of userName with a higher id. signature is
+	// the SPK signature initiators verify, uploadSignature authorizes the upload, see User.SignSignedPreKeyUpload.
+	UploadSignedPreKey(userName string, id uint32, key *ecdh.PublicKey, signature, uploadSignature []byte) error
+	// UploadOneTimePreKeys adds keys to the one-time prekey pool of userName, signature is the signature of the
+	// registered identity key over them, see User.SignOneTimePreKeys.
+	UploadOneTimePreKeys(userName string, keys []PreKey, signature []byte) error
+	// OneTimePreKeyCount returns the number of one-time prekeys left in the pool of userName.
+	OneTimePreKeyCount(userName string) (int, error)
+}
@@ -0,0 +1,232 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileDirectory is a KeyDirectory persisted in a JSON file together with its transparency log.
+// Every change is written to the file before the call returns, handed out one-time prekeys included.
+type FileDirectory struct {
+	mu     sync.Mutex
+	path   string
+	server *Server
+}
+
+// directoryFileJSON is the file format of FileDirectory. Files written before the transparency log
+// only contain the bundles map, their bundles are logged again when they are opened.
+type directoryFileJSON struct {
+	Bundles map[string]KeyBundleSending `json:"bundles"`
+	Log     keyLogJSON                  `json:"log"`
+	// NextOneTimePreKeyIDs keeps the one-time prekeys, which were already handed out, from being uploaded again
+	NextOneTimePreKeyIDs map[string]uint32 `json:"next_one_time_pre_key_ids,omitempty"`
+	// OneTimePreKeysSigned keeps the last accepted upload repeatable after a restart
+	OneTimePreKeysSigned map[string][]byte `json:"one_time_pre_keys_signed,omitempty"`
+}
+
+// keyLogJSON is the file format of the transparency log, including the private log key
+type keyLogJSON struct {
+	Key      []byte         `json:"key"`
+	Entries  []LogEntry     `json:"entries"`
+	TreeHead SignedTreeHead `json:"tree_head"`
+}
+
+// OpenFileDirectory loads the directory stored at path. A missing file is treated as an empty directory.
+func OpenFileDirectory(path string) (*FileDirectory, error) {
+	server, err := NewServer()
+	if err != nil {
+		return nil, err
+	}
+	d := &FileDirectory{
+		path:   path,
+		server: server,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	_, hasBundles := fields["bundles"]
+	_, hasLog := fields["log"]
+	if !hasBundles || !hasLog {
+		var bundles map[string]KeyBundleSending
+		if err := json.Unmarshal(data, &bundles); err != nil {
+			return nil, err
+		}
+		// the bundles were verified by the directory, which wrote the file, they are only logged again
+		for userName, bundle := range bundles {
+			if err := d.server.storeKeyBundle(userName, bundle, storeRestore); err != nil {
+				return nil, err
+			}
+			if err := d.server.log.append(LogEntry{UserName: userName, IdentityKey: bundle.IdentityKey, Timestamp: d.server.now()}); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+
+	var file directoryFileJSON
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(file.Log.Key)
+	if err != nil {
+		return nil, err
+	}
+	if d.server.log, err = restoreKeyLog(key, file.Log.Entries, file.Log.TreeHead); err != nil {
+		return nil, err
+	}
+	for userName, bundle := range file.Bundles {
+		if err := d.server.storeKeyBundle(userName, bundle, storeRestore); err != nil {
+			return nil, err
+		}
+		user := d.server.users[userName]
+		user.nextOneTimePreKeyID = max(user.nextOneTimePreKeyID, file.NextOneTimePreKeyIDs[userName])
+		user.oneTimePreKeysSigned = file.OneTimePreKeysSigned[userName]
+	}
+	return d, nil
+}
+
+func (d *FileDirectory) GetKeyBundle(userName string) (KeyBundleSending, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bundle, err := d.server.GetKeyBundle(userName)
+	if err != nil {
+		return KeyBundleSending{}, err
+	}
+	return bundle, d.save()
+}
+
+func (d *FileDirectory) UploadKeyBundle(userName string, bundle KeyBundleSending) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.server.UploadKeyBundle(userName, bundle); err != nil {
+		return err
+	}
+	return d.save()
+}
+
+func (d *FileDirectory) UploadSignedPreKey(userName string, id uint32, key *ecdh.PublicKey, signature, uploadSignature []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.server.UploadSignedPreKey(userName, id, key, signature, uploadSignature); err != nil {
+		return err
+	}
+	return d.save()
+}
+
+func (d *FileDirectory) UploadOneTimePreKeys(userName string, keys []PreKey, signature []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.server.UploadOneTimePreKeys(userName, keys, signature); err != nil {
+		return err
+	}
+	return d.save()
+}
+
+func (d *FileDirectory) OneTimePreKeyCount(userName string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.server.OneTimePreKeyCount(userName)
+}
+
+func (d *FileDirectory) LogPublicKey() (*ecdh.PublicKey, error) {
+	return d.server.LogPublicKey()
+}
+
+func (d *FileDirectory) TreeHead() (SignedTreeHead, error) {
+	return d.server.TreeHead()
+}
+
+func (d *FileDirectory) InclusionProof(userName string, identityKey *ecdh.PublicKey, treeSize uint64) (InclusionProof, error) {
+	return d.server.InclusionProof(userName, identityKey, treeSize)
+}
+
+func (d *FileDirectory) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	return d.server.ConsistencyProof(first, second)
+}
+
+func (d *FileDirectory) LogEntries(start, end uint64) ([]LogEntry, error) {
+	return d.server.LogEntries(start, end)
+}
+
+// save writes all bundles and the log to a temporary file and renames it, so the file is never left half written
+func (d *FileDirectory) save() error {
+	d.server.mu.Lock()
+	bundles := make(map[string]KeyBundleSending, len(d.server.users))
+	nextIDs := make(map[string]uint32, len(d.server.users))
+	signatures := make(map[string][]byte, len(d.server.users))
+	for userName, user := range d.server.users {
+		nextIDs[userName] = user.nextOneTimePreKeyID
+		if user.oneTimePreKeysSigned != nil {
+			signatures[userName] = user.oneTimePreKeysSigned
+		}
+		bundles[userName] = KeyBundleSending{
+			IdentityKey:        user.identityKey,
+			SignedPreKey:       user.signedPreKey,
+			SignedPreKeySigned: user.signedPreKeySigned,
+			SignedPreKeyID:     user.signedPreKeyID,
+			OneTimePreKeys:     user.oneTimePreKeys,
+			LastResortPreKey:   user.lastResortPreKey,
+			PQPreKey:           user.pqPreKey,
+			Sequence:           user.sequence,
+		}
+	}
+	file := directoryFileJSON{
+		Bundles:              bundles,
+		NextOneTimePreKeyIDs: nextIDs,
+		OneTimePreKeysSigned: signatures,
+		Log: keyLogJSON{
+			Key:      d.server.log.key.Bytes(),
+			Entries:  d.server.log.entries,
+			TreeHead: d.server.log.head,
+		},
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	d.server.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(d.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it, so path is never left half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,173 @@
+package x3dh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HTTPDirectory is a KeyDirectory talking to a Server over the HTTP interface of Server.Handler.
+type HTTPDirectory struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewHTTPDirectory returns a directory for the server at baseURL, e.g. "http://127.0.0.1:8080".
+// If httpClient is nil, http.DefaultClient is used.
+func NewHTTPDirectory(baseURL string, httpClient *http.Client) *HTTPDirectory {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPDirectory{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+func (d *HTTPDirectory) GetKeyBundle(userName string) (KeyBundleSending, error) {
+	var bundle KeyBundleSending
+	err := d.do(http.MethodGet, d.bundleURL(userName), nil, &bundle)
+	return bundle, err
+}
+
+func (d *HTTPDirectory) UploadKeyBundle(userName string, bundle KeyBundleSending) error {
+	return d.do(http.MethodPut, d.bundleURL(userName), bundle, nil)
+}
+
+func (d *HTTPDirectory) UploadSignedPreKey(userName string, id uint32, key *ecdh.PublicKey, signature, uploadSignature []byte) error {
+	body := signedPreKeyJSON{ID: id, Key: publicKeyBytes(key), Signature: signature, UploadSignature: uploadSignature}
+	return d.do(http.MethodPut, d.bundleURL(userName)+"/signed-prekey", body, nil)
+}
+
+func (d *HTTPDirectory) UploadOneTimePreKeys(userName string, keys []PreKey, signature []byte) error {
+	body := oneTimePreKeysJSON{OneTimePreKeys: preKeysJSON(keys), Signature: signature}
+	return d.do(http.MethodPost, d.bundleURL(userName)+"/one-time-prekeys", body, nil)
+}
+
+func (d *HTTPDirectory) OneTimePreKeyCount(userName string) (int, error) {
+	var count oneTimePreKeyCountJSON
+	err := d.do(http.MethodGet, d.bundleURL(userName)+"/one-time-prekeys/count", nil, &count)
+	return count.Count, err
+}
+
+func (d *HTTPDirectory) LogPublicKey() (*ecdh.PublicKey, error) {
+	var key logKeyJSON
+	if err := d.do(http.MethodGet, d.baseURL+"/log/key", nil, &key); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(key.Key)
+}
+
+func (d *HTTPDirectory) TreeHead() (SignedTreeHead, error) {
+	var head SignedTreeHead
+	err := d.do(http.MethodGet, d.baseURL+"/log/tree-head", nil, &head)
+	return head, err
+}
+
+func (d *HTTPDirectory) InclusionProof(userName string, identityKey *ecdh.PublicKey, treeSize uint64) (InclusionProof, error) {
+	query := url.Values{
+		"key":       {hex.EncodeToString(publicKeyBytes(identityKey))},
+		"tree_size": {strconv.FormatUint(treeSize, 10)},
+	}
+	var proof InclusionProof
+	err := d.do(http.MethodGet, d.baseURL+"/log/inclusion/"+url.PathEscape(userName)+"?"+query.Encode(), nil, &proof)
+	return proof, err
+}
+
+func (d *HTTPDirectory) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	query := url.Values{"first": {strconv.FormatUint(first, 10)}, "second": {strconv.FormatUint(second, 10)}}
+	var proof consistencyProofJSON
+	err := d.do(http.MethodGet, d.baseURL+"/log/consistency?"+query.Encode(), nil, &proof)
+	return proof.Hashes, err
+}
+
+func (d *HTTPDirectory) LogEntries(start, end uint64) ([]LogEntry, error) {
+	query := url.Values{"start": {strconv.FormatUint(start, 10)}, "end": {strconv.FormatUint(end, 10)}}
+	var entries logEntriesJSON
+	err := d.do(http.MethodGet, d.baseURL+"/log/entries?"+query.Encode(), nil, &entries)
+	return entries.Entries, err
+}
+
+func (d *HTTPDirectory) bundleURL(userName string) string {
+	return d.baseURL + "/bundles/" + url.PathEscape(userName)
+}
+
+// do sends in as JSON body and decodes the JSON response into out, both may be nil.
+// Error responses are mapped back to the errors of Server, so errors.Is works across the transport.
+func (d *HTTPDirectory) do(method, url string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// httpError is an error response of Server. It wraps the errors named in the response, so the callers see the same
+// errors as with a Server.
+type httpError struct {
+	msg   string
+	kinds []error
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func (e *httpError) Unwrap() []error {
+	return e.kinds
+}
+
+// responseError maps the error response resp back to the errors of Server
+func responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var out errorJSON
+	if err := json.Unmarshal(msg, &out); err != nil || out.Error == "" {
+		return fmt.Errorf("prekey server responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	e := &httpError{msg: out.Error}
+	for _, name := range out.Kinds {
+		for _, kind := range errorKinds {
+			if kind.name == name {
+				e.kinds = append(e.kinds, kind.err)
+			}
+		}
+	}
+	if len(e.kinds) == 0 {
+		e.msg = fmt.Sprintf("prekey server responded with %s: %s", resp.Status, out.Error)
+	}
+	return e
+}
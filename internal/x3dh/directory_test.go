@@ -0,0 +1,369 @@
+package x3dh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"signal/internal/doubleratchet"
+	"testing"
+)
+
+func generatePreKeys(t *testing.T, n int) []PreKey {
+	var keys []PreKey
+	for i := range n {
+		key, err := doubleratchet.GenerateDH()
+		if err != nil {
+			t.Fatal("GenerateDH failed:", err.Error())
+		}
+		keys = append(keys, PreKey{ID: uint32(1000 + i), Key: key.PublicKey()})
+	}
+	return keys
+}
+
+func TestKeyDirectoryImplementations(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bob, err := NewUser("bob", 2)
+			if err != nil {
+				t.Fatal("NewUser failed:", err.Error())
+			}
+
+			if _, err := directory.GetKeyBundle("bob"); !errors.Is(err, ErrUnknownPeer) {
+				t.Fatal("expected unknown user error, got:", err)
+			}
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bob)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			count, err := directory.OneTimePreKeyCount("bob")
+			if err != nil {
+				t.Fatal("OneTimePreKeyCount failed:", err.Error())
+			}
+			if count != 2 {
+				t.Fatal("expected 2 one-time prekeys, got:", count)
+			}
+
+			preKeys, err := bob.GenerateOneTimePreKeys(3)
+			if err != nil {
+				t.Fatal("GenerateOneTimePreKeys failed:", err.Error())
+			}
+			signature, err := bob.SignOneTimePreKeys(preKeys)
+			if err != nil {
+				t.Fatal("SignOneTimePreKeys failed:", err.Error())
+			}
+			if err := directory.UploadOneTimePreKeys("bob", preKeys, signature); err != nil {
+				t.Fatal("UploadOneTimePreKeys failed:", err.Error())
+			}
+
+			bundle, err := directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			if !bundle.IdentityKey.Equal(bob.IdentityKey.PublicKey()) || len(bundle.OneTimePreKeys) != 1 {
+				t.Fatal("unexpected bundle")
+			}
+
+			count, err = directory.OneTimePreKeyCount("bob")
+			if err != nil {
+				t.Fatal("OneTimePreKeyCount failed:", err.Error())
+			}
+			if count != 4 {
+				t.Fatal("expected 4 one-time prekeys, got:", count)
+			}
+
+			tampered := publishTestBundle(t, bob)
+			tampered.SignedPreKeySigned = bytes.Clone(tampered.SignedPreKeySigned)
+			tampered.SignedPreKeySigned[0] ^= 0xff
+			if err := directory.UploadKeyBundle("bob", tampered); !errors.Is(err, ErrInvalidBundle) {
+				t.Fatal("expected invalid bundle error, got:", err)
+			}
+		})
+	}
+}
+
+func TestKeyDirectoryAuthenticatesUploads(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bob, err := NewUser("bob", 1)
+			if err != nil {
+				t.Fatal("NewUser failed:", err.Error())
+			}
+			mallory, err := NewUser("mallory", 1)
+			if err != nil {
+				t.Fatal("NewUser failed:", err.Error())
+			}
+			impostor, err := NewUser("bob", 1)
+			if err != nil {
+				t.Fatal("NewUser failed:", err.Error())
+			}
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bob)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			// nobody takes over the name of a registered user, the owner may register again
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, impostor)); !errors.Is(err, ErrNameTaken) {
+				t.Fatal("Expected ErrNameTaken, Actual:", err)
+			}
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bob)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			preKeys := generatePreKeys(t, 2)
+			forged, err := mallory.SignOneTimePreKeys(preKeys)
+			if err != nil {
+				t.Fatal("SignOneTimePreKeys failed:", err.Error())
+			}
+			if err := directory.UploadOneTimePreKeys("bob", preKeys, forged); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatal("Expected ErrInvalidSignature, Actual:", err)
+			}
+
+			signature, err := bob.SignOneTimePreKeys(preKeys)
+			if err != nil {
+				t.Fatal("SignOneTimePreKeys failed:", err.Error())
+			}
+			if err := directory.UploadOneTimePreKeys("bob", preKeys, signature); err != nil {
+				t.Fatal("UploadOneTimePreKeys failed:", err.Error())
+			}
+			// the repeated upload after a lost response succeeds without adding the keys again
+			if err := directory.UploadOneTimePreKeys("bob", preKeys, signature); err != nil {
+				t.Fatal("UploadOneTimePreKeys failed:", err.Error())
+			}
+
+			next := []PreKey{{ID: preKeys[1].ID + 1, Key: generatePreKeys(t, 1)[0].Key}}
+			nextSignature, err := bob.SignOneTimePreKeys(next)
+			if err != nil {
+				t.Fatal("SignOneTimePreKeys failed:", err.Error())
+			}
+			if err := directory.UploadOneTimePreKeys("bob", next, nextSignature); err != nil {
+				t.Fatal("UploadOneTimePreKeys failed:", err.Error())
+			}
+			if err := directory.UploadOneTimePreKeys("bob", preKeys, signature); !errors.Is(err, ErrInvalidBundle) {
+				t.Fatal("Expected ErrInvalidBundle for a replayed upload, Actual:", err)
+			}
+			count, err := directory.OneTimePreKeyCount("bob")
+			if err != nil {
+				t.Fatal("OneTimePreKeyCount failed:", err.Error())
+			}
+			if count != 4 {
+				t.Fatal("expected 4 one-time prekeys, got:", count)
+			}
+		})
+	}
+}
+
+func TestKeyDirectoryRejectsBundleOfPublicData(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bob, err := NewUser("bob", 2)
+			if err != nil {
+				t.Fatal("NewUser failed:", err.Error())
+			}
+			captured := publishTestBundle(t, bob)
+			if err := directory.UploadKeyBundle("bob", captured); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			// everything but the bundle signature can be fetched from the directory
+			public, err := directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			lastResort, err := doubleratchet.GenerateDH()
+			if err != nil {
+				t.Fatal("GenerateDH failed:", err.Error())
+			}
+			forged := KeyBundleSending{
+				IdentityKey:        public.IdentityKey,
+				SignedPreKey:       public.SignedPreKey,
+				SignedPreKeySigned: public.SignedPreKeySigned,
+				SignedPreKeyID:     999,
+				LastResortPreKey:   lastResort.PublicKey(),
+				Sequence:           captured.Sequence + 1,
+				Signature:          captured.Signature,
+			}
+			if err := directory.UploadKeyBundle("bob", forged); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatal("Expected ErrInvalidSignature, Actual:", err)
+			}
+			if err := directory.UploadKeyBundle("bob", captured); !errors.Is(err, ErrInvalidBundle) {
+				t.Fatal("Expected ErrInvalidBundle for a replayed bundle, Actual:", err)
+			}
+
+			bundle, err := directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			if bundle.SignedPreKeyID != bob.SignedPreKeyID || len(bundle.OneTimePreKeys) != 1 || bundle.PQPreKey == nil {
+				t.Fatal("rejected uploads must not change the published bundle")
+			}
+		})
+	}
+}
+
+func TestRepublicationIsNotLogged(t *testing.T) {
+	bobUser, server := publishTestUser(t, "bob")
+	head, err := server.TreeHead()
+	if err != nil {
+		t.Fatal("TreeHead failed:", err.Error())
+	}
+	if err := server.UploadKeyBundle("bob", publishTestBundle(t, bobUser)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+	republished, err := server.TreeHead()
+	if err != nil {
+		t.Fatal("TreeHead failed:", err.Error())
+	}
+	if republished.Size != head.Size {
+		t.Fatal("a new bundle with the logged identity key must not be logged again")
+	}
+}
+
+func TestFileDirectoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "directory.json")
+	directory, err := OpenFileDirectory(path)
+	if err != nil {
+		t.Fatal("OpenFileDirectory failed:", err.Error())
+	}
+
+	bob, err := NewUser("bob", 2)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bob)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+	first, err := directory.GetKeyBundle("bob")
+	if err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+
+	reopened, err := OpenFileDirectory(path)
+	if err != nil {
+		t.Fatal("OpenFileDirectory failed:", err.Error())
+	}
+	second, err := reopened.GetKeyBundle("bob")
+	if err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if len(second.OneTimePreKeys) != 1 || second.OneTimePreKeys[0].ID == first.OneTimePreKeys[0].ID {
+		t.Fatal("handed out one-time prekey has to stay removed after reopening")
+	}
+	if !second.SignedPreKey.Equal(bob.SignedPreKey.PublicKey()) {
+		t.Fatal("signed prekey was not persisted")
+	}
+
+	// uploads, whose keys were handed out already, do not add them again after reopening either
+	preKeys := generatePreKeys(t, 1)
+	signature, err := bob.SignOneTimePreKeys(preKeys)
+	if err != nil {
+		t.Fatal("SignOneTimePreKeys failed:", err.Error())
+	}
+	if err := reopened.UploadOneTimePreKeys("bob", preKeys, signature); err != nil {
+		t.Fatal("UploadOneTimePreKeys failed:", err.Error())
+	}
+	if _, err := reopened.GetKeyBundle("bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	reopened, err = OpenFileDirectory(path)
+	if err != nil {
+		t.Fatal("OpenFileDirectory failed:", err.Error())
+	}
+	if err := reopened.UploadOneTimePreKeys("bob", preKeys, signature); err != nil {
+		t.Fatal("UploadOneTimePreKeys failed:", err.Error())
+	}
+	count, err := reopened.OneTimePreKeyCount("bob")
+	if err != nil {
+		t.Fatal("OneTimePreKeyCount failed:", err.Error())
+	}
+	if count != 0 {
+		t.Fatal("repeated upload must not add the handed out one-time prekey again, count:", count)
+	}
+}
+
+func TestClientWithFaultyDirectory(t *testing.T) {
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+
+	t.Run("tampered signature", func(t *testing.T) {
+		_, alice := newTestUserClient(t, "alice", 0)
+		directory := &faultyDirectory{KeyDirectory: server, tamper: func(bundle *KeyBundleSending) {
+			bundle.SignedPreKeySigned = bytes.Clone(bundle.SignedPreKeySigned)
+			bundle.SignedPreKeySigned[10] ^= 0x01
+		}}
+		if err := alice.InitialHandshake(directory, "bob"); err != nil {
+			t.Fatal("InitialHandshake failed:", err.Error())
+		}
+		if err := alice.GenerateSendSecretKey("bob"); err == nil {
+			t.Fatal("tampered signed prekey signature has to be rejected")
+		}
+	})
+
+	t.Run("exhausted pool without last-resort prekey", func(t *testing.T) {
+		_, alice := newTestUserClient(t, "alice", 0)
+		directory := &faultyDirectory{KeyDirectory: server, tamper: func(bundle *KeyBundleSending) {
+			bundle.OneTimePreKeys = nil
+			bundle.LastResortPreKey = nil
+		}}
+		hello := handshakeWithDirectory(t, alice, directory, "bob")
+		if hello.PreKeyType != PreKeyNone {
+			t.Fatal("expected a 3-DH handshake")
+		}
+
+		msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+		decryptTestMessage(t, bob, "alice", msg, "Hello Bob")
+	})
+
+	if len(bobUser.OKPs) != 1 {
+		t.Fatal("no hello was sent, so the one-time prekey has to stay")
+	}
+}
+
+func TestLastResortPreKey(t *testing.T) {
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+
+	expected := []PreKeyType{PreKeyOneTime, PreKeyLastResort, PreKeyLastResort}
+	for i, preKeyType := range expected {
+		name := fmt.Sprintf("alice%d", i)
+		_, alice := newTestUserClient(t, name, 0)
+
+		hello := handshakeWithDirectory(t, alice, server, "bob")
+		if hello.PreKeyType != preKeyType {
+			t.Fatalf("handshake %d: expected prekey type %d, got %d", i, preKeyType, hello.PreKeyType)
+		}
+
+		msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+		decryptTestMessage(t, bob, name, msg, "Hello Bob")
+	}
+
+	if len(bobUser.OKPs) != 0 {
+		t.Fatal("one-time prekey has to be consumed")
+	}
+	if bobUser.LastResortPreKey == nil {
+		t.Fatal("last-resort prekey must never be deleted")
+	}
+}
+
+func TestPreKeyTypeIsAuthenticated(t *testing.T) {
+	bobUser, _ := newTestUserClient(t, "bob", 1)
+	_, alice := newTestUserClient(t, "alice", 0)
+	server := newTestServer(t)
+	if err := server.UploadKeyBundle("bob", publishTestBundle(t, bobUser)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+
+	hello := handshakeWithDirectory(t, alice, server, "bob")
+	hello.PreKeyType = PreKeyLastResort
+	if _, _, err := bobUser.ProcessX3DHHello(hello); err == nil {
+		t.Fatal("hello with a changed prekey type must not be accepted")
+	}
+	if len(bobUser.OKPs) != 1 {
+		t.Fatal("one-time prekey must not be deleted by a failed hello")
+	}
+}
@@ -0,0 +1,396 @@
+package x3dh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"signal/internal/doubleratchet"
+	"time"
+)
+
+// CurveX25519 is the curve type of Encode(PK) for X25519 public keys, the same byte libsignal uses
+const CurveX25519 byte = 0x05
+
+// EncodePublicKey is Encode(PK) of the X3DH specification: a byte for the curve type followed by the little-endian u-coordinate.
+func EncodePublicKey(key *ecdh.PublicKey) []byte {
+	return append([]byte{CurveX25519}, key.Bytes()...)
+}
+
+// associatedData returns AD = Encode(IK_A) || Encode(IK_B). It is the associated data of the initial ciphertext
+// and of every Double Ratchet message of the session.
+func associatedData(initiatorIdentityKey, responderIdentityKey *ecdh.PublicKey) []byte {
+	return append(EncodePublicKey(initiatorIdentityKey), EncodePublicKey(responderIdentityKey)...)
+}
+
+// MarshalBinary encodes the envelope as from || to || message, every field prefixed with its length as unsigned varint.
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	var b []byte
+	for _, field := range []string{e.From, e.To, e.Message} {
+		b = binary.AppendUvarint(b, uint64(len(field)))
+		b = append(b, field...)
+	}
+	return b, nil
+}
+
+func (e *Envelope) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var decoded Envelope
+	for _, field := range []*string{&decoded.From, &decoded.To, &decoded.Message} {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return fmt.Errorf("%w: truncated envelope", ErrInvalidMessage)
+		}
+		v := make([]byte, n)
+		if _, err := io.ReadFull(r, v); err != nil {
+			return err
+		}
+		*field = string(v)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes in envelope", ErrInvalidMessage, r.Len())
+	}
+	*e = decoded
+	return nil
+}
+
+// keyBundleJSON is the wire format of KeyBundleSending, public keys are encoded as raw X25519 bytes
+type keyBundleJSON struct {
+	IdentityKey        []byte        `json:"identity_key"`
+	SignedPreKey       []byte        `json:"signed_pre_key"`
+	SignedPreKeySigned []byte        `json:"signed_pre_key_signed"`
+	SignedPreKeyID     uint32        `json:"signed_pre_key_id"`
+	OneTimePreKeys     []preKeyJSON  `json:"one_time_pre_keys,omitempty"`
+	LastResortPreKey   []byte        `json:"last_resort_pre_key,omitempty"`
+	PQPreKey           *pqPreKeyJSON `json:"pq_pre_key,omitempty"`
+	Sequence           uint64        `json:"sequence,omitempty"`
+	Signature          []byte        `json:"signature,omitempty"`
+}
+
+// pqPreKeyJSON is the wire format of PQPreKey, the key is encoded with its KEM type
+type pqPreKeyJSON struct {
+	ID        uint32 `json:"id"`
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+// preKeyJSON is the wire format of PreKey
+type preKeyJSON struct {
+	ID  uint32 `json:"id"`
+	Key []byte `json:"key"`
+}
+
+func (b KeyBundleSending) MarshalJSON() ([]byte, error) {
+	out := keyBundleJSON{
+		IdentityKey:        publicKeyBytes(b.IdentityKey),
+		SignedPreKey:       publicKeyBytes(b.SignedPreKey),
+		SignedPreKeySigned: b.SignedPreKeySigned,
+		SignedPreKeyID:     b.SignedPreKeyID,
+		LastResortPreKey:   publicKeyBytes(b.LastResortPreKey),
+		Sequence:           b.Sequence,
+		Signature:          b.Signature,
+	}
+	out.OneTimePreKeys = preKeysJSON(b.OneTimePreKeys)
+	if b.PQPreKey != nil {
+		out.PQPreKey = &pqPreKeyJSON{
+			ID:        b.PQPreKey.ID,
+			Key:       encodeKEMPublicKey(b.PQPreKey.Key),
+			Signature: b.PQPreKey.Signature,
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (b *KeyBundleSending) UnmarshalJSON(data []byte) error {
+	var in keyBundleJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	var err error
+	b.IdentityKey, err = parsePublicKey(in.IdentityKey)
+	if err != nil {
+		return err
+	}
+	b.SignedPreKey, err = parsePublicKey(in.SignedPreKey)
+	if err != nil {
+		return err
+	}
+	b.SignedPreKeySigned = in.SignedPreKeySigned
+	b.SignedPreKeyID = in.SignedPreKeyID
+	b.Sequence = in.Sequence
+	b.Signature = in.Signature
+	b.LastResortPreKey, err = parsePublicKey(in.LastResortPreKey)
+	if err != nil {
+		return err
+	}
+	b.OneTimePreKeys, err = parsePreKeys(in.OneTimePreKeys)
+	if err != nil {
+		return err
+	}
+	b.PQPreKey = nil
+	if in.PQPreKey != nil {
+		key, err := parseKEMPublicKey(in.PQPreKey.Key)
+		if err != nil {
+			return err
+		}
+		b.PQPreKey = &PQPreKey{
+			ID:        in.PQPreKey.ID,
+			Key:       key,
+			Signature: in.PQPreKey.Signature,
+		}
+	}
+	return nil
+}
+
+// logEntryJSON is the wire format of LogEntry
+type logEntryJSON struct {
+	UserName    string    `json:"user_name"`
+	IdentityKey []byte    `json:"identity_key"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func (e LogEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(logEntryJSON{
+		UserName:    e.UserName,
+		IdentityKey: publicKeyBytes(e.IdentityKey),
+		Timestamp:   e.Timestamp,
+	})
+}
+
+func (e *LogEntry) UnmarshalJSON(data []byte) error {
+	var in logEntryJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	key, err := parsePublicKey(in.IdentityKey)
+	if err != nil {
+		return err
+	}
+	*e = LogEntry{UserName: in.UserName, IdentityKey: key, Timestamp: in.Timestamp}
+	return nil
+}
+
+func publicKeyBytes(key *ecdh.PublicKey) []byte {
+	if key == nil {
+		return nil
+	}
+	return key.Bytes()
+}
+
+// parsePublicKey returns nil for empty input, so missing keys survive a round trip
+func parsePublicKey(data []byte) (*ecdh.PublicKey, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+func privateKeyBytes(key *ecdh.PrivateKey) []byte {
+	if key == nil {
+		return nil
+	}
+	return key.Bytes()
+}
+
+// parsePrivateKey returns nil for empty input, so missing keys survive a round trip
+func parsePrivateKey(data []byte) (*ecdh.PrivateKey, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return ecdh.X25519().NewPrivateKey(data)
+}
+
+func preKeysJSON(keys []PreKey) []preKeyJSON {
+	var out []preKeyJSON
+	for _, key := range keys {
+		out = append(out, preKeyJSON{ID: key.ID, Key: key.Key.Bytes()})
+	}
+	return out
+}
+
+func parsePreKeys(data []preKeyJSON) ([]PreKey, error) {
+	var keys []PreKey
+	for _, d := range data {
+		key, err := ecdh.X25519().NewPublicKey(d.Key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, PreKey{ID: d.ID, Key: key})
+	}
+	return keys, nil
+}
+
+// sessionRecordVersion is the first byte of an encoded Session, it is incremented when the format changes
+const sessionRecordVersion byte = 1
+
+// MarshalBinary encodes the initial message as IK_A || EK_A || SPK id || prekey type || OPK id || PQ prekey id ||
+// PQ ciphertext || nonce || ciphertext. The keys are raw X25519 bytes, IDs are unsigned varints and all byte strings
+// are prefixed with their length as unsigned varint.
+func (m *InitialMessage) MarshalBinary() ([]byte, error) {
+	if m.IdentityKey == nil || m.EphemeralKey == nil {
+		return nil, fmt.Errorf("%w: incomplete initial message", ErrInvalidMessage)
+	}
+	b := appendField(nil, m.IdentityKey.Bytes())
+	b = appendField(b, m.EphemeralKey.Bytes())
+	b = binary.AppendUvarint(b, uint64(m.SignedPreKeyID))
+	b = append(b, byte(m.PreKeyType))
+	b = binary.AppendUvarint(b, uint64(m.OneTimePreKeyID))
+	b = binary.AppendUvarint(b, uint64(m.PQPreKeyID))
+	b = appendField(b, m.PQCiphertext)
+	b = appendField(b, m.Nonce)
+	b = appendField(b, m.Ciphertext)
+	return b, nil
+}
+
+func (m *InitialMessage) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var decoded InitialMessage
+	identityKey, err := readField(r)
+	if err != nil {
+		return err
+	}
+	ephemeralKey, err := readField(r)
+	if err != nil {
+		return err
+	}
+	if decoded.IdentityKey, err = ecdh.X25519().NewPublicKey(identityKey); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	if decoded.EphemeralKey, err = ecdh.X25519().NewPublicKey(ephemeralKey); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	if decoded.SignedPreKeyID, err = readUint32(r); err != nil {
+		return err
+	}
+	preKeyType, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: truncated initial message", ErrInvalidMessage)
+	}
+	decoded.PreKeyType = PreKeyType(preKeyType)
+	if decoded.OneTimePreKeyID, err = readUint32(r); err != nil {
+		return err
+	}
+	if decoded.PQPreKeyID, err = readUint32(r); err != nil {
+		return err
+	}
+	for _, field := range []*[]byte{&decoded.PQCiphertext, &decoded.Nonce, &decoded.Ciphertext} {
+		if *field, err = readField(r); err != nil {
+			return err
+		}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes in initial message", ErrInvalidMessage, r.Len())
+	}
+	*m = decoded
+	return nil
+}
+
+// MarshalBinary encodes the session for a SessionStore as version || peer name || AD || Double Ratchet state ||
+// pending hello, the hello is empty once the peer replied. It must not be called while the session is in use.
+func (s *Session) MarshalBinary() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.marshal()
+}
+
+// marshal is MarshalBinary with s.mu held
+func (s *Session) marshal() ([]byte, error) {
+	state, err := s.State.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return s.record(state, s.pendingHello)
+}
+
+// record encodes the session with the encoded Double Ratchet state and the pending hello, s.mu has to be held
+func (s *Session) record(state []byte, pendingHello *InitialMessage) ([]byte, error) {
+	var hello []byte
+	if pendingHello != nil {
+		var err error
+		if hello, err = pendingHello.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	b := appendField([]byte{sessionRecordVersion}, []byte(s.PeerName))
+	b = appendField(b, s.AssociatedData)
+	b = appendField(b, state)
+	b = appendField(b, hello)
+	return b, nil
+}
+
+// UnmarshalBinary restores an encoded session. Like doubleratchet.State.UnmarshalBinary it keeps the entropy source,
+// clock and skipped key store of s.State, if set.
+func (s *Session) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != sessionRecordVersion {
+		return fmt.Errorf("%w: unknown session record version", ErrInvalidMessage)
+	}
+	r := bytes.NewReader(data[1:])
+	var fields [4][]byte
+	for i := range fields {
+		field, err := readField(r)
+		if err != nil {
+			return err
+		}
+		fields[i] = field
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes in session record", ErrInvalidMessage, r.Len())
+	}
+
+	state := s.State
+	if state == nil {
+		state = &doubleratchet.State{}
+	}
+	if err := state.UnmarshalBinary(fields[2]); err != nil {
+		return err
+	}
+	var hello *InitialMessage
+	if len(fields[3]) != 0 {
+		hello = &InitialMessage{}
+		if err := hello.UnmarshalBinary(fields[3]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PeerName = string(fields[0])
+	s.AssociatedData = fields[1]
+	s.State = state
+	s.pendingHello = hello
+	return nil
+}
+
+// appendField appends data prefixed with its length as unsigned varint
+func appendField(b []byte, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// readField reads a field written by appendField, empty fields are returned as nil
+func readField(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: truncated field", ErrInvalidMessage)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+func readUint32(r *bytes.Reader) (uint32, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil || v > math.MaxUint32 {
+		return 0, fmt.Errorf("%w: invalid ID", ErrInvalidMessage)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,58 @@
+package x3dh
+
+import (
+	"errors"
+	"signal/internal/doubleratchet"
+)
+
+// Errors of the handshake, the prekey directory and the sessions. They are wrapped, so callers can tell the failures
+// apart with errors.Is, the errors of the Double Ratchet (e.g. doubleratchet.MaxSkipError) are passed through unchanged.
+var (
+	// ErrUnknownPeer is returned for a user, who is not registered at the directory, or for whom the client has
+	// neither a key bundle nor a session.
+	ErrUnknownPeer = errors.New("unknown peer")
+	// ErrInvalidBundle is returned by the directory for key bundles and prekeys which are incomplete or not signed by
+	// the identity key.
+	ErrInvalidBundle = errors.New("invalid key bundle")
+	// ErrNameTaken is returned by the directory for a registration of a user name, which is registered with
+	// another identity key.
+	ErrNameTaken = errors.New("user name registered with another identity key")
+	// ErrInvalidSignature is returned if a signed prekey, a PQ prekey or an upload of one-time prekeys does not verify
+	// under the identity key of its owner.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrBundleExhausted is returned if an initial message references a prekey, which has already been consumed,
+	// has expired or was never published.
+	ErrBundleExhausted = errors.New("prekey bundle exhausted")
+	// ErrInvalidMessage is returned for initial messages and messages which are incomplete or malformed.
+	ErrInvalidMessage = errors.New("invalid message")
+	// ErrNoUser is returned by operations which need the private keys of a client created without a User.
+	ErrNoUser = errors.New("client has no user")
+	// ErrNoEphemeralKey is returned by GenerateSendSecretKey, if no ephemeral key was generated by InitialHandshake.
+	ErrNoEphemeralKey = errors.New("no ephemeral key")
+	// ErrNoSecretKey is returned by BuildX3DHHello and StartSession, if GenerateSendSecretKey has not been called.
+	ErrNoSecretKey = errors.New("secret key not generated")
+	// ErrStoreInUse is returned by NewUserWithStore for a store, which already holds the identity of a user.
+	ErrStoreInUse = errors.New("store in use")
+	// ErrIdentityChanged is wrapped by IdentityChanged, if a contact uses another identity key than the recorded one.
+	ErrIdentityChanged = errors.New("identity key changed")
+	// ErrNoIdentityChange is returned by AcknowledgeIdentityChange, if the identity key of the contact has not changed.
+	ErrNoIdentityChange = errors.New("identity key has not changed")
+	// ErrIdentityMismatch is returned by VerifyIdentity, if the compared key is not the recorded identity key of the contact.
+	ErrIdentityMismatch = errors.New("identity key does not match the recorded one")
+	// ErrTransparency is returned if the key transparency log of the directory can not prove a fetched identity key
+	// or its tree heads are not signed or not consistent with the ones seen before.
+	ErrTransparency = errors.New("key transparency verification failed")
+	// ErrUnauthorizedPublication is wrapped by UnauthorizedPublication, if the log contains foreign keys for the client.
+	ErrUnauthorizedPublication = errors.New("unauthorized identity key publication")
+	// ErrInvalidTreeSize is returned by the log for proofs and entries beyond the current tree.
+	ErrInvalidTreeSize = errors.New("invalid tree size")
+
+	// ErrAuthentication is returned if an initial message or a message does not authenticate.
+	ErrAuthentication = doubleratchet.ErrAuthentication
+	// ErrDuplicateMessage is returned for a message which has already been decrypted.
+	ErrDuplicateMessage = doubleratchet.ErrDuplicateMessage
+	// ErrMessageKeyExpired is returned for a late message, whose skipped message key has already been purged.
+	ErrMessageKeyExpired = doubleratchet.ErrMessageKeyExpired
+	// ErrInvalidKey is returned for keys of the wrong size, e.g. the key of an EncryptedFileStore.
+	ErrInvalidKey = doubleratchet.ErrInvalidKey
+)
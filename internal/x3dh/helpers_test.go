@@ -0,0 +1,191 @@
+package x3dh
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"signal/internal/doubleratchet"
+	"testing"
+	"time"
+)
+
+// newTestUserClient returns a new user and a client, which acts for it
+func newTestUserClient(t *testing.T, name string, opkNum int) (*User, *Client) {
+	user, err := NewUser(name, opkNum)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	return user, NewClientFromUser(user)
+}
+
+// newTestClient returns a client with the identity key of a new user, but without its prekeys
+func newTestClient(t *testing.T, name string) *Client {
+	user, _ := newTestUserClient(t, name, 0)
+	client := NewClient()
+	client.UserName = name
+	client.IdentityKey = user.IdentityKey
+	return client
+}
+
+// fakeClock replaces the clock of a user, so rotation and grace period can be tested
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// newTestUserWithClock is newTestUserClient for a user, whose clock is controlled by the test
+func newTestUserWithClock(t *testing.T, name string, opkNum int) (*User, *Client, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	user, client := newTestUserClient(t, name, opkNum)
+	user.now = clock.Now
+	user.SignedPreKeyAt = clock.now
+	return user, client, clock
+}
+
+// publishTestBundle returns the next signed bundle of user
+func publishTestBundle(t *testing.T, user *User) KeyBundleSending {
+	t.Helper()
+	bundle, err := user.Publish()
+	if err != nil {
+		t.Fatal("Publish failed:", err.Error())
+	}
+	return bundle
+}
+
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal("NewServer failed:", err.Error())
+	}
+	return server
+}
+
+// publishTestUser publishes the bundle of a new user name at a new server
+func publishTestUser(t *testing.T, name string) (*User, *Server) {
+	user, client := newTestUserClient(t, name, 1)
+	server := newTestServer(t)
+	if err := client.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	return user, server
+}
+
+// newTestDirectories returns an empty directory of every KeyDirectory implementation
+func newTestDirectories(t *testing.T) map[string]KeyDirectory {
+	httpServer := httptest.NewServer(newTestServer(t).Handler())
+	t.Cleanup(httpServer.Close)
+
+	fileDirectory, err := OpenFileDirectory(filepath.Join(t.TempDir(), "directory.json"))
+	if err != nil {
+		t.Fatal("OpenFileDirectory failed:", err.Error())
+	}
+
+	return map[string]KeyDirectory{
+		"memory": newTestServer(t),
+		"http":   NewHTTPDirectory(httpServer.URL, nil),
+		"file":   fileDirectory,
+	}
+}
+
+// faultyDirectory wraps a KeyDirectory and lets tests tamper with the fetched bundles
+type faultyDirectory struct {
+	KeyDirectory
+	tamper func(bundle *KeyBundleSending)
+}
+
+func (d *faultyDirectory) GetKeyBundle(userName string) (KeyBundleSending, error) {
+	bundle, err := d.KeyDirectory.GetKeyBundle(userName)
+	if err != nil {
+		return bundle, err
+	}
+	d.tamper(&bundle)
+	return bundle, nil
+}
+
+// prepareHandshake hands the bundle of bob to client without a directory and generates the ephemeral key
+func prepareHandshake(t *testing.T, client *Client, bob *User) {
+	client.setKeyBundle(bob.name, publishTestBundle(t, bob))
+
+	ek, err := doubleratchet.GenerateDH()
+	if err != nil {
+		t.Fatal("GenerateDH failed:", err.Error())
+	}
+	client.keyBundles[bob.name].EphemeralKey = ek
+}
+
+// handshakeWithDirectory runs the handshake of alice with userName against directory and returns the hello
+func handshakeWithDirectory(t *testing.T, alice *Client, directory KeyDirectory, userName string) *InitialMessage {
+	t.Helper()
+	if err := alice.InitialHandshake(directory, userName); err != nil {
+		t.Fatal("InitialHandshake failed:", err.Error())
+	}
+	if err := alice.GenerateSendSecretKey(userName); err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+	hello, err := alice.BuildX3DHHello(userName, "Hello "+userName)
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+	if _, err := alice.StartSession(userName, hello); err != nil {
+		t.Fatal("StartSession failed:", err.Error())
+	}
+	return hello
+}
+
+// startTestSession starts the session of alice with bobUser without a directory
+func startTestSession(t *testing.T, alice *Client, bobUser *User) *Session {
+	prepareHandshake(t, alice, bobUser)
+
+	if err := alice.GenerateSendSecretKey(bobUser.name); err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+	hello, err := alice.BuildX3DHHello(bobUser.name, "Hello Bob")
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+	session, err := alice.StartSession(bobUser.name, hello)
+	if err != nil {
+		t.Fatal("StartSession failed:", err.Error())
+	}
+	return session
+}
+
+func encryptTestMessage(t *testing.T, c *Client, to, plaintext string) *Message {
+	msg, err := c.EncryptMessage(to, []byte(plaintext))
+	if err != nil {
+		t.Fatal("EncryptMessage failed:", err.Error())
+	}
+	return msg
+}
+
+func decryptTestMessage(t *testing.T, c *Client, from string, msg *Message, plaintext string) {
+	t.Helper()
+	decrypted, err := c.DecryptMessage(from, msg)
+	if err != nil {
+		t.Fatal("DecryptMessage failed:", err.Error())
+	}
+	if !bytes.Equal(decrypted, []byte(plaintext)) {
+		t.Fatal("Did not receive the correct plaintext")
+	}
+}
+
+// openTestStore opens the EncryptedFileStore at path
+func openTestStore(t *testing.T, path string, key []byte) *EncryptedFileStore {
+	store, err := OpenEncryptedFileStore(path, key)
+	if err != nil {
+		t.Fatal("OpenEncryptedFileStore failed:", err.Error())
+	}
+	return store
+}
+
+// restartTestUser reopens the store at path and restores the user and a new client from it
+func restartTestUser(t *testing.T, path string, key []byte) (*User, *Client) {
+	user, err := LoadUser(openTestStore(t, path, key))
+	if err != nil {
+		t.Fatal("LoadUser failed:", err.Error())
+	}
+	return user, NewClientFromUser(user)
+}
@@ -0,0 +1,88 @@
+package x3dh
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"signal/internal/testutil"
+	"strings"
+	"testing"
+)
+
+var updateKAT = flag.Bool("update", false, "rewrite the known-answer vectors in testdata")
+
+// runSessionKAT establishes a session between seeded users through a server and returns one line per wire message:
+// the hello and the headers and ciphertexts of a short conversation with a reordered message.
+func runSessionKAT(t *testing.T, pq bool) []string {
+	t.Helper()
+	aliceUser, err := NewUserWithRandom("alice", 0, testutil.NewDRBG("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobUser, err := NewUserWithRandom("bob", 2, testutil.NewDRBG("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pq {
+		bobUser.PQPreKey = nil
+	}
+	alice, bob := NewClientFromUser(aliceUser), NewClientFromUser(bobUser)
+
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal(err)
+	}
+	hello := handshakeWithDirectory(t, alice, server, "bob")
+	lines := []string{fmt.Sprintf("hello %x %x %x %x", hello.EphemeralKey.Bytes(), hello.Nonce, hello.Ciphertext, hello.PQCiphertext)}
+
+	record := func(name string, msg *Message) *Message {
+		header, err := msg.Header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%s %x %x", name, header, msg.Ciphertext))
+		return msg
+	}
+
+	a1 := record("a1", encryptTestMessage(t, alice, "bob", "message a1"))
+	a2 := record("a2", encryptTestMessage(t, alice, "bob", "message a2"))
+	decryptTestMessage(t, bob, "alice", a2, "message a2")
+	decryptTestMessage(t, bob, "alice", a1, "message a1")
+	b1 := record("b1", encryptTestMessage(t, bob, "alice", "message b1"))
+	decryptTestMessage(t, alice, "bob", b1, "message b1")
+	a3 := record("a3", encryptTestMessage(t, alice, "bob", "message a3"))
+	decryptTestMessage(t, bob, "alice", a3, "message a3")
+	return lines
+}
+
+// TestSessionKnownAnswers compares the exact hello and messages of deterministic sessions with testdata/kat_*.txt.
+// Run go test -run TestSessionKnownAnswers -update to rewrite the vectors after an intended change of the handshake or the ratchet.
+func TestSessionKnownAnswers(t *testing.T) {
+	for name, pq := range map[string]bool{"x3dh": false, "pqxdh": true} {
+		t.Run(name, func(t *testing.T) {
+			actual := strings.Join(runSessionKAT(t, pq), "\n") + "\n"
+			if again := strings.Join(runSessionKAT(t, pq), "\n") + "\n"; again != actual {
+				t.Fatal("session is not deterministic")
+			}
+
+			path := "testdata/kat_" + name + ".txt"
+			if *updateKAT {
+				if err := os.MkdirAll("testdata", 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(actual), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal([]byte(actual), expected) {
+				t.Fatalf("session differs from %s", path)
+			}
+		})
+	}
+}
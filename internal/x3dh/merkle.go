@@ -0,0 +1,187 @@
+package x3dh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/bits"
+)
+
+// The Merkle tree of the key transparency log as specified in RFC 9162 section 2.1.
+// Leaves and inner nodes are hashed with different prefixes, so a leaf can never be passed off as a subtree.
+
+func leafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two smaller than n, n has to be at least 2
+func splitPoint(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// rootHash returns MTH(D[n]) of the leaf hashes
+func rootHash(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		return sha256.New().Sum(nil)
+	case 1:
+		return hashes[0]
+	}
+	k := splitPoint(len(hashes))
+	return nodeHash(rootHash(hashes[:k]), rootHash(hashes[k:]))
+}
+
+// inclusionPath returns PATH(m, D[n]), the audit path of leaf m
+func inclusionPath(hashes [][]byte, m int) [][]byte {
+	if len(hashes) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(hashes))
+	if m < k {
+		return append(inclusionPath(hashes[:k], m), rootHash(hashes[k:]))
+	}
+	return append(inclusionPath(hashes[k:], m-k), rootHash(hashes[:k]))
+}
+
+// consistencyPath returns PROOF(m, D[n]), which proves that the first m leaves are a prefix of D[n]
+func consistencyPath(hashes [][]byte, m int) [][]byte {
+	if m <= 0 || m >= len(hashes) {
+		return nil
+	}
+	return subproof(hashes, m, true)
+}
+
+func subproof(hashes [][]byte, m int, complete bool) [][]byte {
+	n := len(hashes)
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{rootHash(hashes)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(subproof(hashes[:k], m, complete), rootHash(hashes[k:]))
+	}
+	return append(subproof(hashes[k:], m-k, false), rootHash(hashes[:k]))
+}
+
+// verifyInclusion checks the audit path of the leaf at index in the tree of size with root, see RFC 9162 section 2.1.3.2
+func verifyInclusion(index, size uint64, leaf []byte, path [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// verifyConsistency checks that the tree of first with firstRoot is a prefix of the tree of second with secondRoot,
+// see RFC 9162 section 2.1.4.2
+func verifyConsistency(first, second uint64, firstRoot, secondRoot []byte, path [][]byte) bool {
+	switch {
+	case first > second:
+		return false
+	case first == second:
+		return len(path) == 0 && bytes.Equal(firstRoot, secondRoot)
+	case first == 0:
+		return len(path) == 0
+	case len(path) == 0:
+		return false
+	}
+
+	if first&(first-1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
+
+// merkleFrontier is the compact form of a tree: the roots of its perfect subtrees from left to right.
+// Leaves can be appended without knowing the earlier ones, so a monitor only downloads new entries.
+type merkleFrontier struct {
+	size   uint64
+	hashes [][]byte
+}
+
+func (f *merkleFrontier) append(leaf []byte) {
+	f.hashes = append(f.hashes, leaf)
+	for n := f.size; n&1 == 1; n >>= 1 {
+		last := len(f.hashes) - 1
+		f.hashes = append(f.hashes[:last-1], nodeHash(f.hashes[last-1], f.hashes[last]))
+	}
+	f.size++
+}
+
+// frontierBefore returns the frontier of the first index leaves from the audit path of the leaf at index
+// in the tree of index+1 leaves. All siblings of the last leaf are left subtrees, the roots of the perfect subtrees
+// before it, from the smallest to the largest.
+func frontierBefore(index uint64, path [][]byte) (merkleFrontier, bool) {
+	if len(path) != bits.OnesCount64(index) {
+		return merkleFrontier{}, false
+	}
+	f := merkleFrontier{size: index, hashes: make([][]byte, 0, len(path))}
+	for i := len(path) - 1; i >= 0; i-- {
+		f.hashes = append(f.hashes, path[i])
+	}
+	return f, true
+}
+
+func (f *merkleFrontier) root() []byte {
+	if len(f.hashes) == 0 {
+		return rootHash(nil)
+	}
+	r := f.hashes[len(f.hashes)-1]
+	for i := len(f.hashes) - 2; i >= 0; i-- {
+		r = nodeHash(f.hashes[i], r)
+	}
+	return r
+}
@@ -0,0 +1,101 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"fmt"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"io"
+	"signal/internal/xeddsa"
+)
+
+// PQXDH as specified in https://signal.org/docs/specifications/pqxdh/
+// The responder publishes a ML-KEM-768 prekey signed with the responder's identity key. The initiator encapsulates to it
+// and appends the shared secret to DH1 || DH2 || DH3 || DH4 before x3dhKDF, so SK stays secret as long as either
+// the DHs or ML-KEM hold. Bundles without a PQ prekey fall back to X3DH.
+
+// kemTypeMLKEM768 prefixes the encoded PQ prekey, which is signed, so the signature also covers the KEM type
+const kemTypeMLKEM768 byte = 0x01
+
+// PQPreKey is the public half of a signed ML-KEM-768 prekey together with the ID the owner stores the private half under.
+type PQPreKey struct {
+	ID        uint32
+	Key       *mlkem768.PublicKey
+	Signature []byte // SIG(IK_s, EncodeKEM(PQPK))
+}
+
+// encodeKEMPublicKey returns the KEM type || the encoded ML-KEM-768 public key
+func encodeKEMPublicKey(key *mlkem768.PublicKey) []byte {
+	encoded := make([]byte, 1+mlkem768.PublicKeySize)
+	encoded[0] = kemTypeMLKEM768
+	key.Pack(encoded[1:])
+	return encoded
+}
+
+func parseKEMPublicKey(data []byte) (*mlkem768.PublicKey, error) {
+	if len(data) != 1+mlkem768.PublicKeySize || data[0] != kemTypeMLKEM768 {
+		return nil, fmt.Errorf("%w: invalid ML-KEM-768 public key", ErrInvalidBundle)
+	}
+	key := &mlkem768.PublicKey{}
+	if err := key.Unpack(data[1:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// verifyPQPreKey checks the signature of the PQ prekey against identityKey
+func verifyPQPreKey(identityKey *ecdh.PublicKey, preKey *PQPreKey) bool {
+	return preKey.Key != nil && xeddsa.Verify(identityKey, encodeKEMPublicKey(preKey.Key), preKey.Signature)
+}
+
+// generatePQPreKey replaces the PQ prekey with a new signed one.
+// It is used as last-resort PQ prekey, which is not deleted after a handshake.
+func (u *User) generatePQPreKey(id uint32) error {
+	public, private, err := mlkem768.GenerateKeyPair(u.random())
+	if err != nil {
+		return err
+	}
+	signature, err := xeddsa.SignWithRandom(u.IdentityKey, encodeKEMPublicKey(public), u.random())
+	if err != nil {
+		return err
+	}
+
+	u.PQPreKey = private
+	u.PQPreKeySigned = signature
+	u.PQPreKeyID = id
+	return u.saveLocalIdentity()
+}
+
+// publishPQPreKey returns the public half of the PQ prekey, nil if the user has none
+func (u *User) publishPQPreKey() *PQPreKey {
+	if u.PQPreKey == nil {
+		return nil
+	}
+	return &PQPreKey{
+		ID:        u.PQPreKeyID,
+		Key:       u.PQPreKey.Public().(*mlkem768.PublicKey),
+		Signature: u.PQPreKeySigned,
+	}
+}
+
+// pqEncapsulate returns the ciphertext for the responder and the shared secret of the PQ prekey, the seed is read from random
+func pqEncapsulate(random io.Reader, preKey *PQPreKey) (ciphertext, sharedSecret []byte, err error) {
+	seed := make([]byte, mlkem768.EncapsulationSeedSize)
+	if _, err := io.ReadFull(random, seed); err != nil {
+		return nil, nil, err
+	}
+	ciphertext = make([]byte, mlkem768.CiphertextSize)
+	sharedSecret = make([]byte, mlkem768.SharedKeySize)
+	preKey.Key.EncapsulateTo(ciphertext, sharedSecret, seed)
+	return ciphertext, sharedSecret, nil
+}
+
+// pqDecapsulate returns the shared secret of ciphertext, which was encapsulated to the PQ prekey with id
+func (u *User) pqDecapsulate(id uint32, ciphertext []byte) ([]byte, error) {
+	if u.PQPreKey == nil || u.PQPreKeyID != id {
+		return nil, fmt.Errorf("%w: unknown PQ prekey %d", ErrBundleExhausted, id)
+	}
+	if len(ciphertext) != mlkem768.CiphertextSize {
+		return nil, fmt.Errorf("%w: invalid ML-KEM-768 ciphertext size", ErrInvalidMessage)
+	}
+	return mlkem768.Scheme().Decapsulate(u.PQPreKey, ciphertext)
+}
@@ -0,0 +1,175 @@
+package x3dh
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPQXDHHandshake(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bobUser, bob := newTestUserClient(t, "bob", 1)
+			if err := bob.PublishKeyBundle(directory); err != nil {
+				t.Fatal("PublishKeyBundle failed:", err.Error())
+			}
+
+			// the second handshake uses the last-resort prekey, both have to mix in the PQ shared secret
+			for _, aliceName := range []string{"alice", "carol"} {
+				_, alice := newTestUserClient(t, aliceName, 0)
+				hello := handshakeWithDirectory(t, alice, directory, "bob")
+				if len(hello.PQCiphertext) == 0 || hello.PQPreKeyID != bobUser.PQPreKeyID {
+					t.Fatal("hello carries no PQ ciphertext")
+				}
+
+				sk, _, err := bobUser.ProcessX3DHHello(hello)
+				if err != nil {
+					t.Fatal("ProcessX3DHHello failed:", err.Error())
+				}
+				if !bytes.Equal(sk, alice.keyBundles["bob"].SecretKey) {
+					t.Fatal("secret key of bob is not same as secret key of alice")
+				}
+			}
+		})
+	}
+}
+
+func TestPQXDHFallsBackToX3DH(t *testing.T) {
+	bobUser, _ := newTestUserClient(t, "bob", 1)
+	_, alice := newTestUserClient(t, "alice", 0)
+	directory := &faultyDirectory{
+		KeyDirectory: newTestServer(t),
+		tamper: func(bundle *KeyBundleSending) {
+			bundle.PQPreKey = nil
+		},
+	}
+	if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bobUser)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+
+	hello := handshakeWithDirectory(t, alice, directory, "bob")
+	if hello.PQCiphertext != nil {
+		t.Fatal("hello carries a PQ ciphertext without PQ prekey")
+	}
+	sk, _, err := bobUser.ProcessX3DHHello(hello)
+	if err != nil {
+		t.Fatal("ProcessX3DHHello failed:", err.Error())
+	}
+	if !bytes.Equal(sk, alice.keyBundles["bob"].SecretKey) {
+		t.Fatal("secret key of bob is not same as secret key of alice")
+	}
+}
+
+func TestPQPreKeyCanNotBeRemoved(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bobUser, _ := newTestUserClient(t, "bob", 1)
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bobUser)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			// a correctly signed bundle without the PQ prekey would downgrade initiators to X3DH
+			bobUser.PQPreKey = nil
+			err := directory.UploadKeyBundle("bob", publishTestBundle(t, bobUser))
+			if !errors.Is(err, ErrInvalidBundle) {
+				t.Fatal("Expected ErrInvalidBundle, Actual:", err)
+			}
+
+			bundle, err := directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			if bundle.PQPreKey == nil {
+				t.Fatal("rejected upload must not remove the PQ prekey")
+			}
+		})
+	}
+}
+
+func TestPQXDHCiphertextIsAuthenticated(t *testing.T) {
+	tests := map[string]func(hello *InitialMessage){
+		"tampered": func(hello *InitialMessage) { hello.PQCiphertext[0] ^= 0xff },
+		"stripped": func(hello *InitialMessage) { hello.PQCiphertext = nil },
+		"wrong id": func(hello *InitialMessage) { hello.PQPreKeyID++ },
+	}
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			bobUser, _ := newTestUserClient(t, "bob", 1)
+			_, alice := newTestUserClient(t, "alice", 0)
+			server := newTestServer(t)
+			if err := server.UploadKeyBundle("bob", publishTestBundle(t, bobUser)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			hello := handshakeWithDirectory(t, alice, server, "bob")
+			tamper(hello)
+			if _, _, err := bobUser.ProcessX3DHHello(hello); err == nil {
+				t.Fatal("hello with a changed PQ ciphertext must not be accepted")
+			}
+			if len(bobUser.OKPs) != 1 {
+				t.Fatal("one-time prekey must not be deleted by a failed hello")
+			}
+		})
+	}
+}
+
+func TestPQPreKeySignature(t *testing.T) {
+	bobUser, _ := newTestUserClient(t, "bob", 1)
+	mallory, _ := newTestUserClient(t, "mallory", 0)
+
+	// a PQ prekey signed by another identity key is rejected by the server
+	bundle := publishTestBundle(t, bobUser)
+	bundle.PQPreKey = publishTestBundle(t, mallory).PQPreKey
+	if err := newTestServer(t).UploadKeyBundle("bob", bundle); !errors.Is(err, ErrInvalidBundle) {
+		t.Fatal("expected invalid bundle error, got:", err)
+	}
+
+	// and by the initiator, if the server swapped it
+	_, alice := newTestUserClient(t, "alice", 0)
+	directory := &faultyDirectory{
+		KeyDirectory: newTestServer(t),
+		tamper: func(bundle *KeyBundleSending) {
+			bundle.PQPreKey = publishTestBundle(t, mallory).PQPreKey
+		},
+	}
+	if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bobUser)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+	if err := alice.InitialHandshake(directory, "bob"); err != nil {
+		t.Fatal("InitialHandshake failed:", err.Error())
+	}
+	if err := alice.GenerateSendSecretKey("bob"); err == nil {
+		t.Fatal("GenerateSendSecretKey should fail with a foreign PQ prekey")
+	}
+}
+
+func TestPQXDHSessionNegotiatesKEMRatchet(t *testing.T) {
+	for _, pq := range []bool{true, false} {
+		_, alice := newTestUserClient(t, "alice", 0)
+		bobUser, bob := newTestUserClient(t, "bob", 1)
+		if !pq {
+			bobUser.PQPreKey = nil
+		}
+		session := startTestSession(t, alice, bobUser)
+		if (session.State.KEM != nil) != pq {
+			t.Fatalf("KEM ratchet of the initiator has to be enabled only for PQXDH, PQXDH: %t", pq)
+		}
+
+		first := encryptTestMessage(t, alice, "bob", "Hello Bob")
+		if (first.Header.KEMPublicKey != nil) != pq {
+			t.Fatalf("first header has to offer an encapsulation key only for PQXDH, PQXDH: %t", pq)
+		}
+		decryptTestMessage(t, bob, "alice", first, "Hello Bob")
+		bobSession, _, _ := bob.Session("alice")
+		if (bobSession.State.KEM != nil) != pq {
+			t.Fatalf("KEM ratchet of the responder has to be enabled only for PQXDH, PQXDH: %t", pq)
+		}
+
+		reply := encryptTestMessage(t, bob, "alice", "Hello Alice")
+		if (reply.Header.KEMCiphertext != nil) != pq {
+			t.Fatalf("reply has to answer the encapsulation key only for PQXDH, PQXDH: %t", pq)
+		}
+		decryptTestMessage(t, alice, "bob", reply, "Hello Alice")
+		decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "How are you?"), "How are you?")
+	}
+}
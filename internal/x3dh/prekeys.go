@@ -0,0 +1,364 @@
+package x3dh
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"signal/internal/doubleratchet"
+	"signal/internal/xeddsa"
+	"slices"
+	"time"
+)
+
+const (
+	DefaultRotationInterval = 7 * 24 * time.Hour
+	DefaultGracePeriod      = 30 * 24 * time.Hour
+
+	DefaultOneTimePreKeyThreshold = 10
+	DefaultOneTimePreKeyBatch     = 100
+)
+
+// The contexts separate the signatures of uploads to the directory from the other signatures of the identity key
+const (
+	bundleContext         = "signal x3dh key bundle v1"
+	signedPreKeyContext   = "signal x3dh signed prekey v1"
+	oneTimePreKeysContext = "signal x3dh one-time prekeys v1"
+)
+
+func (u *User) generateSignedPreKey(id uint32) error {
+	key, err := doubleratchet.GenerateDHWithRandom(u.random())
+	if err != nil {
+		return err
+	}
+	signature, err := xeddsa.SignWithRandom(u.IdentityKey, key.PublicKey().Bytes(), u.random())
+	if err != nil {
+		return err
+	}
+
+	record := SignedPreKeyRecord{ID: id, Key: key, Signature: signature, CreatedAt: u.now()}
+	if err := u.store.StoreSignedPreKey(record); err != nil {
+		return err
+	}
+	u.SignedPreKey = key
+	u.SignedPreKeySigned = signature
+	u.SignedPreKeyID = id
+	u.SignedPreKeyAt = record.CreatedAt
+	return nil
+}
+
+// SignedPreKeyRotationDue reports whether the current SPK is older than RotationInterval.
+func (u *User) SignedPreKeyRotationDue() bool {
+	return u.now().Sub(u.SignedPreKeyAt) >= u.RotationInterval
+}
+
+// RotateSignedPreKey replaces the SPK with a new one and the next ID.
+// The previous SPK is retired and kept for GracePeriod, retired SPKs older than that are deleted.
+func (u *User) RotateSignedPreKey() error {
+	previous := SignedPreKeyRecord{
+		ID:        u.SignedPreKeyID,
+		Key:       u.SignedPreKey,
+		Signature: u.SignedPreKeySigned,
+		CreatedAt: u.SignedPreKeyAt,
+		RetiredAt: u.now(),
+	}
+
+	// the previous SPK is stored as retired first, so it is never lost if storing the new one fails
+	if err := u.store.StoreSignedPreKey(previous); err != nil {
+		return err
+	}
+	u.retiredPreKeys = append(u.retiredPreKeys, previous)
+	if err := u.generateSignedPreKey(u.SignedPreKeyID + 1); err != nil {
+		u.retiredPreKeys = u.retiredPreKeys[:len(u.retiredPreKeys)-1]
+		previous.RetiredAt = time.Time{}
+		return errors.Join(err, u.store.StoreSignedPreKey(previous))
+	}
+	return u.pruneRetiredPreKeys()
+}
+
+// pruneRetiredPreKeys deletes the retired SPKs, whose grace period is over
+func (u *User) pruneRetiredPreKeys() error {
+	now := u.now()
+	kept := u.retiredPreKeys[:0]
+	for i, retired := range u.retiredPreKeys {
+		if now.Sub(retired.RetiredAt) < u.GracePeriod {
+			kept = append(kept, retired)
+			continue
+		}
+		if err := u.store.RemoveSignedPreKey(retired.ID); err != nil {
+			u.retiredPreKeys = append(kept, u.retiredPreKeys[i:]...)
+			return err
+		}
+	}
+	u.retiredPreKeys = kept
+	return nil
+}
+
+// signedPreKeyByID returns the current SPK or a retired one, which is still within the grace period
+func (u *User) signedPreKeyByID(id uint32) (*ecdh.PrivateKey, error) {
+	if id == u.SignedPreKeyID {
+		return u.SignedPreKey, nil
+	}
+	if err := u.pruneRetiredPreKeys(); err != nil {
+		return nil, err
+	}
+	for _, retired := range u.retiredPreKeys {
+		if retired.ID == id {
+			return retired.Key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown or expired signed prekey %d", ErrBundleExhausted, id)
+}
+
+// RefreshSignedPreKey rotates the SPK of the client's user if it is due and uploads the new one to directory.
+// The upload is recorded as pending in the store before the rotation, so an upload which failed is retried
+// by the next call, also after a restart. The directory accepts the repeated upload of a published SPK, so a retry
+// after a lost response succeeds. It reports whether a rotation happened.
+func (c *Client) RefreshSignedPreKey(directory KeyDirectory) (bool, error) {
+	if c.user == nil {
+		return false, fmt.Errorf("%w to rotate the signed prekey of", ErrNoUser)
+	}
+	c.mu.Lock()
+	due := c.user.SignedPreKeyRotationDue()
+	if !due && !c.user.signedPreKeyPending {
+		c.mu.Unlock()
+		return false, nil
+	}
+	if due {
+		if err := c.user.setSignedPreKeyPending(true); err != nil {
+			c.mu.Unlock()
+			return false, err
+		}
+		if err := c.user.RotateSignedPreKey(); err != nil {
+			c.mu.Unlock()
+			return false, err
+		}
+	}
+	id, key, signature := c.user.SignedPreKeyID, c.user.SignedPreKey.PublicKey(), c.user.SignedPreKeySigned
+	uploadSignature, err := c.user.SignSignedPreKeyUpload()
+	c.mu.Unlock()
+	if err != nil {
+		return due, err
+	}
+
+	if err := directory.UploadSignedPreKey(c.UserName, id, key, signature, uploadSignature); err != nil {
+		return due, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a rotation in the meantime is still pending
+	if c.user.SignedPreKeyID != id {
+		return due, nil
+	}
+	return due, c.user.setSignedPreKeyPending(false)
+}
+
+// setSignedPreKeyPending records in the store whether the current SPK still has to be uploaded
+func (u *User) setSignedPreKeyPending(pending bool) error {
+	previous := u.signedPreKeyPending
+	u.signedPreKeyPending = pending
+	if err := u.saveLocalIdentity(); err != nil {
+		u.signedPreKeyPending = previous
+		return err
+	}
+	return nil
+}
+
+// GenerateOneTimePreKeys generates n one-time prekeys with new IDs.
+// The private halves are stored in OKPs and the store, the public halves are returned for the upload.
+func (u *User) GenerateOneTimePreKeys(n int) ([]PreKey, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	// the IDs are reserved before any key is stored, so they are not handed out twice after a crash
+	first := u.nextOneTimePreKeyID
+	u.nextOneTimePreKeyID += uint32(n)
+	if err := u.saveLocalIdentity(); err != nil {
+		return nil, err
+	}
+
+	var preKeys []PreKey
+	for id := first; id != u.nextOneTimePreKeyID; id++ {
+		key, err := doubleratchet.GenerateDHWithRandom(u.random())
+		if err != nil {
+			return nil, err
+		}
+		if err := u.store.StorePreKey(id, key); err != nil {
+			return nil, err
+		}
+		u.OKPs[id] = key
+		preKeys = append(preKeys, PreKey{ID: id, Key: key.PublicKey()})
+	}
+	return preKeys, nil
+}
+
+// SignSignedPreKeyUpload signs the upload of the current SPK to the directory with the identity key,
+// see Server.UploadSignedPreKey.
+func (u *User) SignSignedPreKeyUpload() ([]byte, error) {
+	return xeddsa.SignWithRandom(u.IdentityKey, signedPreKeyMessage(u.name, u.SignedPreKeyID, u.SignedPreKey.PublicKey()), u.random())
+}
+
+// signedPreKeyMessage is the signed message of an SPK upload: the context, the length prefixed user name, the ID and the key
+func signedPreKeyMessage(userName string, id uint32, key *ecdh.PublicKey) []byte {
+	b := []byte(signedPreKeyContext)
+	b = binary.AppendUvarint(b, uint64(len(userName)))
+	b = append(b, userName...)
+	b = binary.BigEndian.AppendUint32(b, id)
+	return append(b, publicKeyBytes(key)...)
+}
+
+// SignOneTimePreKeys signs an upload of keys to the directory with the identity key, see Server.UploadOneTimePreKeys.
+func (u *User) SignOneTimePreKeys(keys []PreKey) ([]byte, error) {
+	return xeddsa.SignWithRandom(u.IdentityKey, oneTimePreKeysMessage(u.name, keys), u.random())
+}
+
+// oneTimePreKeysMessage is the signed message of an upload: the context, the length prefixed user name and the ID and
+// key of every prekey. The user name binds the upload to the account of the user.
+func oneTimePreKeysMessage(userName string, keys []PreKey) []byte {
+	b := []byte(oneTimePreKeysContext)
+	b = binary.AppendUvarint(b, uint64(len(userName)))
+	b = append(b, userName...)
+	for _, preKey := range keys {
+		b = binary.BigEndian.AppendUint32(b, preKey.ID)
+		b = append(b, publicKeyBytes(preKey.Key)...)
+	}
+	return b
+}
+
+// bundleMessage is the signed message of a bundle upload: the context, the length prefixed user name, the sequence
+// number and every prekey with its ID. Absent prekeys are encoded as a zero byte, present ones start with a one byte.
+// The signatures of the SPK and the PQ prekey are verified on their own.
+func bundleMessage(userName string, bundle KeyBundleSending) []byte {
+	b := []byte(bundleContext)
+	b = binary.AppendUvarint(b, uint64(len(userName)))
+	b = append(b, userName...)
+	b = binary.BigEndian.AppendUint64(b, bundle.Sequence)
+	b = binary.BigEndian.AppendUint32(b, bundle.SignedPreKeyID)
+	b = append(b, publicKeyBytes(bundle.SignedPreKey)...)
+	b = binary.AppendUvarint(b, uint64(len(bundle.OneTimePreKeys)))
+	for _, preKey := range bundle.OneTimePreKeys {
+		b = binary.BigEndian.AppendUint32(b, preKey.ID)
+		b = append(b, publicKeyBytes(preKey.Key)...)
+	}
+	if bundle.LastResortPreKey == nil {
+		b = append(b, 0)
+	} else {
+		b = append(append(b, 1), bundle.LastResortPreKey.Bytes()...)
+	}
+	if bundle.PQPreKey == nil || bundle.PQPreKey.Key == nil {
+		b = append(b, 0)
+	} else {
+		b = binary.BigEndian.AppendUint32(append(b, 1), bundle.PQPreKey.ID)
+		b = append(b, encodeKEMPublicKey(bundle.PQPreKey.Key)...)
+	}
+	return b
+}
+
+// removeOneTimePreKey deletes the one-time prekey id once it was used
+func (u *User) removeOneTimePreKey(id uint32) error {
+	if err := u.store.RemovePreKey(id); err != nil {
+		return err
+	}
+	delete(u.OKPs, id)
+	return nil
+}
+
+// oneTimePreKeys returns the public halves of all unused one-time prekeys ordered by ID
+func (u *User) oneTimePreKeys() []PreKey {
+	var preKeys []PreKey
+	for id, key := range u.OKPs {
+		preKeys = append(preKeys, PreKey{ID: id, Key: key.PublicKey()})
+	}
+	slices.SortFunc(preKeys, func(a, b PreKey) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return preKeys
+}
+
+// ReplenishOneTimePreKeys checks the number of one-time prekeys left on directory
+// and uploads a batch of OneTimePreKeyBatch new ones once it dropped below OneTimePreKeyThreshold.
+// The batch is recorded as pending in the store before the upload. An upload which failed, possibly only on the way
+// back, is repeated with the same IDs and signature by the next call, the directory accepts it once or without a change.
+// It returns the number of uploaded prekeys.
+func (c *Client) ReplenishOneTimePreKeys(directory KeyDirectory) (int, error) {
+	if c.user == nil {
+		return 0, fmt.Errorf("%w to replenish one-time prekeys of", ErrNoUser)
+	}
+
+	count, err := directory.OneTimePreKeyCount(c.UserName)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	preKeys, signature, err := c.user.pendingOneTimePreKeys()
+	if err == nil && preKeys == nil && count < c.OneTimePreKeyThreshold {
+		preKeys, signature, err = c.user.newOneTimePreKeyBatch(c.OneTimePreKeyBatch)
+	}
+	c.mu.Unlock()
+	if err != nil || preKeys == nil {
+		return 0, err
+	}
+	if err := directory.UploadOneTimePreKeys(c.UserName, preKeys, signature); err != nil {
+		// the batch stays pending, it may have been published already
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a bundle published in the meantime carried the batch already
+	if !bytes.Equal(c.user.pendingPreKeysSigned, signature) {
+		return len(preKeys), nil
+	}
+	return len(preKeys), c.user.setOneTimePreKeysPending(nil, nil)
+}
+
+// newOneTimePreKeyBatch generates and signs n one-time prekeys and records them as pending upload
+func (u *User) newOneTimePreKeyBatch(n int) ([]PreKey, []byte, error) {
+	preKeys, err := u.GenerateOneTimePreKeys(n)
+	if err != nil || preKeys == nil {
+		return nil, nil, err
+	}
+	signature, err := u.SignOneTimePreKeys(preKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]uint32, len(preKeys))
+	for i, preKey := range preKeys {
+		ids[i] = preKey.ID
+	}
+	if err := u.setOneTimePreKeysPending(ids, signature); err != nil {
+		return nil, nil, err
+	}
+	return preKeys, signature, nil
+}
+
+// pendingOneTimePreKeys returns the batch whose upload did not succeed yet, nil if there is none.
+// A batch with a used prekey was published already and is not pending anymore.
+func (u *User) pendingOneTimePreKeys() ([]PreKey, []byte, error) {
+	if u.pendingPreKeyIDs == nil {
+		return nil, nil, nil
+	}
+	preKeys := make([]PreKey, len(u.pendingPreKeyIDs))
+	for i, id := range u.pendingPreKeyIDs {
+		key, ok := u.OKPs[id]
+		if !ok {
+			return nil, nil, u.setOneTimePreKeysPending(nil, nil)
+		}
+		preKeys[i] = PreKey{ID: id, Key: key.PublicKey()}
+	}
+	return preKeys, u.pendingPreKeysSigned, nil
+}
+
+// setOneTimePreKeysPending records in the store which one-time prekey batch still has to be uploaded
+func (u *User) setOneTimePreKeysPending(ids []uint32, signature []byte) error {
+	previousIDs, previousSigned := u.pendingPreKeyIDs, u.pendingPreKeysSigned
+	u.pendingPreKeyIDs, u.pendingPreKeysSigned = ids, signature
+	if err := u.saveLocalIdentity(); err != nil {
+		u.pendingPreKeyIDs, u.pendingPreKeysSigned = previousIDs, previousSigned
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"testing"
+)
+
+func TestSignedPreKeyRotation(t *testing.T) {
+	bobUser, bob, clock := newTestUserWithClock(t, "bob", 3)
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+
+	rotated, err := bob.RefreshSignedPreKey(server)
+	if err != nil {
+		t.Fatal("RefreshSignedPreKey failed:", err.Error())
+	}
+	if rotated {
+		t.Fatal("signed prekey must not be rotated before the interval is over")
+	}
+
+	// alice fetches the bundle before bob rotates
+	_, alice := newTestUserClient(t, "alice", 0)
+	hello := handshakeWithDirectory(t, alice, server, "bob")
+	if hello.SignedPreKeyID != 1 {
+		t.Fatal("expected signed prekey 1, got:", hello.SignedPreKeyID)
+	}
+
+	clock.now = clock.now.Add(bobUser.RotationInterval)
+	rotated, err = bob.RefreshSignedPreKey(server)
+	if err != nil {
+		t.Fatal("RefreshSignedPreKey failed:", err.Error())
+	}
+	if !rotated || bobUser.SignedPreKeyID != 2 {
+		t.Fatal("signed prekey has to be rotated once the interval is over")
+	}
+
+	bundle, err := server.GetKeyBundle("bob")
+	if err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if bundle.SignedPreKeyID != 2 || !bundle.SignedPreKey.Equal(bobUser.SignedPreKey.PublicKey()) {
+		t.Fatal("server has to publish the rotated signed prekey")
+	}
+
+	// the hello built against the old bundle still decrypts within the grace period
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	decryptTestMessage(t, bob, "alice", msg, "Hello Bob")
+
+	// new handshakes use the rotated signed prekey
+	_, carol := newTestUserClient(t, "carol", 0)
+	hello = handshakeWithDirectory(t, carol, server, "bob")
+	if hello.SignedPreKeyID != 2 {
+		t.Fatal("expected signed prekey 2, got:", hello.SignedPreKeyID)
+	}
+	msg = encryptTestMessage(t, carol, "bob", "Hello Bob")
+	decryptTestMessage(t, bob, "carol", msg, "Hello Bob")
+}
+
+// unreachableDirectory wraps a KeyDirectory and fails the SPK uploads while down is set
+type unreachableDirectory struct {
+	KeyDirectory
+	down bool
+}
+
+func (d *unreachableDirectory) UploadSignedPreKey(userName string, id uint32, key *ecdh.PublicKey, signature, uploadSignature []byte) error {
+	if d.down {
+		return errors.New("directory unreachable")
+	}
+	return d.KeyDirectory.UploadSignedPreKey(userName, id, key, signature, uploadSignature)
+}
+
+func TestSignedPreKeyUploadIsRetried(t *testing.T) {
+	bobUser, bob, clock := newTestUserWithClock(t, "bob", 1)
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+
+	directory := &unreachableDirectory{KeyDirectory: server, down: true}
+	clock.now = clock.now.Add(bobUser.RotationInterval)
+	if _, err := bob.RefreshSignedPreKey(directory); err == nil {
+		t.Fatal("failed upload has to be reported")
+	}
+	bundle, err := server.GetKeyBundle("bob")
+	if err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if bundle.SignedPreKeyID != 1 || bobUser.SignedPreKeyID != 2 {
+		t.Fatal("expected signed prekey 1 on the server and 2 locally")
+	}
+
+	// the pending upload survives a restart
+	restored, err := LoadUser(bobUser.store)
+	if err != nil {
+		t.Fatal("LoadUser failed:", err.Error())
+	}
+	restored.now = clock.Now
+	bob = NewClientFromUser(restored)
+
+	directory.down = false
+	rotated, err := bob.RefreshSignedPreKey(directory)
+	if err != nil {
+		t.Fatal("RefreshSignedPreKey failed:", err.Error())
+	}
+	if rotated {
+		t.Fatal("retried upload must not rotate the signed prekey again")
+	}
+	bundle, err = server.GetKeyBundle("bob")
+	if err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if bundle.SignedPreKeyID != 2 || !bundle.SignedPreKey.Equal(restored.SignedPreKey.PublicKey()) {
+		t.Fatal("server has to publish the rotated signed prekey")
+	}
+	if restored.signedPreKeyPending {
+		t.Fatal("successful upload has to clear the pending upload")
+	}
+}
+
+func TestSignedPreKeyGracePeriodExpires(t *testing.T) {
+	bobUser, bob, clock := newTestUserWithClock(t, "bob", 1)
+	server := newTestServer(t)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+
+	_, alice := newTestUserClient(t, "alice", 0)
+	handshakeWithDirectory(t, alice, server, "bob")
+
+	if err := bobUser.RotateSignedPreKey(); err != nil {
+		t.Fatal("RotateSignedPreKey failed:", err.Error())
+	}
+	clock.now = clock.now.Add(bobUser.GracePeriod)
+
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	if _, err := bob.DecryptMessage("alice", msg); err == nil {
+		t.Fatal("hello against an expired signed prekey must not be accepted")
+	}
+	if len(bobUser.retiredPreKeys) != 0 {
+		t.Fatal("expired signed prekey has to be deleted")
+	}
+}
+
+func TestUploadSignedPreKeyRejectsForeignSignature(t *testing.T) {
+	bob, err := NewUser("bob", 0)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	mallory, err := NewUser("mallory", 0)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bob)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+
+			uploadSignature, err := mallory.SignSignedPreKeyUpload()
+			if err != nil {
+				t.Fatal("SignSignedPreKeyUpload failed:", err.Error())
+			}
+			err = directory.UploadSignedPreKey("bob", 7, mallory.SignedPreKey.PublicKey(), mallory.SignedPreKeySigned, uploadSignature)
+			if !errors.Is(err, ErrInvalidSignature) || !errors.Is(err, ErrInvalidBundle) {
+				t.Fatal("Expected ErrInvalidSignature, Actual:", err)
+			}
+
+			bundle, err := directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			if bundle.SignedPreKeyID != bob.SignedPreKeyID || !bundle.SignedPreKey.Equal(bob.SignedPreKey.PublicKey()) {
+				t.Fatal("rejected upload must not change the published signed prekey")
+			}
+
+			if err := bob.RotateSignedPreKey(); err != nil {
+				t.Fatal("RotateSignedPreKey failed:", err.Error())
+			}
+			uploadSignature, err = bob.SignSignedPreKeyUpload()
+			if err != nil {
+				t.Fatal("SignSignedPreKeyUpload failed:", err.Error())
+			}
+			err = directory.UploadSignedPreKey("bob", bob.SignedPreKeyID, bob.SignedPreKey.PublicKey(), bob.SignedPreKeySigned, uploadSignature)
+			if err != nil {
+				t.Fatal("UploadSignedPreKey failed:", err.Error())
+			}
+			bundle, err = directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			if bundle.SignedPreKeyID != bob.SignedPreKeyID || !bundle.SignedPreKey.Equal(bob.SignedPreKey.PublicKey()) {
+				t.Fatal("published signed prekey was not replaced")
+			}
+		})
+	}
+}
+
+func TestUploadSignedPreKeyRejectsReplayAndRollback(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bob, err := NewUser("bob", 0)
+			if err != nil {
+				t.Fatal("NewUser failed:", err.Error())
+			}
+			if err := directory.UploadKeyBundle("bob", publishTestBundle(t, bob)); err != nil {
+				t.Fatal("UploadKeyBundle failed:", err.Error())
+			}
+			oldID, oldKey, oldSigned := bob.SignedPreKeyID, bob.SignedPreKey.PublicKey(), bob.SignedPreKeySigned
+			oldUploadSignature, err := bob.SignSignedPreKeyUpload()
+			if err != nil {
+				t.Fatal("SignSignedPreKeyUpload failed:", err.Error())
+			}
+
+			if err := bob.RotateSignedPreKey(); err != nil {
+				t.Fatal("RotateSignedPreKey failed:", err.Error())
+			}
+			uploadSignature, err := bob.SignSignedPreKeyUpload()
+			if err != nil {
+				t.Fatal("SignSignedPreKeyUpload failed:", err.Error())
+			}
+			err = directory.UploadSignedPreKey("bob", bob.SignedPreKeyID, bob.SignedPreKey.PublicKey(), bob.SignedPreKeySigned, uploadSignature)
+			if err != nil {
+				t.Fatal("UploadSignedPreKey failed:", err.Error())
+			}
+			// the repeated upload after a lost response is accepted
+			err = directory.UploadSignedPreKey("bob", bob.SignedPreKeyID, bob.SignedPreKey.PublicKey(), bob.SignedPreKeySigned, uploadSignature)
+			if err != nil {
+				t.Fatal("UploadSignedPreKey failed:", err.Error())
+			}
+
+			// the old SPK under a higher ID: the upload signature covers the ID
+			err = directory.UploadSignedPreKey("bob", bob.SignedPreKeyID+1, oldKey, oldSigned, oldUploadSignature)
+			if !errors.Is(err, ErrInvalidSignature) {
+				t.Fatal("Expected ErrInvalidSignature, Actual:", err)
+			}
+			// the old SPK under its own ID
+			err = directory.UploadSignedPreKey("bob", oldID, oldKey, oldSigned, oldUploadSignature)
+			if !errors.Is(err, ErrInvalidBundle) || errors.Is(err, ErrInvalidSignature) {
+				t.Fatal("Expected ErrInvalidBundle, Actual:", err)
+			}
+
+			bundle, err := directory.GetKeyBundle("bob")
+			if err != nil {
+				t.Fatal("GetKeyBundle failed:", err.Error())
+			}
+			if bundle.SignedPreKeyID != bob.SignedPreKeyID || !bundle.SignedPreKey.Equal(bob.SignedPreKey.PublicKey()) {
+				t.Fatal("rejected upload must not change the published signed prekey")
+			}
+		})
+	}
+}
+
+func TestOneTimePreKeyIDs(t *testing.T) {
+	bob, err := NewUser("bob", 3)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+
+	published := publishTestBundle(t, bob).OneTimePreKeys
+	for i, preKey := range published {
+		if preKey.ID != uint32(i+1) {
+			t.Fatalf("expected one-time prekey ID %d, got %d", i+1, preKey.ID)
+		}
+		if !bob.OKPs[preKey.ID].PublicKey().Equal(preKey.Key) {
+			t.Fatal("private half is not stored under the ID of the public half")
+		}
+	}
+
+	more, err := bob.GenerateOneTimePreKeys(2)
+	if err != nil {
+		t.Fatal("GenerateOneTimePreKeys failed:", err.Error())
+	}
+	if more[0].ID != 4 || more[1].ID != 5 || len(bob.OKPs) != 5 {
+		t.Fatal("new one-time prekeys have to continue the IDs")
+	}
+}
+
+func TestReplenishOneTimePreKeys(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			bobUser, bob := newTestUserClient(t, "bob", 3)
+			bob.OneTimePreKeyThreshold = 2
+			bob.OneTimePreKeyBatch = 5
+
+			if err := bob.PublishKeyBundle(directory); err != nil {
+				t.Fatal("PublishKeyBundle failed:", err.Error())
+			}
+			published := len(bobUser.OKPs)
+
+			uploaded, err := bob.ReplenishOneTimePreKeys(directory)
+			if err != nil {
+				t.Fatal("ReplenishOneTimePreKeys failed:", err.Error())
+			}
+			if uploaded != 0 {
+				t.Fatal("prekeys must not be uploaded above the threshold")
+			}
+
+			// two initiators use up the pool below the threshold
+			var hellos []*Message
+			for _, name := range []string{"alice", "carol"} {
+				_, initiator := newTestUserClient(t, name, 0)
+				handshakeWithDirectory(t, initiator, directory, "bob")
+				hellos = append(hellos, encryptTestMessage(t, initiator, "bob", "Hello Bob"))
+			}
+
+			uploaded, err = bob.ReplenishOneTimePreKeys(directory)
+			if err != nil {
+				t.Fatal("ReplenishOneTimePreKeys failed:", err.Error())
+			}
+			if uploaded != 5 {
+				t.Fatal("expected a batch of 5 prekeys, got:", uploaded)
+			}
+			count, err := directory.OneTimePreKeyCount("bob")
+			if err != nil {
+				t.Fatal("OneTimePreKeyCount failed:", err.Error())
+			}
+			if count != published-2+5 || len(bobUser.OKPs) != published+5 {
+				t.Fatal("unexpected number of prekeys on the server:", count)
+			}
+
+			// consumed private halves are deleted
+			for i, name := range []string{"alice", "carol"} {
+				id := hellos[i].Hello.OneTimePreKeyID
+				decryptTestMessage(t, bob, name, hellos[i], "Hello Bob")
+				if _, ok := bobUser.OKPs[id]; ok {
+					t.Fatal("consumed one-time prekey was not deleted:", id)
+				}
+			}
+		})
+	}
+}
+
+// lossyDirectory wraps a KeyDirectory and fails the one-time prekey uploads while down is set,
+// after passing them on if delivered is set, as if only the response was lost
+type lossyDirectory struct {
+	KeyDirectory
+	down      bool
+	delivered bool
+}
+
+func (d *lossyDirectory) UploadOneTimePreKeys(userName string, keys []PreKey, signature []byte) error {
+	if !d.down {
+		return d.KeyDirectory.UploadOneTimePreKeys(userName, keys, signature)
+	}
+	if d.delivered {
+		if err := d.KeyDirectory.UploadOneTimePreKeys(userName, keys, signature); err != nil {
+			return err
+		}
+	}
+	return errors.New("directory unreachable")
+}
+
+func TestOneTimePreKeyUploadIsRetried(t *testing.T) {
+	for name, delivered := range map[string]bool{"lost request": false, "lost response": true} {
+		t.Run(name, func(t *testing.T) {
+			bobUser, bob := newTestUserClient(t, "bob", 0)
+			bob.OneTimePreKeyThreshold = 1
+			bob.OneTimePreKeyBatch = 2
+			server := newTestServer(t)
+			if err := bob.PublishKeyBundle(server); err != nil {
+				t.Fatal("PublishKeyBundle failed:", err.Error())
+			}
+
+			directory := &lossyDirectory{KeyDirectory: server, down: true, delivered: delivered}
+			if _, err := bob.ReplenishOneTimePreKeys(directory); err == nil {
+				t.Fatal("failed upload has to be reported")
+			}
+			if len(bobUser.OKPs) != 2 {
+				t.Fatal("failed upload must keep the private halves, got:", len(bobUser.OKPs))
+			}
+
+			// the pending batch survives a restart and is uploaded again unchanged
+			restored, err := LoadUser(bobUser.store)
+			if err != nil {
+				t.Fatal("LoadUser failed:", err.Error())
+			}
+			bob = NewClientFromUser(restored)
+			bob.OneTimePreKeyThreshold = 1
+			bob.OneTimePreKeyBatch = 2
+
+			directory.down = false
+			uploaded, err := bob.ReplenishOneTimePreKeys(directory)
+			if err != nil {
+				t.Fatal("ReplenishOneTimePreKeys failed:", err.Error())
+			}
+			if uploaded != 2 || len(restored.OKPs) != 2 || restored.pendingPreKeyIDs != nil {
+				t.Fatal("retry has to upload the pending batch, uploaded:", uploaded)
+			}
+			count, err := server.OneTimePreKeyCount("bob")
+			if err != nil {
+				t.Fatal("OneTimePreKeyCount failed:", err.Error())
+			}
+			if count != 2 {
+				t.Fatal("expected 2 one-time prekeys on the server, got:", count)
+			}
+
+			// the retried keys are usable
+			_, alice := newTestUserClient(t, "alice", 0)
+			hello := handshakeWithDirectory(t, alice, server, "bob")
+			if _, ok := restored.OKPs[hello.OneTimePreKeyID]; !ok {
+				t.Fatal("handed out one-time prekey is unknown to bob:", hello.OneTimePreKeyID)
+			}
+		})
+	}
+}
@@ -1,17 +1,231 @@
 package x3dh
 
-type Server struct{}
+import (
+	"bytes"
+	"crypto/ecdh"
+	"fmt"
+	"signal/internal/xeddsa"
+	"sync"
+	"time"
+)
 
-func NewServer() *Server {
-	return &Server{}
+// Server is the prekey directory. It stores the published key bundles of all users
+// and hands out every one-time prekey only once. Every published identity key is recorded in its key transparency log.
+type Server struct {
+	mu    sync.Mutex
+	users map[string]*publishedBundle
+	log   *keyLog
+	now   func() time.Time
 }
 
-func (s *Server) GetKeyBundle(userName string) KeyBundleSending {
-	// Return dummy data for the key bundle
-	return KeyBundleSending{
-		IdentityKey:        nil,
-		SignedPreKey:       nil,
-		SignedPreKeySigned: nil,
-		OneTimePreKeys:     nil,
+type publishedBundle struct {
+	identityKey        *ecdh.PublicKey
+	signedPreKey       *ecdh.PublicKey
+	signedPreKeySigned []byte
+	signedPreKeyID     uint32
+	oneTimePreKeys     []PreKey
+	lastResortPreKey   *ecdh.PublicKey
+	pqPreKey           *PQPreKey
+	// one-time prekeys with lower IDs are refused, so a signed upload can not be replayed
+	nextOneTimePreKeyID uint32
+	// signature of the last accepted one-time prekey upload, its repetition succeeds without a change
+	oneTimePreKeysSigned []byte
+	// sequence number of the stored bundle, bundles with the same or a lower one are refused
+	sequence uint64
+}
+
+// storeMode tells storeKeyBundle where a bundle comes from
+type storeMode int
+
+const (
+	// storeUpload verifies the signature and the sequence number of the bundle, logs the identity key of a new user
+	// and refuses to register a known user with another identity key
+	storeUpload storeMode = iota
+	// storeRestore stores a bundle read by FileDirectory, which has been verified and logged already
+	storeRestore
+	// storeReplace logs the identity key and replaces the bundle of a known user with any identity key,
+	// tests use it to act as a malicious server
+	storeReplace
+)
+
+// NewServer returns an empty directory with a new transparency log.
+func NewServer() (*Server, error) {
+	log, err := newKeyLog()
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		users: make(map[string]*publishedBundle),
+		log:   log,
+		now:   time.Now,
+	}, nil
+}
+
+// UploadKeyBundle registers userName with the output of User.Publish, whose signature is verified against the identity
+// key of the bundle. A registration of an already known user replaces the stored bundle, if it has the same identity
+// key and a higher sequence number and keeps a published PQ prekey, otherwise it fails with ErrNameTaken or
+// ErrInvalidBundle.
+// The identity key of a new user is appended to the transparency log before the bundle is handed out.
+func (s *Server) UploadKeyBundle(userName string, bundle KeyBundleSending) error {
+	return s.storeKeyBundle(userName, bundle, storeUpload)
+}
+
+// storeKeyBundle validates and stores bundle, mode tells whether it is logged and may replace another identity key
+func (s *Server) storeKeyBundle(userName string, bundle KeyBundleSending, mode storeMode) error {
+	if bundle.IdentityKey == nil || bundle.SignedPreKey == nil {
+		return fmt.Errorf("%w: identity key and signed prekey are required", ErrInvalidBundle)
+	}
+	if !xeddsa.Verify(bundle.IdentityKey, bundle.SignedPreKey.Bytes(), bundle.SignedPreKeySigned) {
+		return fmt.Errorf("%w: %w: signed prekey", ErrInvalidBundle, ErrInvalidSignature)
+	}
+	if bundle.PQPreKey != nil && !verifyPQPreKey(bundle.IdentityKey, bundle.PQPreKey) {
+		return fmt.Errorf("%w: %w: PQ prekey", ErrInvalidBundle, ErrInvalidSignature)
+	}
+	if mode == storeUpload && !xeddsa.Verify(bundle.IdentityKey, bundleMessage(userName, bundle), bundle.Signature) {
+		return fmt.Errorf("%w: %w: bundle", ErrInvalidBundle, ErrInvalidSignature)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := &publishedBundle{
+		identityKey:        bundle.IdentityKey,
+		signedPreKey:       bundle.SignedPreKey,
+		signedPreKeySigned: bundle.SignedPreKeySigned,
+		signedPreKeyID:     bundle.SignedPreKeyID,
+		oneTimePreKeys:     append([]PreKey(nil), bundle.OneTimePreKeys...),
+		lastResortPreKey:   bundle.LastResortPreKey,
+		pqPreKey:           bundle.PQPreKey,
+		sequence:           bundle.Sequence,
+	}
+	for _, preKey := range bundle.OneTimePreKeys {
+		stored.nextOneTimePreKeyID = max(stored.nextOneTimePreKeyID, preKey.ID+1)
+	}
+	previous, known := s.users[userName]
+	if known && mode == storeUpload {
+		if !previous.identityKey.Equal(bundle.IdentityKey) {
+			return fmt.Errorf("%w: %s", ErrNameTaken, userName)
+		}
+		if bundle.Sequence <= previous.sequence {
+			return fmt.Errorf("%w: bundle %d of %s was uploaded before", ErrInvalidBundle, bundle.Sequence, userName)
+		}
+		// once published, initiators rely on the PQ prekey, a bundle without one would downgrade them to X3DH
+		if previous.pqPreKey != nil && bundle.PQPreKey == nil {
+			return fmt.Errorf("%w: PQ prekey of %s is missing", ErrInvalidBundle, userName)
+		}
+	}
+	if known && mode != storeReplace {
+		stored.nextOneTimePreKeyID = max(stored.nextOneTimePreKeyID, previous.nextOneTimePreKeyID)
+		stored.oneTimePreKeysSigned = previous.oneTimePreKeysSigned
+	}
+
+	// a new bundle with the logged identity key is no new publication
+	if mode != storeRestore && (!known || !previous.identityKey.Equal(bundle.IdentityKey)) {
+		if err := s.log.append(LogEntry{UserName: userName, IdentityKey: bundle.IdentityKey, Timestamp: s.now()}); err != nil {
+			return err
+		}
+	}
+	s.users[userName] = stored
+	return nil
+}
+
+// GetKeyBundle returns the key bundle of userName with at most one one-time prekey.
+// The handed out one-time prekey is removed from the pool, so no other initiator gets the same one.
+// Once the pool is empty, the last-resort prekey is handed out instead.
+func (s *Server) GetKeyBundle(userName string) (KeyBundleSending, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return KeyBundleSending{}, fmt.Errorf("%w: %s", ErrUnknownPeer, userName)
+	}
+
+	bundle := KeyBundleSending{
+		IdentityKey:        user.identityKey,
+		SignedPreKey:       user.signedPreKey,
+		SignedPreKeySigned: user.signedPreKeySigned,
+		SignedPreKeyID:     user.signedPreKeyID,
+		PQPreKey:           user.pqPreKey,
+	}
+	if len(user.oneTimePreKeys) > 0 {
+		bundle.OneTimePreKeys = []PreKey{user.oneTimePreKeys[0]}
+		user.oneTimePreKeys = user.oneTimePreKeys[1:]
+	} else {
+		bundle.LastResortPreKey = user.lastResortPreKey
+	}
+	return bundle, nil
+}
+
+// UploadSignedPreKey replaces the published SPK of userName after verifying signature and uploadSignature against the
+// stored identity key, see User.SignSignedPreKeyUpload. The ID has to be higher than the published one, so an old SPK
+// can not be published again, only the upload of the published SPK is repeated without a change.
+// Key, signature and ID are replaced together, so a bundle never mixes the old and the new SPK.
+func (s *Server) UploadSignedPreKey(userName string, id uint32, key *ecdh.PublicKey, signature, uploadSignature []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, userName)
+	}
+	if key == nil || !xeddsa.Verify(user.identityKey, key.Bytes(), signature) {
+		return fmt.Errorf("%w: %w: signed prekey", ErrInvalidBundle, ErrInvalidSignature)
+	}
+	if !xeddsa.Verify(user.identityKey, signedPreKeyMessage(userName, id, key), uploadSignature) {
+		return fmt.Errorf("%w: %w: signed prekey upload", ErrInvalidBundle, ErrInvalidSignature)
+	}
+	if id == user.signedPreKeyID && key.Equal(user.signedPreKey) {
+		return nil
+	}
+	if id <= user.signedPreKeyID {
+		return fmt.Errorf("%w: signed prekey %d is not newer than %d", ErrInvalidBundle, id, user.signedPreKeyID)
+	}
+
+	user.signedPreKey = key
+	user.signedPreKeySigned = signature
+	user.signedPreKeyID = id
+	return nil
+}
+
+// UploadOneTimePreKeys adds keys to the pool of userName after verifying signature against the stored identity key,
+// see User.SignOneTimePreKeys. The IDs have to be higher than the ones uploaded before, so an upload is accepted once.
+// The repetition of the last accepted upload, whose response may have been lost, succeeds without adding the keys again.
+func (s *Server) UploadOneTimePreKeys(userName string, keys []PreKey, signature []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, userName)
+	}
+	if !xeddsa.Verify(user.identityKey, oneTimePreKeysMessage(userName, keys), signature) {
+		return fmt.Errorf("%w: %w: one-time prekeys", ErrInvalidBundle, ErrInvalidSignature)
+	}
+	if bytes.Equal(signature, user.oneTimePreKeysSigned) {
+		return nil
+	}
+	next := user.nextOneTimePreKeyID
+	for _, preKey := range keys {
+		if preKey.Key == nil || preKey.ID < next {
+			return fmt.Errorf("%w: one-time prekey %d is missing or was uploaded before", ErrInvalidBundle, preKey.ID)
+		}
+		next = preKey.ID + 1
+	}
+
+	user.oneTimePreKeys = append(user.oneTimePreKeys, keys...)
+	user.nextOneTimePreKeyID = next
+	user.oneTimePreKeysSigned = signature
+	return nil
+}
+
+func (s *Server) OneTimePreKeyCount(userName string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownPeer, userName)
 	}
+	return len(user.oneTimePreKeys), nil
 }
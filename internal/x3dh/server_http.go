@@ -0,0 +1,290 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// signedPreKeyJSON is the wire format of a signed prekey upload
+type signedPreKeyJSON struct {
+	ID              uint32 `json:"id"`
+	Key             []byte `json:"key"`
+	Signature       []byte `json:"signature"`
+	UploadSignature []byte `json:"upload_signature"`
+}
+
+// oneTimePreKeysJSON is the wire format of an one-time prekey upload
+type oneTimePreKeysJSON struct {
+	OneTimePreKeys []preKeyJSON `json:"one_time_pre_keys"`
+	Signature      []byte       `json:"signature"`
+}
+
+// oneTimePreKeyCountJSON is the wire format of the one-time prekey count
+type oneTimePreKeyCountJSON struct {
+	Count int `json:"count"`
+}
+
+// logKeyJSON is the wire format of the public log key
+type logKeyJSON struct {
+	Key []byte `json:"key"`
+}
+
+// consistencyProofJSON is the wire format of a consistency proof
+type consistencyProofJSON struct {
+	Hashes [][]byte `json:"hashes"`
+}
+
+// logEntriesJSON is the wire format of a range of log entries
+type logEntriesJSON struct {
+	Entries []LogEntry `json:"entries"`
+}
+
+// errorJSON is the wire format of an error response. Kinds names the errors of this package the error wraps,
+// see errorKinds.
+type errorJSON struct {
+	Error string   `json:"error"`
+	Kinds []string `json:"kinds,omitempty"`
+}
+
+// errorKinds are the errors of Server, which are sent along with an error response and mapped back by HTTPDirectory
+var errorKinds = []struct {
+	name string
+	err  error
+}{
+	{"unknown_peer", ErrUnknownPeer},
+	{"invalid_bundle", ErrInvalidBundle},
+	{"name_taken", ErrNameTaken},
+	{"invalid_signature", ErrInvalidSignature},
+	{"invalid_tree_size", ErrInvalidTreeSize},
+}
+
+// maxRequestBytes limits the size of the request bodies, a bundle with a batch of prekeys takes a few kilobytes
+const maxRequestBytes = 1 << 20
+
+// Handler returns the HTTP interface of the prekey directory:
+//
+//	PUT  /bundles/{user}                          registers user with a JSON encoded KeyBundleSending
+//	GET  /bundles/{user}                          returns the key bundle of user with at most one one-time prekey
+//	PUT  /bundles/{user}/signed-prekey            replaces the signed prekey of user, signed by its identity key
+//	POST /bundles/{user}/one-time-prekeys         adds one-time prekeys signed by the identity key to the pool of user
+//	GET  /bundles/{user}/one-time-prekeys/count   returns the number of one-time prekeys left
+//	GET  /log/key                                 returns the public key the tree heads are signed with
+//	GET  /log/tree-head                           returns the signed tree head of the transparency log
+//	GET  /log/inclusion/{user}?key=&tree_size=    returns the inclusion proof of the hex encoded identity key of user
+//	GET  /log/consistency?first=&second=          returns the consistency proof between two tree sizes
+//	GET  /log/entries?start=&end=                 returns the log entries in [start, end)
+//
+// Errors of Server are answered with a JSON body, which names the errors they wrap, so HTTPDirectory can map them back.
+// Request bodies are limited to maxRequestBytes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /bundles/{user}", s.handleUploadKeyBundle)
+	mux.HandleFunc("GET /bundles/{user}", s.handleGetKeyBundle)
+	mux.HandleFunc("PUT /bundles/{user}/signed-prekey", s.handleUploadSignedPreKey)
+	mux.HandleFunc("POST /bundles/{user}/one-time-prekeys", s.handleUploadOneTimePreKeys)
+	mux.HandleFunc("GET /bundles/{user}/one-time-prekeys/count", s.handleOneTimePreKeyCount)
+	mux.HandleFunc("GET /log/key", s.handleLogPublicKey)
+	mux.HandleFunc("GET /log/tree-head", s.handleTreeHead)
+	mux.HandleFunc("GET /log/inclusion/{user}", s.handleInclusionProof)
+	mux.HandleFunc("GET /log/consistency", s.handleConsistencyProof)
+	mux.HandleFunc("GET /log/entries", s.handleLogEntries)
+	return mux
+}
+
+func (s *Server) handleUploadKeyBundle(w http.ResponseWriter, r *http.Request) {
+	var bundle KeyBundleSending
+	if err := decodeJSON(w, r, &bundle); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if err := s.UploadKeyBundle(r.PathValue("user"), bundle); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetKeyBundle(w http.ResponseWriter, r *http.Request) {
+	bundle, err := s.GetKeyBundle(r.PathValue("user"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, bundle)
+}
+
+func (s *Server) handleUploadSignedPreKey(w http.ResponseWriter, r *http.Request) {
+	var in signedPreKeyJSON
+	if err := decodeJSON(w, r, &in); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	key, err := parsePublicKey(in.Key)
+	if err != nil {
+		writeServerError(w, fmt.Errorf("%w: %w", ErrInvalidBundle, err))
+		return
+	}
+	if err := s.UploadSignedPreKey(r.PathValue("user"), in.ID, key, in.Signature, in.UploadSignature); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleUploadOneTimePreKeys(w http.ResponseWriter, r *http.Request) {
+	var in oneTimePreKeysJSON
+	if err := decodeJSON(w, r, &in); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	keys, err := parsePreKeys(in.OneTimePreKeys)
+	if err != nil {
+		writeServerError(w, fmt.Errorf("%w: %w", ErrInvalidBundle, err))
+		return
+	}
+	if err := s.UploadOneTimePreKeys(r.PathValue("user"), keys, in.Signature); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleOneTimePreKeyCount(w http.ResponseWriter, r *http.Request) {
+	count, err := s.OneTimePreKeyCount(r.PathValue("user"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, oneTimePreKeyCountJSON{Count: count})
+}
+
+func (s *Server) handleLogPublicKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.LogPublicKey()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, logKeyJSON{Key: key.Bytes()})
+}
+
+func (s *Server) handleTreeHead(w http.ResponseWriter, r *http.Request) {
+	head, err := s.TreeHead()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, head)
+}
+
+func (s *Server) handleInclusionProof(w http.ResponseWriter, r *http.Request) {
+	keyBytes, err := hex.DecodeString(r.URL.Query().Get("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := ecdh.X25519().NewPublicKey(keyBytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	treeSize, err := strconv.ParseUint(r.URL.Query().Get("tree_size"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proof, err := s.InclusionProof(r.PathValue("user"), key, treeSize)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, proof)
+}
+
+func (s *Server) handleConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	first, second, err := parseTreeSizes(r, "first", "second")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hashes, err := s.ConsistencyProof(first, second)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, consistencyProofJSON{Hashes: hashes})
+}
+
+func (s *Server) handleLogEntries(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseTreeSizes(r, "start", "end")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := s.LogEntries(start, end)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, logEntriesJSON{Entries: entries})
+}
+
+// parseTreeSizes parses the two tree sizes in the query parameters a and b
+func parseTreeSizes(r *http.Request, a, b string) (uint64, uint64, error) {
+	first, err := strconv.ParseUint(r.URL.Query().Get(a), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	second, err := strconv.ParseUint(r.URL.Query().Get(b), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, second, nil
+}
+
+// decodeJSON decodes the request body of at most maxRequestBytes into v. A body, which can not be decoded, is an
+// invalid bundle, all request bodies carry keys.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeServerError responds with the status for err and names the errors of errorKinds it wraps in the body
+func writeServerError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	status := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &tooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnknownPeer):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNameTaken):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidBundle):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrInvalidTreeSize):
+		status = http.StatusUnprocessableEntity
+	}
+
+	out := errorJSON{Error: err.Error()}
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			out.Kinds = append(out.Kinds, kind.name)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,184 @@
+package x3dh
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestServerHandsOutEveryOneTimePreKeyOnce(t *testing.T) {
+	const opkNum = 50
+
+	bob, err := NewUser("bob", opkNum)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	server := newTestServer(t)
+	if err := server.UploadKeyBundle(bob.Name(), publishTestBundle(t, bob)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[string]int)
+	)
+	for range opkNum + 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bundle, err := server.GetKeyBundle("bob")
+			if err != nil {
+				t.Error("GetKeyBundle failed:", err.Error())
+				return
+			}
+			if len(bundle.OneTimePreKeys) > 1 {
+				t.Error("bundle contains more than one one-time prekey")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, opk := range bundle.OneTimePreKeys {
+				seen[string(opk.Key.Bytes())]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != opkNum {
+		t.Fatalf("expected %d distinct one-time prekeys, got %d", opkNum, len(seen))
+	}
+	for _, count := range seen {
+		if count != 1 {
+			t.Fatal("one-time prekey was handed out more than once")
+		}
+	}
+}
+
+func TestServerRejectsInvalidBundles(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	server := newTestServer(t)
+
+	bundle := publishTestBundle(t, bob)
+	bundle.SignedPreKeySigned = bytes.Clone(bundle.SignedPreKeySigned)
+	bundle.SignedPreKeySigned[0] ^= 0xff
+	if err := server.UploadKeyBundle("bob", bundle); err == nil {
+		t.Fatal("bundle with invalid signature should be rejected")
+	}
+
+	if _, err := server.GetKeyBundle("bob"); err == nil {
+		t.Fatal("unknown user should not have a bundle")
+	}
+}
+
+func TestServerHandshakeIntegration(t *testing.T) {
+	bobUser, bob := newTestUserClient(t, "bob", 2)
+	_, alice := newTestUserClient(t, "alice", 0)
+
+	server := newTestServer(t)
+	if err := server.UploadKeyBundle(bobUser.Name(), publishTestBundle(t, bobUser)); err != nil {
+		t.Fatal("UploadKeyBundle failed:", err.Error())
+	}
+
+	if err := alice.InitialHandshake(server, "bob"); err != nil {
+		t.Fatal("InitialHandshake failed:", err.Error())
+	}
+	if err := alice.GenerateSendSecretKey("bob"); err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+	hello, err := alice.BuildX3DHHello("bob", "Hello Bob")
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+	if _, err := alice.StartSession("bob", hello); err != nil {
+		t.Fatal("StartSession failed:", err.Error())
+	}
+
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	decryptTestMessage(t, bob, "alice", msg, "Hello Bob")
+}
+
+func TestServerHTTPIntegration(t *testing.T) {
+	bob, err := NewUser("bob", 2)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+
+	httpServer := httptest.NewServer(newTestServer(t).Handler())
+	defer httpServer.Close()
+
+	body, err := json.Marshal(publishTestBundle(t, bob))
+	if err != nil {
+		t.Fatal("Marshal failed:", err.Error())
+	}
+	req, err := http.NewRequest(http.MethodPut, httpServer.URL+"/bundles/bob", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("NewRequest failed:", err.Error())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("register request failed:", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal("unexpected status on register:", resp.Status)
+	}
+
+	published := publishTestBundle(t, bob)
+	for i := range 3 {
+		resp, err := http.Get(httpServer.URL + "/bundles/bob")
+		if err != nil {
+			t.Fatal("get request failed:", err.Error())
+		}
+		var bundle KeyBundleSending
+		err = json.NewDecoder(resp.Body).Decode(&bundle)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal("Decode failed:", err.Error())
+		}
+
+		if !bundle.IdentityKey.Equal(published.IdentityKey) || !bundle.SignedPreKey.Equal(published.SignedPreKey) {
+			t.Fatal("received bundle does not match the published bundle")
+		}
+		if i < 2 {
+			if len(bundle.OneTimePreKeys) != 1 || bundle.OneTimePreKeys[0].ID != published.OneTimePreKeys[i].ID || !bundle.OneTimePreKeys[0].Key.Equal(published.OneTimePreKeys[i].Key) {
+				t.Fatal("expected the next one-time prekey of the pool")
+			}
+		} else if len(bundle.OneTimePreKeys) != 0 || !bundle.LastResortPreKey.Equal(published.LastResortPreKey) {
+			t.Fatal("pool should be exhausted and the last-resort prekey handed out")
+		}
+	}
+
+	resp, err = http.Get(httpServer.URL + "/bundles/alice")
+	if err != nil {
+		t.Fatal("get request failed:", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("unexpected status for unknown user:", resp.Status)
+	}
+}
+
+func TestServerHTTPRejectsLargeBody(t *testing.T) {
+	httpServer := httptest.NewServer(newTestServer(t).Handler())
+	defer httpServer.Close()
+
+	body := bytes.NewReader(append([]byte(`{"identity_key":"`), bytes.Repeat([]byte{'A'}, maxRequestBytes)...))
+	req, err := http.NewRequest(http.MethodPut, httpServer.URL+"/bundles/bob", body)
+	if err != nil {
+		t.Fatal("NewRequest failed:", err.Error())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("register request failed:", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("unexpected status for a large body:", resp.Status)
+	}
+}
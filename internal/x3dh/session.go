@@ -0,0 +1,306 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io"
+	"signal/internal/doubleratchet"
+	"sync"
+)
+
+// Message is a Double Ratchet message sent over the wire.
+// Until the responder replied, the initiator attaches the X3DH hello to every message, like libsignal's PreKeySignalMessage,
+// so the responder can establish the session from whichever message arrives first.
+type Message struct {
+	Hello      *InitialMessage // nil once the peer replied
+	Header     *doubleratchet.MessageHeader
+	Ciphertext []byte
+}
+
+// Session is an established Double Ratchet session with a single peer.
+// Encrypt and Decrypt are serialized, so a send and a receive goroutine can share a session.
+// State must not be used directly while the session is in use.
+type Session struct {
+	PeerName       string
+	State          *doubleratchet.State
+	AssociatedData []byte          // associated data of every ratchet message, Encode(IK_A) || Encode(IK_B)
+	mu             sync.Mutex      // guards State and pendingHello
+	pendingHello   *InitialMessage // hello of the initiator, attached until the peer replied
+	store          SessionStore    // receives the session after every message, nil for a session which is not persisted
+}
+
+// save writes the session to its store, s.mu has to be held
+func (s *Session) save() error {
+	if s.store == nil {
+		return nil
+	}
+	record, err := s.marshal()
+	if err != nil {
+		return err
+	}
+	return s.store.StoreSession(s.PeerName, record)
+}
+
+// sessionTable holds the sessions of a client by peer name, it is safe for concurrent use.
+// With a store, sessions are written through to it and loaded from it on first use.
+type sessionTable struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	store    SessionStore
+	random   func() io.Reader // entropy source of loaded sessions
+}
+
+func newSessionTable(store SessionStore, random func() io.Reader) *sessionTable {
+	return &sessionTable{sessions: make(map[string]*Session), store: store, random: random}
+}
+
+func (t *sessionTable) get(peerName string) (*Session, bool, error) {
+	t.mu.RLock()
+	session, ok := t.sessions[peerName]
+	t.mu.RUnlock()
+	if ok || t.store == nil {
+		return session, ok, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if session, ok := t.sessions[peerName]; ok {
+		return session, true, nil
+	}
+	record, ok, err := t.store.LoadSession(peerName)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	session = &Session{State: &doubleratchet.State{Rand: t.random()}, store: t.store}
+	if err := session.UnmarshalBinary(record); err != nil {
+		return nil, false, err
+	}
+	t.sessions[peerName] = session
+	return session, true, nil
+}
+
+// put adds a new session and writes it to the store
+func (t *sessionTable) put(session *Session) error {
+	session.mu.Lock()
+	session.store = t.store
+	err := session.save()
+	session.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[session.PeerName] = session
+	return nil
+}
+
+// newInitiatorSession seeds RatchetInitAlice with the X3DH shared secret and the responder's signed prekey.
+func newInitiatorSession(random io.Reader, peerName string, secretKey []byte, signedPreKey *ecdh.PublicKey, hello *InitialMessage, peerIdentityKey *ecdh.PublicKey) (*Session, error) {
+	state, err := doubleratchet.RatchetInitAliceWithRandom(doubleratchet.DefaultSuite, random, secretKey, signedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := negotiateKEMRatchet(state, hello); err != nil {
+		return nil, err
+	}
+	return &Session{
+		PeerName:       peerName,
+		State:          state,
+		AssociatedData: associatedData(hello.IdentityKey, peerIdentityKey),
+		pendingHello:   hello,
+	}, nil
+}
+
+// newResponderSession seeds RatchetInitBob with the X3DH shared secret and the responder's signed prekey pair.
+func newResponderSession(random io.Reader, peerName string, secretKey []byte, signedPreKey *ecdh.PrivateKey, hello *InitialMessage, identityKey *ecdh.PublicKey) (*Session, error) {
+	state := doubleratchet.RatchetInitBob(secretKey, signedPreKey)
+	state.Rand = random
+	if err := negotiateKEMRatchet(state, hello); err != nil {
+		return nil, err
+	}
+	return &Session{
+		PeerName:       peerName,
+		State:          state,
+		AssociatedData: associatedData(hello.IdentityKey, identityKey),
+	}, nil
+}
+
+// negotiateKEMRatchet enables the KEM ratchet for sessions established with PQXDH.
+// Both parties know from the hello whether PQXDH was used, peers without PQ prekey keep the classic Double Ratchet.
+func negotiateKEMRatchet(state *doubleratchet.State, hello *InitialMessage) error {
+	if hello.PQCiphertext == nil {
+		return nil
+	}
+	return state.EnableKEMRatchet()
+}
+
+// Encrypt encrypts plaintext with the next sending message key.
+func (s *Session) Encrypt(plaintext []byte) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header, ciphertext, err := s.State.RatchetEncrypt(plaintext, s.AssociatedData)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Hello:      s.pendingHello,
+		Header:     header,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Decrypt decrypts a message of the peer. A successful decryption proves the peer established the session,
+// so the hello does not have to be attached anymore.
+func (s *Session) Decrypt(msg *Message) ([]byte, error) {
+	if msg == nil || msg.Header == nil {
+		return nil, fmt.Errorf("%w: incomplete message", ErrInvalidMessage)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, err := s.State.PrepareDecrypt(msg.Header, msg.Ciphertext, s.AssociatedData)
+	if err != nil {
+		return nil, err
+	}
+	// the state after the decryption is stored first, so a failed write leaves the message decryptable
+	if err := s.saveDecrypt(pending); err != nil {
+		pending.Discard()
+		return nil, err
+	}
+	if err := pending.Commit(); err != nil {
+		return nil, errors.Join(err, s.save())
+	}
+	s.pendingHello = nil
+	return pending.Plaintext, nil
+}
+
+// saveDecrypt writes the session as it is after pending is committed, s.mu has to be held
+func (s *Session) saveDecrypt(pending *doubleratchet.PendingDecrypt) error {
+	if s.store == nil {
+		return nil
+	}
+	state, err := pending.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	record, err := s.record(state, nil)
+	if err != nil {
+		return err
+	}
+	return s.store.StoreSession(s.PeerName, record)
+}
+
+// StartSession starts the Double Ratchet session with userName after BuildX3DHHello.
+// The hello is attached to all messages until userName replied.
+func (c *Client) StartSession(userName string, hello *InitialMessage) (*Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keyBundle, ok := c.keyBundles[userName]
+	if !ok {
+		return nil, fmt.Errorf("%w: no key bundle for %s", ErrUnknownPeer, userName)
+	}
+	if len(keyBundle.SecretKey) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoSecretKey, userName)
+	}
+
+	session, err := newInitiatorSession(c.random(), userName, keyBundle.SecretKey, keyBundle.SignedPreKey, hello, keyBundle.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sessions.put(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Session returns the established session with userName, a session of the user's store is loaded on first use.
+func (c *Client) Session(userName string) (*Session, bool, error) {
+	return c.sessions.get(userName)
+}
+
+// EncryptMessage encrypts plaintext for userName with the established session.
+// It fails with IdentityChanged while a key change of userName has not been acknowledged.
+func (c *Client) EncryptMessage(userName string, plaintext []byte) (*Message, error) {
+	if err := c.checkSendingAllowed(userName); err != nil {
+		return nil, err
+	}
+	session, ok, err := c.sessions.get(userName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: no session with %s", ErrUnknownPeer, userName)
+	}
+	return session.Encrypt(plaintext)
+}
+
+// DecryptMessage decrypts a message from userName.
+// If there is no session yet, it is established from the attached hello.
+// Messages of different peers are decrypted concurrently, sessions are established one at a time.
+// A hello with another identity key than the recorded one is still accepted, but raises IdentityChanged
+// through OnIdentityChanged and blocks sending until the change is acknowledged.
+func (c *Client) DecryptMessage(userName string, msg *Message) ([]byte, error) {
+	session, ok, err := c.sessions.get(userName)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return session.Decrypt(msg)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another message with the hello may have established the session in the meantime
+	if session, ok, err = c.sessions.get(userName); err != nil {
+		return nil, err
+	}
+	if ok {
+		return session.Decrypt(msg)
+	}
+
+	if msg == nil || msg.Hello == nil {
+		return nil, fmt.Errorf("%w: no session with %s", ErrUnknownPeer, userName)
+	}
+	if c.user == nil {
+		return nil, fmt.Errorf("%w to accept sessions", ErrNoUser)
+	}
+
+	// the one-time prekey is only deleted once the session is stored, so a tampered message does not use it up
+	sk, envelope, err := c.user.processHello(msg.Hello)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.From != userName || envelope.To != c.UserName {
+		return nil, fmt.Errorf("%w: hello was not sent from %s to %s", ErrInvalidMessage, userName, c.UserName)
+	}
+
+	signedPreKey, err := c.user.signedPreKeyByID(msg.Hello.SignedPreKeyID)
+	if err != nil {
+		return nil, err
+	}
+	session, err = newResponderSession(c.random(), userName, sk, signedPreKey, msg.Hello, c.user.IdentityKey.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := session.Decrypt(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkIdentity(userName, msg.Hello.IdentityKey); err != nil && !errors.Is(err, ErrIdentityChanged) {
+		return nil, err
+	}
+	if err := c.sessions.put(session); err != nil {
+		return nil, err
+	}
+	if err := c.user.consumePreKey(msg.Hello); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
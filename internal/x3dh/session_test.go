@@ -0,0 +1,146 @@
+package x3dh
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSessionIntegration(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 3)
+	startTestSession(t, alice, bobUser)
+
+	first := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	second := encryptTestMessage(t, alice, "bob", "Message in a Bottle :)")
+	if first.Hello == nil || second.Hello == nil {
+		t.Fatal("hello has to be attached until bob replied")
+	}
+
+	// the second message arrives first and establishes the session
+	decryptTestMessage(t, bob, "alice", second, "Message in a Bottle :)")
+	decryptTestMessage(t, bob, "alice", first, "Hello Bob")
+	if len(bobUser.OKPs) != 2 {
+		t.Fatal("one-time prekey has to be consumed exactly once, remaining:", len(bobUser.OKPs))
+	}
+
+	reply := encryptTestMessage(t, bob, "alice", "Hello Alice")
+	if reply.Hello != nil {
+		t.Fatal("responder must not attach a hello")
+	}
+	decryptTestMessage(t, alice, "bob", reply, "Hello Alice")
+
+	third := encryptTestMessage(t, alice, "bob", "Another Message in a Bottle :)")
+	if third.Hello != nil {
+		t.Fatal("hello must not be attached after bob replied")
+	}
+	decryptTestMessage(t, bob, "alice", third, "Another Message in a Bottle :)")
+}
+
+func TestSessionWrongSender(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	startTestSession(t, alice, bobUser)
+
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	if _, err := bob.DecryptMessage("mallory", msg); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatal("hello of alice must not establish a session with mallory, Actual:", err)
+	}
+	if _, ok, _ := bob.Session("mallory"); ok {
+		t.Fatal("session with mallory must not be stored")
+	}
+}
+
+func TestSessionWrongRecipient(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	prepareHandshake(t, alice, bobUser)
+	if err := alice.GenerateSendSecretKey("bob"); err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+
+	// a session with carol, which was established with the keys of bob
+	alice.keyBundles["carol"] = alice.keyBundles["bob"]
+	hello, err := alice.BuildX3DHHello("carol", "Hello Carol")
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+	if _, err := alice.StartSession("carol", hello); err != nil {
+		t.Fatal("StartSession failed:", err.Error())
+	}
+
+	msg := encryptTestMessage(t, alice, "carol", "Hello Carol")
+	if _, err := bob.DecryptMessage("alice", msg); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatal("hello to carol must not establish a session with bob, Actual:", err)
+	}
+	if _, ok, _ := bob.Session("alice"); ok {
+		t.Fatal("session with alice must not be stored")
+	}
+	if len(bobUser.OKPs) != 1 {
+		t.Fatal("one-time prekey must not be deleted by a misaddressed hello")
+	}
+}
+
+func TestSessionWithoutHello(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	startTestSession(t, alice, bobUser)
+
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	msg.Hello = nil
+	if _, err := bob.DecryptMessage("alice", msg); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatal("message without hello must not be decrypted without a session, Actual:", err)
+	}
+}
+
+func TestSessionDuplicateMessage(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	startTestSession(t, alice, bobUser)
+
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	decryptTestMessage(t, bob, "alice", msg, "Hello Bob")
+	if _, err := bob.DecryptMessage("alice", msg); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrDuplicateMessage, Actual:", err)
+	}
+	if _, err := alice.EncryptMessage("carol", []byte("Hello Carol")); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatal("Expected ErrUnknownPeer, Actual:", err)
+	}
+}
+
+func TestSessionIsNotReplacedByAnotherHello(t *testing.T) {
+	aliceUser, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 0)
+	startTestSession(t, alice, bobUser)
+	decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "Hello Bob"), "Hello Bob")
+
+	// another session of alice built against the last-resort prekey must not replace the live one
+	other := NewClientFromUser(aliceUser)
+	startTestSession(t, other, bobUser)
+	if _, err := bob.DecryptMessage("alice", encryptTestMessage(t, other, "bob", "Hello again")); !errors.Is(err, ErrAuthentication) {
+		t.Fatal("Expected ErrAuthentication for a hello of another session, Actual:", err)
+	}
+	decryptTestMessage(t, alice, "bob", encryptTestMessage(t, bob, "alice", "Hello Alice"), "Hello Alice")
+	decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "Still there"), "Still there")
+}
+
+func TestTamperedMessageKeepsOneTimePreKey(t *testing.T) {
+	_, alice := newTestUserClient(t, "alice", 0)
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	startTestSession(t, alice, bobUser)
+
+	msg := encryptTestMessage(t, alice, "bob", "Hello Bob")
+	tampered := *msg
+	tampered.Ciphertext = bytes.Clone(msg.Ciphertext)
+	tampered.Ciphertext[0] ^= 0x01
+	if _, err := bob.DecryptMessage("alice", &tampered); !errors.Is(err, ErrAuthentication) {
+		t.Fatal("Expected ErrAuthentication, Actual:", err)
+	}
+	if len(bobUser.OKPs) != 1 {
+		t.Fatal("A message, which does not decrypt, must not consume the one-time prekey")
+	}
+	decryptTestMessage(t, bob, "alice", msg, "Hello Bob")
+	if len(bobUser.OKPs) != 0 {
+		t.Fatal("The one-time prekey has to be consumed with the session, remaining:", len(bobUser.OKPs))
+	}
+}
@@ -0,0 +1,197 @@
+package x3dh
+
+import (
+	"cmp"
+	"crypto/ecdh"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The stores are modelled on libsignal's IdentityKeyStore, PreKeyStore, SignedPreKeyStore and SessionStore.
+// User writes every change of its private keys to them and Client writes every change of a session,
+// so a user restored with LoadUser continues where it left off. Implementations have to be safe for concurrent use.
+
+// LocalIdentity is the long-term key material of the local user: the identity key and the last-resort prekeys,
+// which are never deleted, and the next free one-time prekey ID, so IDs are not reused after a restart.
+type LocalIdentity struct {
+	UserName            string
+	IdentityKey         *ecdh.PrivateKey
+	LastResortPreKey    *ecdh.PrivateKey
+	PQPreKey            *mlkem768.PrivateKey
+	PQPreKeySigned      []byte
+	PQPreKeyID          uint32
+	NextOneTimePreKeyID uint32
+	SignedPreKeyPending bool   // the current signed prekey still has to be uploaded, see Client.RefreshSignedPreKey
+	BundleSequence      uint64 // sequence number of the last published bundle, see User.Publish
+	// IDs and signature of the one-time prekey batch, whose upload did not succeed yet, see Client.ReplenishOneTimePreKeys
+	PendingOneTimePreKeyIDs     []uint32
+	PendingOneTimePreKeysSigned []byte
+}
+
+// IdentityKeyStore holds the identity of the local user and, as TrustStore, the identity keys of its contacts.
+type IdentityKeyStore interface {
+	TrustStore
+	// LocalIdentity returns the identity of the local user, ok is false for an empty store.
+	LocalIdentity() (identity LocalIdentity, ok bool, err error)
+	SaveLocalIdentity(identity LocalIdentity) error
+}
+
+// PreKeyStore holds the private halves of the unused one-time prekeys by ID.
+type PreKeyStore interface {
+	LoadPreKey(id uint32) (key *ecdh.PrivateKey, ok bool, err error)
+	StorePreKey(id uint32, key *ecdh.PrivateKey) error
+	RemovePreKey(id uint32) error
+	// PreKeyIDs returns the IDs of all stored one-time prekeys in ascending order.
+	PreKeyIDs() ([]uint32, error)
+}
+
+// SignedPreKeyRecord is a signed prekey with its signature, the current one and the retired ones within the grace period.
+type SignedPreKeyRecord struct {
+	ID        uint32
+	Key       *ecdh.PrivateKey
+	Signature []byte    // SIG(IK_s, SPK_p)
+	CreatedAt time.Time // time the SPK was generated
+	RetiredAt time.Time // time the SPK was replaced by a rotation, zero for the current SPK
+}
+
+// SignedPreKeyStore holds the current and the retired signed prekeys by ID.
+type SignedPreKeyStore interface {
+	LoadSignedPreKey(id uint32) (record SignedPreKeyRecord, ok bool, err error)
+	StoreSignedPreKey(record SignedPreKeyRecord) error
+	RemoveSignedPreKey(id uint32) error
+	// SignedPreKeys returns all stored signed prekeys in ascending order of their IDs.
+	SignedPreKeys() ([]SignedPreKeyRecord, error)
+}
+
+// SessionStore holds the encoded sessions by peer name, see Session.MarshalBinary.
+type SessionStore interface {
+	LoadSession(peerName string) (record []byte, ok bool, err error)
+	StoreSession(peerName string, record []byte) error
+	DeleteSession(peerName string) error
+}
+
+// ProtocolStore combines the stores of a user, like libsignal's SignalProtocolStore.
+// MemoryStore keeps everything in memory and EncryptedFileStore persists it in an encrypted file.
+type ProtocolStore interface {
+	IdentityKeyStore
+	PreKeyStore
+	SignedPreKeyStore
+	SessionStore
+}
+
+// MemoryStore is an in-memory ProtocolStore. It is the default store of NewUser.
+type MemoryStore struct {
+	*MemoryTrustStore
+	mu            sync.Mutex
+	local         *LocalIdentity
+	preKeys       map[uint32]*ecdh.PrivateKey
+	signedPreKeys map[uint32]SignedPreKeyRecord
+	sessions      map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		MemoryTrustStore: NewMemoryTrustStore(),
+		preKeys:          make(map[uint32]*ecdh.PrivateKey),
+		signedPreKeys:    make(map[uint32]SignedPreKeyRecord),
+		sessions:         make(map[string][]byte),
+	}
+}
+
+func (m *MemoryStore) LocalIdentity() (LocalIdentity, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.local == nil {
+		return LocalIdentity{}, false, nil
+	}
+	return *m.local, true, nil
+}
+
+func (m *MemoryStore) SaveLocalIdentity(identity LocalIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.local = &identity
+	return nil
+}
+
+func (m *MemoryStore) LoadPreKey(id uint32) (*ecdh.PrivateKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.preKeys[id]
+	return key, ok, nil
+}
+
+func (m *MemoryStore) StorePreKey(id uint32, key *ecdh.PrivateKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.preKeys[id] = key
+	return nil
+}
+
+func (m *MemoryStore) RemovePreKey(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.preKeys, id)
+	return nil
+}
+
+func (m *MemoryStore) PreKeyIDs() ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Sorted(maps.Keys(m.preKeys)), nil
+}
+
+func (m *MemoryStore) LoadSignedPreKey(id uint32) (SignedPreKeyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.signedPreKeys[id]
+	return record, ok, nil
+}
+
+func (m *MemoryStore) StoreSignedPreKey(record SignedPreKeyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signedPreKeys[record.ID] = record
+	return nil
+}
+
+func (m *MemoryStore) RemoveSignedPreKey(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.signedPreKeys, id)
+	return nil
+}
+
+func (m *MemoryStore) SignedPreKeys() ([]SignedPreKeyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := slices.Collect(maps.Values(m.signedPreKeys))
+	slices.SortFunc(records, func(a, b SignedPreKeyRecord) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return records, nil
+}
+
+func (m *MemoryStore) LoadSession(peerName string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.sessions[peerName]
+	return record, ok, nil
+}
+
+func (m *MemoryStore) StoreSession(peerName string, record []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[peerName] = record
+	return nil
+}
+
+func (m *MemoryStore) DeleteSession(peerName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, peerName)
+	return nil
+}
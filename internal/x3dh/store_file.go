@@ -0,0 +1,328 @@
+package x3dh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+// StoreKeySize is the size of the key an EncryptedFileStore is encrypted with
+const StoreKeySize = 32
+
+// storeFileAD binds the ciphertext to the file format, so a file of another format can not be passed off as a store
+var storeFileAD = []byte("signal x3dh protocol store v1")
+
+// EncryptedFileStore is a ProtocolStore persisted in a file, which is encrypted with AES-256-GCM.
+// Every change is written to the file before the call returns. The whole store is rewritten on every change,
+// which is fine for the number of sessions and prekeys of a single user.
+type EncryptedFileStore struct {
+	mu     sync.Mutex
+	path   string
+	aead   cipher.AEAD
+	memory *MemoryStore
+}
+
+// storeFileJSON is the plaintext of the store file
+type storeFileJSON struct {
+	Local         *localIdentityJSON             `json:"local,omitempty"`
+	Identities    map[string]trustedIdentityJSON `json:"identities"`
+	PreKeys       map[uint32][]byte              `json:"pre_keys"`
+	SignedPreKeys []signedPreKeyRecordJSON       `json:"signed_pre_keys"`
+	Sessions      map[string][]byte              `json:"sessions"`
+}
+
+// localIdentityJSON is the file format of LocalIdentity, private keys are encoded as raw bytes
+type localIdentityJSON struct {
+	UserName            string `json:"user_name"`
+	IdentityKey         []byte `json:"identity_key"`
+	LastResortPreKey    []byte `json:"last_resort_pre_key,omitempty"`
+	PQPreKey            []byte `json:"pq_pre_key,omitempty"`
+	PQPreKeySigned      []byte `json:"pq_pre_key_signed,omitempty"`
+	PQPreKeyID          uint32 `json:"pq_pre_key_id"`
+	NextOneTimePreKeyID uint32 `json:"next_one_time_pre_key_id"`
+	SignedPreKeyPending bool   `json:"signed_pre_key_pending,omitempty"`
+	BundleSequence      uint64 `json:"bundle_sequence,omitempty"`
+
+	PendingOneTimePreKeyIDs     []uint32 `json:"pending_one_time_pre_key_ids,omitempty"`
+	PendingOneTimePreKeysSigned []byte   `json:"pending_one_time_pre_keys_signed,omitempty"`
+}
+
+// signedPreKeyRecordJSON is the file format of SignedPreKeyRecord
+type signedPreKeyRecordJSON struct {
+	ID        uint32    `json:"id"`
+	Key       []byte    `json:"key"`
+	Signature []byte    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+	RetiredAt time.Time `json:"retired_at"`
+}
+
+// OpenEncryptedFileStore loads the store at path, which is encrypted with key. A missing file is treated as an empty store.
+// The key has to be StoreKeySize random bytes, e.g. derived from a passphrase or kept in the key chain of the platform.
+// A wrong key or a modified file fails with ErrAuthentication.
+func OpenEncryptedFileStore(path string, key []byte) (*EncryptedFileStore, error) {
+	if len(key) != StoreKeySize {
+		return nil, fmt.Errorf("%w: store key has to be %d bytes, got %d", ErrInvalidKey, StoreKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	f := &EncryptedFileStore{
+		path:   path,
+		aead:   aead,
+		memory: NewMemoryStore(),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated store file", ErrAuthentication)
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], storeFileAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: store file", ErrAuthentication)
+	}
+
+	var file storeFileJSON
+	if err := json.Unmarshal(plaintext, &file); err != nil {
+		return nil, err
+	}
+	if err := f.memory.restore(file); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// restore fills the empty store m with the content of a store file
+func (m *MemoryStore) restore(file storeFileJSON) error {
+	var err error
+	if file.Local != nil {
+		local := LocalIdentity{
+			UserName:            file.Local.UserName,
+			PQPreKeySigned:      file.Local.PQPreKeySigned,
+			PQPreKeyID:          file.Local.PQPreKeyID,
+			NextOneTimePreKeyID: file.Local.NextOneTimePreKeyID,
+			SignedPreKeyPending: file.Local.SignedPreKeyPending,
+			BundleSequence:      file.Local.BundleSequence,
+
+			PendingOneTimePreKeyIDs:     file.Local.PendingOneTimePreKeyIDs,
+			PendingOneTimePreKeysSigned: file.Local.PendingOneTimePreKeysSigned,
+		}
+		if local.IdentityKey, err = parsePrivateKey(file.Local.IdentityKey); err != nil {
+			return err
+		}
+		if local.LastResortPreKey, err = parsePrivateKey(file.Local.LastResortPreKey); err != nil {
+			return err
+		}
+		if len(file.Local.PQPreKey) != 0 {
+			local.PQPreKey = &mlkem768.PrivateKey{}
+			if err := local.PQPreKey.Unpack(file.Local.PQPreKey); err != nil {
+				return err
+			}
+		}
+		m.local = &local
+	}
+	if m.identities, err = parseTrustedIdentities(file.Identities); err != nil {
+		return err
+	}
+	for id, data := range file.PreKeys {
+		if m.preKeys[id], err = parsePrivateKey(data); err != nil {
+			return err
+		}
+	}
+	for _, in := range file.SignedPreKeys {
+		record := SignedPreKeyRecord{ID: in.ID, Signature: in.Signature, CreatedAt: in.CreatedAt, RetiredAt: in.RetiredAt}
+		if record.Key, err = parsePrivateKey(in.Key); err != nil {
+			return err
+		}
+		m.signedPreKeys[record.ID] = record
+	}
+	for peerName, record := range file.Sessions {
+		m.sessions[peerName] = record
+	}
+	return nil
+}
+
+// file returns the content of m for the store file
+func (m *MemoryStore) file() storeFileJSON {
+	m.MemoryTrustStore.mu.Lock()
+	identities := trustedIdentitiesJSON(m.identities)
+	m.MemoryTrustStore.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file := storeFileJSON{
+		Identities: identities,
+		PreKeys:    make(map[uint32][]byte, len(m.preKeys)),
+		Sessions:   make(map[string][]byte, len(m.sessions)),
+	}
+	if m.local != nil {
+		file.Local = &localIdentityJSON{
+			UserName:            m.local.UserName,
+			IdentityKey:         privateKeyBytes(m.local.IdentityKey),
+			LastResortPreKey:    privateKeyBytes(m.local.LastResortPreKey),
+			PQPreKeySigned:      m.local.PQPreKeySigned,
+			PQPreKeyID:          m.local.PQPreKeyID,
+			NextOneTimePreKeyID: m.local.NextOneTimePreKeyID,
+			SignedPreKeyPending: m.local.SignedPreKeyPending,
+			BundleSequence:      m.local.BundleSequence,
+
+			PendingOneTimePreKeyIDs:     m.local.PendingOneTimePreKeyIDs,
+			PendingOneTimePreKeysSigned: m.local.PendingOneTimePreKeysSigned,
+		}
+		if m.local.PQPreKey != nil {
+			file.Local.PQPreKey = make([]byte, mlkem768.PrivateKeySize)
+			m.local.PQPreKey.Pack(file.Local.PQPreKey)
+		}
+	}
+	for id, key := range m.preKeys {
+		file.PreKeys[id] = key.Bytes()
+	}
+	for _, record := range m.signedPreKeys {
+		file.SignedPreKeys = append(file.SignedPreKeys, signedPreKeyRecordJSON{
+			ID:        record.ID,
+			Key:       privateKeyBytes(record.Key),
+			Signature: record.Signature,
+			CreatedAt: record.CreatedAt,
+			RetiredAt: record.RetiredAt,
+		})
+	}
+	for peerName, record := range m.sessions {
+		file.Sessions[peerName] = record
+	}
+	return file
+}
+
+// clone returns a copy of m. The maps are copied, their values are shared, the store only ever replaces them.
+func (m *MemoryStore) clone() *MemoryStore {
+	m.MemoryTrustStore.mu.Lock()
+	identities := maps.Clone(m.identities)
+	m.MemoryTrustStore.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &MemoryStore{
+		MemoryTrustStore: &MemoryTrustStore{identities: identities},
+		local:            m.local,
+		preKeys:          maps.Clone(m.preKeys),
+		signedPreKeys:    maps.Clone(m.signedPreKeys),
+		sessions:         maps.Clone(m.sessions),
+	}
+}
+
+// replace sets the content of m to the content of next, which must not be used afterwards
+func (m *MemoryStore) replace(next *MemoryStore) {
+	m.MemoryTrustStore.mu.Lock()
+	m.identities = next.identities
+	m.MemoryTrustStore.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.local, m.preKeys, m.signedPreKeys, m.sessions = next.local, next.preKeys, next.signedPreKeys, next.sessions
+}
+
+// update applies change to a copy of the memory store and writes the store file. The memory store is only replaced
+// by the copy once the file has been written, so a failed write leaves both unchanged. f.mu serializes the writes,
+// so the file never goes back to an older state.
+func (f *EncryptedFileStore) update(change func(next *MemoryStore) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := f.memory.clone()
+	if err := change(next); err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(next.file())
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.path, f.aead.Seal(nonce, nonce, plaintext, storeFileAD)); err != nil {
+		return err
+	}
+	f.memory.replace(next)
+	return nil
+}
+
+func (f *EncryptedFileStore) Identity(userName string) (TrustedIdentity, bool, error) {
+	return f.memory.Identity(userName)
+}
+
+func (f *EncryptedFileStore) SaveIdentity(userName string, identity TrustedIdentity) error {
+	return f.update(func(next *MemoryStore) error { return next.SaveIdentity(userName, identity) })
+}
+
+func (f *EncryptedFileStore) LocalIdentity() (LocalIdentity, bool, error) {
+	return f.memory.LocalIdentity()
+}
+
+func (f *EncryptedFileStore) SaveLocalIdentity(identity LocalIdentity) error {
+	return f.update(func(next *MemoryStore) error { return next.SaveLocalIdentity(identity) })
+}
+
+func (f *EncryptedFileStore) LoadPreKey(id uint32) (*ecdh.PrivateKey, bool, error) {
+	return f.memory.LoadPreKey(id)
+}
+
+func (f *EncryptedFileStore) StorePreKey(id uint32, key *ecdh.PrivateKey) error {
+	return f.update(func(next *MemoryStore) error { return next.StorePreKey(id, key) })
+}
+
+func (f *EncryptedFileStore) RemovePreKey(id uint32) error {
+	return f.update(func(next *MemoryStore) error { return next.RemovePreKey(id) })
+}
+
+func (f *EncryptedFileStore) PreKeyIDs() ([]uint32, error) {
+	return f.memory.PreKeyIDs()
+}
+
+func (f *EncryptedFileStore) LoadSignedPreKey(id uint32) (SignedPreKeyRecord, bool, error) {
+	return f.memory.LoadSignedPreKey(id)
+}
+
+func (f *EncryptedFileStore) StoreSignedPreKey(record SignedPreKeyRecord) error {
+	return f.update(func(next *MemoryStore) error { return next.StoreSignedPreKey(record) })
+}
+
+func (f *EncryptedFileStore) RemoveSignedPreKey(id uint32) error {
+	return f.update(func(next *MemoryStore) error { return next.RemoveSignedPreKey(id) })
+}
+
+func (f *EncryptedFileStore) SignedPreKeys() ([]SignedPreKeyRecord, error) {
+	return f.memory.SignedPreKeys()
+}
+
+func (f *EncryptedFileStore) LoadSession(peerName string) ([]byte, bool, error) {
+	return f.memory.LoadSession(peerName)
+}
+
+func (f *EncryptedFileStore) StoreSession(peerName string, record []byte) error {
+	return f.update(func(next *MemoryStore) error { return next.StoreSession(peerName, record) })
+}
+
+func (f *EncryptedFileStore) DeleteSession(peerName string) error {
+	return f.update(func(next *MemoryStore) error { return next.DeleteSession(peerName) })
+}
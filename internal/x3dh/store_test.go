@@ -0,0 +1,187 @@
+package x3dh
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedFileStorePersistsUserAndSessions(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0x42}, StoreKeySize)
+	alicePath, bobPath := filepath.Join(dir, "alice.store"), filepath.Join(dir, "bob.store")
+
+	aliceUser, err := NewUserWithStore("alice", 0, openTestStore(t, alicePath, key), nil)
+	if err != nil {
+		t.Fatal("NewUserWithStore failed:", err.Error())
+	}
+	alice := NewClientFromUser(aliceUser)
+	bobStore := openTestStore(t, bobPath, key)
+	bobUser, err := NewUserWithStore("bob", 2, bobStore, nil)
+	if err != nil {
+		t.Fatal("NewUserWithStore failed:", err.Error())
+	}
+	if _, err := NewUserWithStore("bob", 2, bobStore, nil); !errors.Is(err, ErrStoreInUse) {
+		t.Fatal("Expected ErrStoreInUse, Actual:", err)
+	}
+	if err := bobUser.RotateSignedPreKey(); err != nil {
+		t.Fatal("RotateSignedPreKey failed:", err.Error())
+	}
+	startTestSession(t, alice, bobUser)
+	first := encryptTestMessage(t, alice, "bob", "Hello Bob")
+
+	// alice restarts before bob replied, so the hello is still attached
+	_, alice = restartTestUser(t, alicePath, key)
+	second := encryptTestMessage(t, alice, "bob", "Are you there?")
+	if second.Hello == nil || !second.Hello.EphemeralKey.Equal(first.Hello.EphemeralKey) {
+		t.Fatal("The pending hello has to survive a restart")
+	}
+
+	bob := NewClientFromUser(bobUser)
+	decryptTestMessage(t, bob, "alice", first, "Hello Bob")
+	decryptTestMessage(t, alice, "bob", encryptTestMessage(t, bob, "alice", "Hello Alice"), "Hello Alice")
+
+	restoredUser, bob := restartTestUser(t, bobPath, key)
+	if restoredUser.Name() != "bob" || !restoredUser.IdentityKey.Equal(bobUser.IdentityKey) {
+		t.Fatal("The identity key has to survive a restart")
+	}
+	if restoredUser.SignedPreKeyID != bobUser.SignedPreKeyID || len(restoredUser.retiredPreKeys) != 1 {
+		t.Fatal("Expected the current and the retired signed prekey, Actual ID:", restoredUser.SignedPreKeyID)
+	}
+	if len(restoredUser.OKPs) != 1 {
+		t.Fatal("The consumed one-time prekey must not come back, remaining:", len(restoredUser.OKPs))
+	}
+	if _, ok, _ := bob.Trust.Identity("alice"); !ok {
+		t.Fatal("The identity key of alice has to survive a restart")
+	}
+	preKeys, err := restoredUser.GenerateOneTimePreKeys(1)
+	if err != nil {
+		t.Fatal("GenerateOneTimePreKeys failed:", err.Error())
+	}
+	if preKeys[0].ID != 3 {
+		t.Fatal("One-time prekey IDs must not be reused after a restart, Actual:", preKeys[0].ID)
+	}
+
+	decryptTestMessage(t, bob, "alice", second, "Are you there?")
+	decryptTestMessage(t, alice, "bob", encryptTestMessage(t, bob, "alice", "Still here"), "Still here")
+	if _, err := bob.DecryptMessage("alice", first); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrDuplicateMessage for a message decrypted before the restart, Actual:", err)
+	}
+}
+
+func TestEncryptedFileStoreRejectsWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bob.store")
+	key := bytes.Repeat([]byte{0x42}, StoreKeySize)
+	if _, err := NewUserWithStore("bob", 1, openTestStore(t, path, key), nil); err != nil {
+		t.Fatal("NewUserWithStore failed:", err.Error())
+	}
+
+	if _, err := OpenEncryptedFileStore(path, bytes.Repeat([]byte{0x43}, StoreKeySize)); !errors.Is(err, ErrAuthentication) {
+		t.Fatal("Expected ErrAuthentication for a wrong key, Actual:", err)
+	}
+	if _, err := OpenEncryptedFileStore(path, key[:16]); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey for a key of the wrong size, Actual:", err)
+	}
+	if _, err := LoadUser(openTestStore(t, filepath.Join(t.TempDir(), "empty.store"), key)); !errors.Is(err, ErrNoUser) {
+		t.Fatal("Expected ErrNoUser for an empty store, Actual:", err)
+	}
+}
+
+func TestEncryptedFileStoreFailedWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	path, key := filepath.Join(dir, "bob.store"), bytes.Repeat([]byte{0x42}, StoreKeySize)
+	store := openTestStore(t, path, key)
+	if err := store.StoreSession("alice", []byte("first")); err != nil {
+		t.Fatal("StoreSession failed:", err.Error())
+	}
+
+	// the directory of the store is replaced by a file, so the store file can not be written
+	if err := os.Rename(dir, dir+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreSession("alice", []byte("second")); err == nil {
+		t.Fatal("StoreSession has to fail if the file can not be written")
+	}
+	if err := store.RemovePreKey(1); err == nil {
+		t.Fatal("RemovePreKey has to fail if the file can not be written")
+	}
+	if record, _, _ := store.LoadSession("alice"); string(record) != "first" {
+		t.Fatal("A failed write must not change the store, Actual:", string(record))
+	}
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir+".moved", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreSession("bob", []byte("other")); err != nil {
+		t.Fatal("StoreSession failed:", err.Error())
+	}
+	reopened := openTestStore(t, path, key)
+	if record, _, _ := reopened.LoadSession("alice"); string(record) != "first" {
+		t.Fatal("The failed write must not reach the file with a later write, Actual:", string(record))
+	}
+}
+
+func TestMemoryStoreRestartedClient(t *testing.T) {
+	bobUser, bob := newTestUserClient(t, "bob", 1)
+	_, alice := newTestUserClient(t, "alice", 0)
+	startTestSession(t, alice, bobUser)
+	decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "Hello Bob"), "Hello Bob")
+
+	// a restarted client of bob continues the session from the store
+	other := NewClientFromUser(bobUser)
+	decryptTestMessage(t, other, "alice", encryptTestMessage(t, alice, "bob", "Hello again"), "Hello again")
+	if ids, _ := bobUser.store.PreKeyIDs(); len(ids) != 0 {
+		t.Fatal("The consumed one-time prekey has to be removed from the store, remaining:", len(ids))
+	}
+}
+
+var errDiskFull = errors.New("disk full")
+
+// failingStore is a ProtocolStore, whose session writes fail while full is set
+type failingStore struct {
+	ProtocolStore
+	full bool
+}
+
+func (f *failingStore) StoreSession(peerName string, record []byte) error {
+	if f.full {
+		return errDiskFull
+	}
+	return f.ProtocolStore.StoreSession(peerName, record)
+}
+
+func TestSessionDecryptSurvivesFailedWrite(t *testing.T) {
+	store := &failingStore{ProtocolStore: NewMemoryStore()}
+	bobUser, err := NewUserWithStore("bob", 1, store, nil)
+	if err != nil {
+		t.Fatal("NewUserWithStore failed:", err.Error())
+	}
+	bob := NewClientFromUser(bobUser)
+	_, alice := newTestUserClient(t, "alice", 0)
+	startTestSession(t, alice, bobUser)
+	decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "Hello Bob"), "Hello Bob")
+
+	second := encryptTestMessage(t, alice, "bob", "Are you there?")
+	store.full = true
+	if _, err := bob.DecryptMessage("alice", second); !errors.Is(err, errDiskFull) {
+		t.Fatal("Expected the error of the store, Actual:", err)
+	}
+	store.full = false
+	decryptTestMessage(t, bob, "alice", second, "Are you there?")
+
+	// the stored session is the one after the second message
+	if _, err := NewClientFromUser(bobUser).DecryptMessage("alice", second); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatal("Expected ErrDuplicateMessage from the stored session, Actual:", err)
+	}
+}
@@ -0,0 +1,376 @@
+package x3dh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"signal/internal/xeddsa"
+	"slices"
+	"time"
+)
+
+// treeHeadContext separates tree head signatures from the other signatures of the log key
+const treeHeadContext = "signal x3dh key transparency tree head v1"
+
+// LogEntry is a publication of an identity key recorded by the key transparency log of the prekey server.
+type LogEntry struct {
+	UserName    string
+	IdentityKey *ecdh.PublicKey
+	Timestamp   time.Time
+}
+
+// MarshalBinary encodes the leaf of the entry as user name prefixed with its length as unsigned varint,
+// Encode(IK) and the timestamp in nanoseconds since the Unix epoch as big-endian int64.
+func (e LogEntry) MarshalBinary() ([]byte, error) {
+	if e.IdentityKey == nil {
+		return nil, fmt.Errorf("%w: log entry without identity key", ErrInvalidBundle)
+	}
+	b := binary.AppendUvarint(nil, uint64(len(e.UserName)))
+	b = append(b, e.UserName...)
+	b = append(b, EncodePublicKey(e.IdentityKey)...)
+	return binary.BigEndian.AppendUint64(b, uint64(e.Timestamp.UnixNano())), nil
+}
+
+// SignedTreeHead is the root of the log at Size entries, signed by the log key of the server.
+type SignedTreeHead struct {
+	Size      uint64    `json:"size"`
+	RootHash  []byte    `json:"root_hash"`
+	Timestamp time.Time `json:"timestamp"`
+	Signature []byte    `json:"signature"` // XEdDSA signature of the log key
+}
+
+// signedMessage returns context || size || timestamp || root hash, sizes and timestamps as big-endian uint64
+func (h *SignedTreeHead) signedMessage() []byte {
+	b := []byte(treeHeadContext)
+	b = binary.BigEndian.AppendUint64(b, h.Size)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Timestamp.UnixNano()))
+	return append(b, h.RootHash...)
+}
+
+// Verify checks the signature of the tree head under the log key.
+func (h *SignedTreeHead) Verify(logKey *ecdh.PublicKey) bool {
+	return logKey != nil && len(h.RootHash) == 32 && xeddsa.Verify(logKey, h.signedMessage(), h.Signature)
+}
+
+// InclusionProof proves that Entry is the leaf at Index of the tree of TreeSize entries and the latest entry of its user.
+// The audit path of the leaf in the tree of Index+1 entries holds the roots of the subtrees of all earlier entries,
+// the later entries are sent along, so the client can rebuild the root and check that none of them replaced the key.
+type InclusionProof struct {
+	Entry    LogEntry   `json:"entry"`
+	Index    uint64     `json:"index"`
+	TreeSize uint64     `json:"tree_size"`
+	Hashes   [][]byte   `json:"hashes"` // audit path from the leaf to the root of the tree of Index+1 entries
+	Later    []LogEntry `json:"later"`  // the entries after Index up to TreeSize
+}
+
+// TransparencyLog is the append-only log of all identity key publications of a prekey directory.
+// Clients check every fetched bundle against it and owners monitor it for keys they never published.
+// Server, HTTPDirectory and FileDirectory implement it.
+type TransparencyLog interface {
+	// LogPublicKey returns the key the tree heads are signed with.
+	LogPublicKey() (*ecdh.PublicKey, error)
+	// TreeHead returns the signed head of the current tree.
+	TreeHead() (SignedTreeHead, error)
+	// InclusionProof proves that identityKey is the latest entry of userName in the tree of treeSize entries.
+	InclusionProof(userName string, identityKey *ecdh.PublicKey, treeSize uint64) (InclusionProof, error)
+	// ConsistencyProof proves that the tree of first entries is a prefix of the tree of second entries.
+	ConsistencyProof(first, second uint64) ([][]byte, error)
+	// LogEntries returns the entries from start up to, but not including, end.
+	LogEntries(start, end uint64) ([]LogEntry, error)
+}
+
+// UnauthorizedPublication is returned by Client.MonitorLog if the log contains identity keys for the user name
+// of the client, which are not its own. Someone published keys in its name, e.g. a compromised server. It wraps
+// ErrUnauthorizedPublication.
+type UnauthorizedPublication struct {
+	UserName string
+	Entries  []LogEntry
+}
+
+func (e *UnauthorizedPublication) Error() string {
+	return fmt.Sprintf("%s: %d identity keys published for %s", ErrUnauthorizedPublication.Error(), len(e.Entries), e.UserName)
+}
+
+func (e *UnauthorizedPublication) Unwrap() error {
+	return ErrUnauthorizedPublication
+}
+
+// keyLog is the transparency log of a Server, guarded by the mutex of the server
+type keyLog struct {
+	key     *ecdh.PrivateKey
+	entries []LogEntry
+	hashes  [][]byte // leaf hashes of entries
+	head    SignedTreeHead
+}
+
+// newKeyLog returns an empty log with a new log key
+func newKeyLog() (*keyLog, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	l := &keyLog{key: key}
+	if err := l.sign(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// restoreKeyLog rebuilds the log of a persisted server. The stored tree head is kept if it matches the entries.
+func restoreKeyLog(key *ecdh.PrivateKey, entries []LogEntry, head SignedTreeHead) (*keyLog, error) {
+	l := &keyLog{key: key}
+	for _, entry := range entries {
+		if err := l.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	if head.Size == uint64(len(entries)) && head.Verify(key.PublicKey()) && bytes.Equal(head.RootHash, rootHash(l.hashes)) {
+		l.head = head
+		return l, nil
+	}
+	return l, l.sign(time.Now())
+}
+
+func (l *keyLog) add(entry LogEntry) error {
+	leaf, err := entry.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entry)
+	l.hashes = append(l.hashes, leafHash(leaf))
+	return nil
+}
+
+// append records entry and signs the new tree head
+func (l *keyLog) append(entry LogEntry) error {
+	if err := l.add(entry); err != nil {
+		return err
+	}
+	return l.sign(entry.Timestamp)
+}
+
+func (l *keyLog) sign(now time.Time) error {
+	head := SignedTreeHead{
+		Size:      uint64(len(l.entries)),
+		RootHash:  rootHash(l.hashes),
+		Timestamp: now,
+	}
+	signature, err := xeddsa.Sign(l.key, head.signedMessage())
+	if err != nil {
+		return err
+	}
+	head.Signature = signature
+	l.head = head
+	return nil
+}
+
+func (l *keyLog) checkTreeSize(size uint64) error {
+	if size > uint64(len(l.entries)) {
+		return fmt.Errorf("%w: %d, the log has %d entries", ErrInvalidTreeSize, size, len(l.entries))
+	}
+	return nil
+}
+
+func (s *Server) LogPublicKey() (*ecdh.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.key.PublicKey(), nil
+}
+
+func (s *Server) TreeHead() (SignedTreeHead, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.head, nil
+}
+
+func (s *Server) InclusionProof(userName string, identityKey *ecdh.PublicKey, treeSize uint64) (InclusionProof, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.log.checkTreeSize(treeSize); err != nil {
+		return InclusionProof{}, err
+	}
+	for i := int(treeSize) - 1; i >= 0; i-- {
+		entry := s.log.entries[i]
+		if entry.UserName != userName {
+			continue
+		}
+		if !entry.IdentityKey.Equal(identityKey) {
+			return InclusionProof{}, fmt.Errorf("%w: identity key of %s has been replaced in the log", ErrUnknownPeer, userName)
+		}
+		return InclusionProof{
+			Entry:    entry,
+			Index:    uint64(i),
+			TreeSize: treeSize,
+			Hashes:   inclusionPath(s.log.hashes[:i+1], i),
+			Later:    slices.Clone(s.log.entries[i+1 : treeSize]),
+		}, nil
+	}
+	return InclusionProof{}, fmt.Errorf("%w: identity key of %s is not in the log", ErrUnknownPeer, userName)
+}
+
+func (s *Server) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.log.checkTreeSize(second); err != nil {
+		return nil, err
+	}
+	if first > second {
+		return nil, fmt.Errorf("%w: %d is larger than %d", ErrInvalidTreeSize, first, second)
+	}
+	return consistencyPath(s.log.hashes[:second], int(first)), nil
+}
+
+func (s *Server) LogEntries(start, end uint64) ([]LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.log.checkTreeSize(end); err != nil {
+		return nil, err
+	}
+	if start > end {
+		return nil, fmt.Errorf("%w: %d is larger than %d", ErrInvalidTreeSize, start, end)
+	}
+	return slices.Clone(s.log.entries[start:end]), nil
+}
+
+// updateTreeHead fetches the current tree head of log, checks its signature under the pinned log key
+// and that the log only grew since the last verified head. c.logMu has to be held.
+func (c *Client) updateTreeHead(log TransparencyLog) (SignedTreeHead, error) {
+	if c.LogKey == nil {
+		// trust the log key on first use, like the identity keys of contacts
+		key, err := log.LogPublicKey()
+		if err != nil {
+			return SignedTreeHead{}, err
+		}
+		c.LogKey = key
+	}
+
+	head, err := log.TreeHead()
+	if err != nil {
+		return SignedTreeHead{}, err
+	}
+	if !head.Verify(c.LogKey) {
+		return SignedTreeHead{}, fmt.Errorf("%w: tree head of size %d is not signed by the log key", ErrTransparency, head.Size)
+	}
+
+	if previous := c.treeHead; previous != nil && previous.Size > 0 {
+		if head.Size < previous.Size {
+			return SignedTreeHead{}, fmt.Errorf("%w: log shrank from %d to %d entries", ErrTransparency, previous.Size, head.Size)
+		}
+		var proof [][]byte
+		if head.Size > previous.Size {
+			if proof, err = log.ConsistencyProof(previous.Size, head.Size); err != nil {
+				return SignedTreeHead{}, err
+			}
+		}
+		if !verifyConsistency(previous.Size, head.Size, previous.RootHash, head.RootHash, proof) {
+			return SignedTreeHead{}, fmt.Errorf("%w: tree of %d entries is not an extension of the tree of %d entries",
+				ErrTransparency, head.Size, previous.Size)
+		}
+	}
+	c.treeHead = &head
+	return head, nil
+}
+
+// verifyPublication checks that the identity key of userName has been published in log and has not been replaced since.
+// A directory can not hand out a key for a user without the user seeing it in the log, nor a key the user replaced.
+func (c *Client) verifyPublication(log TransparencyLog, userName string, identityKey *ecdh.PublicKey) error {
+	if identityKey == nil {
+		return fmt.Errorf("%w: bundle of %s has no identity key", ErrInvalidBundle, userName)
+	}
+
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+
+	head, err := c.updateTreeHead(log)
+	if err != nil {
+		return err
+	}
+	proof, err := log.InclusionProof(userName, identityKey, head.Size)
+	if errors.Is(err, ErrUnknownPeer) {
+		return fmt.Errorf("%w: %w", ErrTransparency, err)
+	}
+	if err != nil {
+		return err
+	}
+	if proof.Entry.UserName != userName || !identityKey.Equal(proof.Entry.IdentityKey) || proof.TreeSize != head.Size ||
+		proof.Index >= head.Size || uint64(len(proof.Later)) != head.Size-proof.Index-1 {
+		return fmt.Errorf("%w: inclusion proof for another entry than the identity key of %s", ErrTransparency, userName)
+	}
+
+	// the root is rebuilt from the earlier subtrees, the entry and all later entries
+	tree, ok := frontierBefore(proof.Index, proof.Hashes)
+	if !ok {
+		return fmt.Errorf("%w: audit path of %s does not match index %d", ErrTransparency, userName, proof.Index)
+	}
+	replaced := false
+	for i, entry := range append([]LogEntry{proof.Entry}, proof.Later...) {
+		leaf, err := entry.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		tree.append(leafHash(leaf))
+		replaced = replaced || (i > 0 && entry.UserName == userName)
+	}
+	if !bytes.Equal(tree.root(), head.RootHash) {
+		return fmt.Errorf("%w: identity key of %s is not included in the tree of %d entries", ErrTransparency, userName, head.Size)
+	}
+	if replaced {
+		return fmt.Errorf("%w: identity key of %s has been replaced in the log", ErrTransparency, userName)
+	}
+	return nil
+}
+
+// MonitorLog checks the entries appended to log since the last call for identity keys published in the name
+// of the client, which are not its own. The entries are verified against the signed tree head, so the server can not
+// hide an entry from the owner while handing it out to others. UnauthorizedPublication is returned for foreign keys.
+func (c *Client) MonitorLog(log TransparencyLog) error {
+	if c.IdentityKey == nil {
+		return fmt.Errorf("%w to monitor the log", ErrNoUser)
+	}
+
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+
+	head, err := c.updateTreeHead(log)
+	if err != nil {
+		return err
+	}
+	if head.Size < c.monitored.size {
+		return fmt.Errorf("%w: log shrank from %d to %d entries", ErrTransparency, c.monitored.size, head.Size)
+	}
+	entries, err := log.LogEntries(c.monitored.size, head.Size)
+	if err != nil {
+		return err
+	}
+	if uint64(len(entries)) != head.Size-c.monitored.size {
+		return fmt.Errorf("%w: expected %d log entries, got %d", ErrTransparency, head.Size-c.monitored.size, len(entries))
+	}
+
+	monitored := merkleFrontier{size: c.monitored.size, hashes: slices.Clone(c.monitored.hashes)}
+	var foreign []LogEntry
+	for _, entry := range entries {
+		leaf, err := entry.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		monitored.append(leafHash(leaf))
+		if entry.UserName == c.UserName && !entry.IdentityKey.Equal(c.IdentityKey.PublicKey()) {
+			foreign = append(foreign, entry)
+		}
+	}
+	if !bytes.Equal(monitored.root(), head.RootHash) {
+		return fmt.Errorf("%w: log entries do not match the tree head of size %d", ErrTransparency, head.Size)
+	}
+	c.monitored = monitored
+
+	if len(foreign) > 0 {
+		return &UnauthorizedPublication{UserName: c.UserName, Entries: foreign}
+	}
+	return nil
+}
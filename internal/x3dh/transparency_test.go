@@ -0,0 +1,318 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testLeafHashes(n int) [][]byte {
+	var hashes [][]byte
+	for i := range n {
+		hashes = append(hashes, leafHash([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+	return hashes
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 20; n++ {
+		hashes := testLeafHashes(n)
+		root := rootHash(hashes)
+
+		var frontier merkleFrontier
+		for _, hash := range hashes {
+			frontier.append(hash)
+		}
+		if string(frontier.root()) != string(root) {
+			t.Fatalf("Frontier of %d leaves does not match the root", n)
+		}
+
+		for m := range n {
+			path := inclusionPath(hashes, m)
+			if !verifyInclusion(uint64(m), uint64(n), hashes[m], path, root) {
+				t.Fatalf("Inclusion proof of leaf %d in %d leaves does not verify", m, n)
+			}
+			if verifyInclusion(uint64(m), uint64(n), hashes[(m+1)%n], path, root) && n > 1 {
+				t.Fatalf("Inclusion proof of leaf %d in %d leaves verifies another leaf", m, n)
+			}
+
+			// the audit path of the last leaf of a prefix continues to the root with the later leaves
+			before, ok := frontierBefore(uint64(m), inclusionPath(hashes[:m+1], m))
+			if !ok {
+				t.Fatalf("Audit path of leaf %d does not match its index", m)
+			}
+			for _, hash := range hashes[m:] {
+				before.append(hash)
+			}
+			if string(before.root()) != string(root) {
+				t.Fatalf("Frontier before leaf %d of %d leaves does not match the root", m, n)
+			}
+		}
+
+		for m := 1; m <= n; m++ {
+			path := consistencyPath(hashes, m)
+			if !verifyConsistency(uint64(m), uint64(n), rootHash(hashes[:m]), root, path) {
+				t.Fatalf("Consistency proof from %d to %d leaves does not verify", m, n)
+			}
+			if m < n && verifyConsistency(uint64(m), uint64(n), rootHash(testLeafHashes(m + 1)[1:]), root, path) {
+				t.Fatalf("Consistency proof from %d to %d leaves verifies another tree", m, n)
+			}
+		}
+	}
+
+	if empty := sha256.Sum256(nil); string(rootHash(nil)) != string(empty[:]) {
+		t.Fatal("The root of the empty tree has to be the hash of the empty string")
+	}
+}
+
+// lyingDirectory is a directory with a log, which hands out a bundle with an identity key that was never logged
+type lyingDirectory struct {
+	*Server
+	impostor *User
+}
+
+func (d *lyingDirectory) GetKeyBundle(userName string) (KeyBundleSending, error) {
+	bundle, err := d.Server.GetKeyBundle(userName)
+	if err != nil {
+		return bundle, err
+	}
+	bundle.IdentityKey = d.impostor.IdentityKey.PublicKey()
+	return bundle, nil
+}
+
+func TestGetKeyBundleVerifiesPublication(t *testing.T) {
+	_, server := publishTestUser(t, "bob")
+	_, alice := newTestUserClient(t, "alice", 0)
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if logKey, _ := server.LogPublicKey(); !alice.LogKey.Equal(logKey) {
+		t.Fatal("The log key has to be pinned on first use")
+	}
+
+	mallory, _ := newTestUserClient(t, "mallory", 0)
+	_, eve := newTestUserClient(t, "eve", 0)
+	if _, err := eve.GetKeyBundle(&lyingDirectory{Server: server, impostor: mallory}, "bob"); !errors.Is(err, ErrTransparency) {
+		t.Fatal("Expected ErrTransparency for an identity key, which is not in the log, Actual:", err)
+	}
+	if _, ok, _ := eve.Trust.Identity("bob"); ok {
+		t.Fatal("An unlogged identity key must not be trusted")
+	}
+}
+
+// replayingDirectory hands out an old bundle of a user together with a proof for its log entry
+type replayingDirectory struct {
+	*Server
+	old   KeyBundleSending
+	index int
+	later []LogEntry
+}
+
+func (d *replayingDirectory) GetKeyBundle(userName string) (KeyBundleSending, error) {
+	return d.old, nil
+}
+
+func (d *replayingDirectory) InclusionProof(userName string, identityKey *ecdh.PublicKey, treeSize uint64) (InclusionProof, error) {
+	return InclusionProof{
+		Entry:    d.log.entries[d.index],
+		Index:    uint64(d.index),
+		TreeSize: treeSize,
+		Hashes:   inclusionPath(d.log.hashes[:d.index+1], d.index),
+		Later:    d.later,
+	}, nil
+}
+
+func TestGetKeyBundleRejectsReplacedKey(t *testing.T) {
+	oldBob, server := publishTestUser(t, "bob")
+	// only the server can replace bob's key, an upload of another identity key is refused
+	newBob, _ := newTestUserClient(t, "bob", 1)
+	if err := server.storeKeyBundle("bob", publishTestBundle(t, newBob), storeReplace); err != nil {
+		t.Fatal("storeKeyBundle failed:", err.Error())
+	}
+	_, carol := newTestUserClient(t, "carol", 0)
+	if err := carol.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	if _, err := server.InclusionProof("bob", oldBob.IdentityKey.PublicKey(), 3); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatal("Expected ErrUnknownPeer for a replaced key, Actual:", err)
+	}
+
+	tests := []struct {
+		name  string
+		later []LogEntry
+	}{
+		{"complete proof", server.log.entries[1:]},
+		{"hidden replacement", server.log.entries[2:]},
+		{"forged replacement", []LogEntry{server.log.entries[2], server.log.entries[2]}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, alice := newTestUserClient(t, "alice", 0)
+			directory := &replayingDirectory{Server: server, old: publishTestBundle(t, oldBob), later: test.later}
+			if _, err := alice.GetKeyBundle(directory, "bob"); !errors.Is(err, ErrTransparency) {
+				t.Fatal("Expected ErrTransparency for a replaced identity key, Actual:", err)
+			}
+			if _, ok, _ := alice.Trust.Identity("bob"); ok {
+				t.Fatal("A replaced identity key must not be trusted")
+			}
+		})
+	}
+
+	_, alice := newTestUserClient(t, "alice", 0)
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle of the current key failed:", err.Error())
+	}
+}
+
+func TestGetKeyBundleDetectsForkedLog(t *testing.T) {
+	bobUser, server := publishTestUser(t, "bob")
+	_, alice := newTestUserClient(t, "alice", 0)
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+
+	// the server rewrites its history with the same log key
+	forked, err := restoreKeyLog(server.log.key, []LogEntry{
+		{UserName: "carol", IdentityKey: bobUser.IdentityKey.PublicKey(), Timestamp: time.Now()},
+		{UserName: "bob", IdentityKey: bobUser.IdentityKey.PublicKey(), Timestamp: time.Now()},
+	}, SignedTreeHead{})
+	if err != nil {
+		t.Fatal("restoreKeyLog failed:", err.Error())
+	}
+	server.log = forked
+	alice.keyBundles = make(map[string]*KeyBundleReceiving)
+	if _, err := alice.GetKeyBundle(server, "bob"); !errors.Is(err, ErrTransparency) {
+		t.Fatal("Expected ErrTransparency for a forked log, Actual:", err)
+	}
+
+	// another server pretends to be the directory
+	_, other := publishTestUser(t, "bob")
+	if _, err := alice.GetKeyBundle(other, "bob"); !errors.Is(err, ErrTransparency) {
+		t.Fatal("Expected ErrTransparency for a tree head of another log key, Actual:", err)
+	}
+}
+
+func TestMonitorLogDetectsUnauthorizedPublication(t *testing.T) {
+	server := newTestServer(t)
+	_, bob := newTestUserClient(t, "bob", 1)
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	if err := bob.MonitorLog(server); err != nil {
+		t.Fatal("MonitorLog failed:", err.Error())
+	}
+
+	_, alice := newTestUserClient(t, "alice", 0)
+	if err := alice.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	if err := bob.PublishKeyBundle(server); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	if err := bob.MonitorLog(server); err != nil {
+		t.Fatal("Publications of other users and republications must not alarm the owner:", err)
+	}
+
+	// the server publishes a key in bob's name
+	impostor, _ := newTestUserClient(t, "bob", 1)
+	if err := server.storeKeyBundle("bob", publishTestBundle(t, impostor), storeReplace); err != nil {
+		t.Fatal("storeKeyBundle failed:", err.Error())
+	}
+	err := bob.MonitorLog(server)
+	var unauthorized *UnauthorizedPublication
+	if !errors.As(err, &unauthorized) || !errors.Is(err, ErrUnauthorizedPublication) {
+		t.Fatal("Expected UnauthorizedPublication, Actual:", err)
+	}
+	if len(unauthorized.Entries) != 1 || !unauthorized.Entries[0].IdentityKey.Equal(impostor.IdentityKey.PublicKey()) {
+		t.Fatal("Expected the impostor key, Actual entries:", len(unauthorized.Entries))
+	}
+	if err := bob.MonitorLog(server); err != nil {
+		t.Fatal("Entries are only reported once:", err)
+	}
+
+	// a server hiding the entry from the owner is caught by the signed tree head
+	hidden := server.log.entries[len(server.log.entries)-1]
+	server.log.entries[len(server.log.entries)-1] = LogEntry{UserName: "carol", IdentityKey: hidden.IdentityKey, Timestamp: hidden.Timestamp}
+	_, carol := newTestUserClient(t, "carol", 0)
+	carol.LogKey = bob.LogKey
+	if err := carol.MonitorLog(server); !errors.Is(err, ErrTransparency) {
+		t.Fatal("Expected ErrTransparency for entries, which do not match the tree head, Actual:", err)
+	}
+}
+
+func TestTransparencyLogImplementations(t *testing.T) {
+	for name, directory := range newTestDirectories(t) {
+		t.Run(name, func(t *testing.T) {
+			log := directory.(TransparencyLog)
+			_, bob := newTestUserClient(t, "bob", 1)
+			if err := bob.PublishKeyBundle(directory); err != nil {
+				t.Fatal("PublishKeyBundle failed:", err.Error())
+			}
+			_, alice := newTestUserClient(t, "alice", 0)
+			if err := alice.PublishKeyBundle(directory); err != nil {
+				t.Fatal("PublishKeyBundle failed:", err.Error())
+			}
+
+			handshakeWithDirectory(t, alice, directory, "bob")
+			if err := bob.MonitorLog(log); err != nil {
+				t.Fatal("MonitorLog failed:", err.Error())
+			}
+
+			if _, err := log.ConsistencyProof(1, 3); !errors.Is(err, ErrInvalidTreeSize) {
+				t.Fatal("Expected ErrInvalidTreeSize, Actual:", err)
+			}
+			if _, err := log.InclusionProof("carol", bob.IdentityKey.PublicKey(), 2); !errors.Is(err, ErrUnknownPeer) {
+				t.Fatal("Expected ErrUnknownPeer, Actual:", err)
+			}
+			entries, err := log.LogEntries(0, 2)
+			if err != nil {
+				t.Fatal("LogEntries failed:", err.Error())
+			}
+			if len(entries) != 2 || entries[0].UserName != "bob" || !entries[1].IdentityKey.Equal(alice.IdentityKey.PublicKey()) {
+				t.Fatal("Expected the publications of bob and alice, Actual entries:", len(entries))
+			}
+		})
+	}
+}
+
+func TestFileDirectoryPersistsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "directory.json")
+	directory, err := OpenFileDirectory(path)
+	if err != nil {
+		t.Fatal("OpenFileDirectory failed:", err.Error())
+	}
+	_, bob := newTestUserClient(t, "bob", 2)
+	if err := bob.PublishKeyBundle(directory); err != nil {
+		t.Fatal("PublishKeyBundle failed:", err.Error())
+	}
+	_, alice := newTestUserClient(t, "alice", 0)
+	if _, err := alice.GetKeyBundle(directory, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	head, err := directory.TreeHead()
+	if err != nil {
+		t.Fatal("TreeHead failed:", err.Error())
+	}
+
+	reopened, err := OpenFileDirectory(path)
+	if err != nil {
+		t.Fatal("OpenFileDirectory failed:", err.Error())
+	}
+	reopenedHead, err := reopened.TreeHead()
+	if err != nil {
+		t.Fatal("TreeHead failed:", err.Error())
+	}
+	if reopenedHead.Size != head.Size || string(reopenedHead.RootHash) != string(head.RootHash) || !reopenedHead.Timestamp.Equal(head.Timestamp) {
+		t.Fatal("The log has to survive reopening unchanged")
+	}
+
+	// the pinned log key and tree head of alice stay valid
+	alice.keyBundles = make(map[string]*KeyBundleReceiving)
+	if _, err := alice.GetKeyBundle(reopened, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+}
@@ -0,0 +1,290 @@
+package x3dh
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// TrustStatus is the verification status of the identity key of a contact.
+type TrustStatus byte
+
+const (
+	TrustUnverified TrustStatus = iota // the first identity key seen for the contact, trusted on first use
+	TrustVerified                      // the identity key has been compared out of band
+	TrustChanged                       // another identity key has been seen, sending is blocked until the change is acknowledged
+)
+
+func (s TrustStatus) String() string {
+	switch s {
+	case TrustUnverified:
+		return "unverified"
+	case TrustVerified:
+		return "verified"
+	case TrustChanged:
+		return "changed"
+	default:
+		return fmt.Sprintf("TrustStatus(%d)", byte(s))
+	}
+}
+
+// TrustedIdentity is the identity key recorded for a contact.
+type TrustedIdentity struct {
+	IdentityKey *ecdh.PublicKey
+	Status      TrustStatus
+	FirstSeen   time.Time       // time IdentityKey was recorded
+	ChangedKey  *ecdh.PublicKey // the new identity key while Status is TrustChanged
+}
+
+// TrustStore records the identity keys of contacts. Implementations have to be safe for concurrent use.
+// MemoryTrustStore keeps them in memory and FileTrustStore persists them in a JSON file.
+type TrustStore interface {
+	// Identity returns the recorded identity of userName, ok is false for an unknown contact.
+	Identity(userName string) (identity TrustedIdentity, ok bool, err error)
+	// SaveIdentity records identity for userName and replaces a previously recorded one.
+	SaveIdentity(userName string, identity TrustedIdentity) error
+}
+
+// IdentityChanged is the event raised when a contact shows up with another identity key than the recorded one.
+// It is returned by GetKeyBundle and EncryptMessage and passed to Client.OnIdentityChanged,
+// sending to the contact fails until Client.AcknowledgeIdentityChange is called. It wraps ErrIdentityChanged.
+type IdentityChanged struct {
+	UserName string
+	OldKey   *ecdh.PublicKey // the recorded identity key
+	NewKey   *ecdh.PublicKey // the identity key handed out by the directory or used in a hello
+}
+
+func (e *IdentityChanged) Error() string {
+	return fmt.Sprintf("%s: %s", ErrIdentityChanged.Error(), e.UserName)
+}
+
+func (e *IdentityChanged) Unwrap() error {
+	return ErrIdentityChanged
+}
+
+// MemoryTrustStore is an in-memory TrustStore.
+type MemoryTrustStore struct {
+	mu         sync.Mutex
+	identities map[string]TrustedIdentity
+}
+
+func NewMemoryTrustStore() *MemoryTrustStore {
+	return &MemoryTrustStore{identities: make(map[string]TrustedIdentity)}
+}
+
+func (m *MemoryTrustStore) Identity(userName string) (TrustedIdentity, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	identity, ok := m.identities[userName]
+	return identity, ok, nil
+}
+
+func (m *MemoryTrustStore) SaveIdentity(userName string, identity TrustedIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identities[userName] = identity
+	return nil
+}
+
+// FileTrustStore is a TrustStore persisted in a JSON file. Every change is written before SaveIdentity returns.
+type FileTrustStore struct {
+	mu     sync.Mutex
+	path   string
+	memory *MemoryTrustStore
+}
+
+// trustedIdentityJSON is the file format of TrustedIdentity, public keys are encoded as raw X25519 bytes
+type trustedIdentityJSON struct {
+	IdentityKey []byte    `json:"identity_key"`
+	Status      string    `json:"status"`
+	FirstSeen   time.Time `json:"first_seen"`
+	ChangedKey  []byte    `json:"changed_key,omitempty"`
+}
+
+// OpenFileTrustStore loads the trust store at path. A missing file is treated as an empty store.
+func OpenFileTrustStore(path string) (*FileTrustStore, error) {
+	f := &FileTrustStore{
+		path:   path,
+		memory: NewMemoryTrustStore(),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var identities map[string]trustedIdentityJSON
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return nil, err
+	}
+	if f.memory.identities, err = parseTrustedIdentities(identities); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileTrustStore) Identity(userName string) (TrustedIdentity, bool, error) {
+	return f.memory.Identity(userName)
+}
+
+func (f *FileTrustStore) SaveIdentity(userName string, identity TrustedIdentity) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.memory.SaveIdentity(userName, identity); err != nil {
+		return err
+	}
+
+	f.memory.mu.Lock()
+	identities := trustedIdentitiesJSON(f.memory.identities)
+	data, err := json.MarshalIndent(identities, "", "  ")
+	f.memory.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+func trustedIdentitiesJSON(identities map[string]TrustedIdentity) map[string]trustedIdentityJSON {
+	out := make(map[string]trustedIdentityJSON, len(identities))
+	for userName, identity := range identities {
+		out[userName] = trustedIdentityJSON{
+			IdentityKey: publicKeyBytes(identity.IdentityKey),
+			Status:      identity.Status.String(),
+			FirstSeen:   identity.FirstSeen,
+			ChangedKey:  publicKeyBytes(identity.ChangedKey),
+		}
+	}
+	return out
+}
+
+func parseTrustedIdentities(identities map[string]trustedIdentityJSON) (map[string]TrustedIdentity, error) {
+	out := make(map[string]TrustedIdentity, len(identities))
+	for userName, in := range identities {
+		identity := TrustedIdentity{FirstSeen: in.FirstSeen}
+		var err error
+		if identity.IdentityKey, err = parsePublicKey(in.IdentityKey); err != nil {
+			return nil, err
+		}
+		if identity.ChangedKey, err = parsePublicKey(in.ChangedKey); err != nil {
+			return nil, err
+		}
+		switch in.Status {
+		case TrustUnverified.String():
+			identity.Status = TrustUnverified
+		case TrustVerified.String():
+			identity.Status = TrustVerified
+		case TrustChanged.String():
+			identity.Status = TrustChanged
+		default:
+			return nil, fmt.Errorf("unknown trust status %q of %s", in.Status, userName)
+		}
+		out[userName] = identity
+	}
+	return out, nil
+}
+
+// now returns the time of the user's clock, which is time.Now unless a test replaced it
+func (c *Client) now() time.Time {
+	if c.user == nil || c.user.now == nil {
+		return time.Now()
+	}
+	return c.user.now()
+}
+
+// checkIdentity records the identity key of userName on first use and compares it with the recorded one afterwards.
+// A different key marks the contact as changed and raises IdentityChanged. c.mu has to be held.
+func (c *Client) checkIdentity(userName string, identityKey *ecdh.PublicKey) error {
+	identity, ok, err := c.Trust.Identity(userName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.Trust.SaveIdentity(userName, TrustedIdentity{
+			IdentityKey: identityKey,
+			Status:      TrustUnverified,
+			FirstSeen:   c.now(),
+		})
+	}
+	if identity.IdentityKey.Equal(identityKey) {
+		if identity.Status == TrustChanged {
+			return &IdentityChanged{UserName: userName, OldKey: identity.IdentityKey, NewKey: identity.ChangedKey}
+		}
+		return nil
+	}
+
+	identity.Status = TrustChanged
+	identity.ChangedKey = identityKey
+	if err := c.Trust.SaveIdentity(userName, identity); err != nil {
+		return err
+	}
+	changed := &IdentityChanged{UserName: userName, OldKey: identity.IdentityKey, NewKey: identityKey}
+	if c.OnIdentityChanged != nil {
+		c.OnIdentityChanged(changed)
+	}
+	return changed
+}
+
+// checkSendingAllowed returns IdentityChanged while a key change of userName has not been acknowledged
+func (c *Client) checkSendingAllowed(userName string) error {
+	identity, ok, err := c.Trust.Identity(userName)
+	if err != nil {
+		return err
+	}
+	if ok && identity.Status == TrustChanged {
+		return &IdentityChanged{UserName: userName, OldKey: identity.IdentityKey, NewKey: identity.ChangedKey}
+	}
+	return nil
+}
+
+// AcknowledgeIdentityChange accepts the new identity key of userName after IdentityChanged was raised.
+// The key is recorded as unverified and sending is allowed again. The key bundle has to be fetched again
+// to start a session with the new key.
+func (c *Client) AcknowledgeIdentityChange(userName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	identity, ok, err := c.Trust.Identity(userName)
+	if err != nil {
+		return err
+	}
+	if !ok || identity.Status != TrustChanged {
+		return fmt.Errorf("%w: identity key of %s has not changed", ErrNoIdentityChange, userName)
+	}
+	return c.Trust.SaveIdentity(userName, TrustedIdentity{
+		IdentityKey: identity.ChangedKey,
+		Status:      TrustUnverified,
+		FirstSeen:   c.now(),
+	})
+}
+
+// VerifyIdentity marks the identity key of userName as verified, after it has been compared out of band.
+// identityKey has to be the recorded key, a pending key change has to be acknowledged first.
+func (c *Client) VerifyIdentity(userName string, identityKey *ecdh.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	identity, ok, err := c.Trust.Identity(userName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: no identity key recorded for %s", ErrUnknownPeer, userName)
+	}
+	if identity.Status == TrustChanged {
+		return &IdentityChanged{UserName: userName, OldKey: identity.IdentityKey, NewKey: identity.ChangedKey}
+	}
+	if identityKey == nil || !identity.IdentityKey.Equal(identityKey) {
+		return fmt.Errorf("%w: identity key of %s does not match the recorded one", ErrIdentityMismatch, userName)
+	}
+	identity.Status = TrustVerified
+	return c.Trust.SaveIdentity(userName, identity)
+}
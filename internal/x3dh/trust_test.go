@@ -0,0 +1,196 @@
+package x3dh
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrustOnFirstUse(t *testing.T) {
+	bobUser, server := publishTestUser(t, "bob")
+	_, alice := newTestUserClient(t, "alice", 0)
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+
+	identity, ok, err := alice.Trust.Identity("bob")
+	if err != nil || !ok {
+		t.Fatal("The identity key of bob has not been recorded:", err)
+	}
+	if !identity.IdentityKey.Equal(bobUser.IdentityKey.PublicKey()) || identity.Status != TrustUnverified {
+		t.Fatal("Expected the identity key of bob as unverified, Actual status:", identity.Status)
+	}
+	if identity.FirstSeen.IsZero() {
+		t.Fatal("FirstSeen has not been set")
+	}
+
+	// the same key is accepted again
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+}
+
+func TestIdentityChangedBlocksSending(t *testing.T) {
+	_, server := publishTestUser(t, "bob")
+	_, alice := newTestUserClient(t, "alice", 0)
+	var events []*IdentityChanged
+	alice.OnIdentityChanged = func(changed *IdentityChanged) { events = append(events, changed) }
+	handshakeWithDirectory(t, alice, server, "bob")
+	encryptTestMessage(t, alice, "bob", "Hello Bob")
+
+	// the directory hands out the bundle of an impostor under the same name
+	impostor, impostorServer := publishTestUser(t, "bob")
+	fresh := NewClientFromUser(alice.user)
+	fresh.Trust = alice.Trust
+	fresh.OnIdentityChanged = alice.OnIdentityChanged
+	_, err := fresh.GetKeyBundle(impostorServer, "bob")
+	var changed *IdentityChanged
+	if !errors.As(err, &changed) || !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected IdentityChanged, Actual:", err)
+	}
+	if !changed.NewKey.Equal(impostor.IdentityKey.PublicKey()) || changed.OldKey.Equal(changed.NewKey) {
+		t.Fatal("IdentityChanged does not carry the old and the new identity key")
+	}
+	if len(events) != 1 || events[0].UserName != "bob" {
+		t.Fatal("Expected one IdentityChanged event, Actual:", len(events))
+	}
+	if _, ok := fresh.keyBundles["bob"]; ok {
+		t.Fatal("The bundle with the changed identity key must not be stored")
+	}
+
+	// sending is blocked on every client sharing the trust store
+	if _, err := alice.EncryptMessage("bob", []byte("Hello Bob")); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected ErrIdentityChanged, Actual:", err)
+	}
+	if _, err := fresh.GetKeyBundle(impostorServer, "bob"); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected ErrIdentityChanged until the change is acknowledged, Actual:", err)
+	}
+	if err := fresh.VerifyIdentity("bob", impostor.IdentityKey.PublicKey()); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected ErrIdentityChanged, Actual:", err)
+	}
+
+	if err := fresh.AcknowledgeIdentityChange("bob"); err != nil {
+		t.Fatal("AcknowledgeIdentityChange failed:", err.Error())
+	}
+	identity, _, _ := fresh.Trust.Identity("bob")
+	if !identity.IdentityKey.Equal(impostor.IdentityKey.PublicKey()) || identity.Status != TrustUnverified || identity.ChangedKey != nil {
+		t.Fatal("Expected the new identity key as unverified, Actual status:", identity.Status)
+	}
+	handshakeWithDirectory(t, fresh, impostorServer, "bob")
+	encryptTestMessage(t, fresh, "bob", "Hello Bob")
+	if err := fresh.AcknowledgeIdentityChange("bob"); !errors.Is(err, ErrNoIdentityChange) {
+		t.Fatal("Expected ErrNoIdentityChange without a pending change, Actual:", err)
+	}
+}
+
+func TestIdentityChangedInHello(t *testing.T) {
+	bobUser, bob := newTestUserClient(t, "bob", 2)
+	_, alice := newTestUserClient(t, "alice", 0)
+	startTestSession(t, alice, bobUser)
+	decryptTestMessage(t, bob, "alice", encryptTestMessage(t, alice, "bob", "Hello Bob"), "Hello Bob")
+
+	// bob restarts without the session, which is not replaced by a new hello, and receives a hello from a reinstalled alice
+	if err := bobUser.store.DeleteSession("alice"); err != nil {
+		t.Fatal("DeleteSession failed:", err.Error())
+	}
+	restarted := NewClientFromUser(bobUser)
+	restarted.Trust = bob.Trust
+	var events []*IdentityChanged
+	restarted.OnIdentityChanged = func(changed *IdentityChanged) { events = append(events, changed) }
+	_, reinstalled := newTestUserClient(t, "alice", 0)
+	startTestSession(t, reinstalled, bobUser)
+
+	decryptTestMessage(t, restarted, "alice", encryptTestMessage(t, reinstalled, "bob", "Hello again"), "Hello again")
+	if len(events) != 1 || !events[0].NewKey.Equal(reinstalled.IdentityKey.PublicKey()) {
+		t.Fatal("Expected an IdentityChanged event with the new identity key, Actual:", len(events))
+	}
+	if _, err := restarted.EncryptMessage("alice", []byte("Hello Alice")); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected ErrIdentityChanged, Actual:", err)
+	}
+	if err := restarted.AcknowledgeIdentityChange("alice"); err != nil {
+		t.Fatal("AcknowledgeIdentityChange failed:", err.Error())
+	}
+	decryptTestMessage(t, reinstalled, "bob", encryptTestMessage(t, restarted, "alice", "Hello Alice"), "Hello Alice")
+}
+
+func TestTrustUsesClockOfUser(t *testing.T) {
+	_, server := publishTestUser(t, "bob")
+	aliceUser, alice, clock := newTestUserWithClock(t, "alice", 0)
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if identity, _, _ := alice.Trust.Identity("bob"); !identity.FirstSeen.Equal(clock.now) {
+		t.Fatal("Expected the time of the user's clock, Actual:", identity.FirstSeen)
+	}
+
+	_, impostorServer := publishTestUser(t, "bob")
+	clock.now = clock.now.Add(time.Hour)
+	alice = NewClientFromUser(aliceUser)
+	if _, err := alice.GetKeyBundle(impostorServer, "bob"); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected ErrIdentityChanged, Actual:", err)
+	}
+	if err := alice.AcknowledgeIdentityChange("bob"); err != nil {
+		t.Fatal("AcknowledgeIdentityChange failed:", err.Error())
+	}
+	if identity, _, _ := alice.Trust.Identity("bob"); !identity.FirstSeen.Equal(clock.now) {
+		t.Fatal("Expected the time of the acknowledgement, Actual:", identity.FirstSeen)
+	}
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	bobUser, server := publishTestUser(t, "bob")
+	_, alice := newTestUserClient(t, "alice", 0)
+	if err := alice.VerifyIdentity("bob", bobUser.IdentityKey.PublicKey()); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatal("Expected ErrUnknownPeer before the key is known, Actual:", err)
+	}
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	if err := alice.VerifyIdentity("bob", alice.IdentityKey.PublicKey()); !errors.Is(err, ErrIdentityMismatch) {
+		t.Fatal("Expected ErrIdentityMismatch for another key, Actual:", err)
+	}
+	if err := alice.VerifyIdentity("bob", bobUser.IdentityKey.PublicKey()); err != nil {
+		t.Fatal("VerifyIdentity failed:", err.Error())
+	}
+	if identity, _, _ := alice.Trust.Identity("bob"); identity.Status != TrustVerified {
+		t.Fatal("Expected verified, Actual:", identity.Status)
+	}
+}
+
+func TestFileTrustStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trust.json")
+	store, err := OpenFileTrustStore(path)
+	if err != nil {
+		t.Fatal("OpenFileTrustStore failed:", err.Error())
+	}
+
+	bobUser, server := publishTestUser(t, "bob")
+	_, alice := newTestUserClient(t, "alice", 0)
+	alice.Trust = store
+	if _, err := alice.GetKeyBundle(server, "bob"); err != nil {
+		t.Fatal("GetKeyBundle failed:", err.Error())
+	}
+	// the server hands out an impostor's key for bob
+	impostor, _ := newTestUserClient(t, "bob", 1)
+	if err := server.storeKeyBundle("bob", publishTestBundle(t, impostor), storeReplace); err != nil {
+		t.Fatal("storeKeyBundle failed:", err.Error())
+	}
+	if _, err := alice.GetKeyBundle(server, "bob"); !errors.Is(err, ErrIdentityChanged) {
+		t.Fatal("Expected ErrIdentityChanged, Actual:", err)
+	}
+	want, _, _ := store.Identity("bob")
+
+	reopened, err := OpenFileTrustStore(path)
+	if err != nil {
+		t.Fatal("OpenFileTrustStore failed:", err.Error())
+	}
+	identity, ok, err := reopened.Identity("bob")
+	if err != nil || !ok {
+		t.Fatal("The identity of bob has not been persisted:", err)
+	}
+	if !identity.IdentityKey.Equal(bobUser.IdentityKey.PublicKey()) || !identity.ChangedKey.Equal(want.ChangedKey) ||
+		identity.Status != TrustChanged || !identity.FirstSeen.Equal(want.FirstSeen) {
+		t.Fatal("Expected the persisted identity to match, Actual status:", identity.Status)
+	}
+}
@@ -2,8 +2,13 @@ package x3dh
 
 import (
 	"crypto/ecdh"
-	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"io"
 	"signal/internal/doubleratchet"
+	"signal/internal/xeddsa"
+	"time"
 )
 
 /**
@@ -11,59 +16,320 @@ https://lianglouise.github.io/post/some_practice_on_implementing_signal_protocol
 **/
 
 type User struct {
-	name               string
-	IdentityKey        *ecdh.PrivateKey       // Long-Term Identity Key (32 bytes), which is an unique identifier for each client
-	SignedPreKey       *ecdh.PrivateKey       // Signed PreKey (32 bytes), a key pair will be revoked and re-generated every few days/weeks for sake of security.
-	SignedPreKeySigned []byte                 // SPK public key’s signature, signed by IK secret key - SIG(IK_s, SPK_p)
-	OKPs               []*ecdh.PrivateKey     // One-time Off Key (32 bytes), a key pair will be revoked once used for handshake. Usually, the client will generate multiple OPK pair and generate new one once server used up or needs more.
-	KeyBundles         map[string]interface{} // unsure yet
-	DrKeys             map[string]interface{} // unsure yet
+	name                 string
+	IdentityKey          *ecdh.PrivateKey     // Long-Term Identity Key (32 bytes), which is an unique identifier for each client
+	SignedPreKey         *ecdh.PrivateKey     // Signed PreKey (32 bytes), a key pair will be revoked and re-generated every few days/weeks for sake of security.
+	SignedPreKeySigned   []byte               // SPK public key’s signature, signed by IK secret key - SIG(IK_s, SPK_p)
+	SignedPreKeyID       uint32               // ID of the current SPK, incremented on every rotation
+	SignedPreKeyAt       time.Time            // time the current SPK was generated
+	RotationInterval     time.Duration        // SPK is rotated once it is older than RotationInterval
+	GracePeriod          time.Duration        // retired SPKs are kept for GracePeriod, so hellos built against an old bundle still decrypt
+	retiredPreKeys       []SignedPreKeyRecord // rotated SPKs within the grace period
+	signedPreKeyPending  bool                 // the SPK was rotated by RefreshSignedPreKey, but its upload did not succeed yet
+	now                  func() time.Time
+	Rand                 io.Reader                   // entropy source of new keys and signatures, crypto/rand.Reader if nil
+	OKPs                 map[uint32]*ecdh.PrivateKey // One-time Off Key (32 bytes) by ID, a key pair will be revoked once used for handshake. Usually, the client will generate multiple OPK pair and generate new one once server used up or needs more.
+	nextOneTimePreKeyID  uint32
+	bundleSequence       uint64               // sequence number of the last bundle returned by Publish
+	pendingPreKeyIDs     []uint32             // one-time prekey batch signed by ReplenishOneTimePreKeys, whose upload did not succeed yet
+	pendingPreKeysSigned []byte               // signature of the pending batch, a retry repeats the upload unchanged
+	LastResortPreKey     *ecdh.PrivateKey     // Last-resort PreKey (32 bytes), handed out by the server when no OPK is left. It is never deleted, so new contacts can still reach an offline user.
+	PQPreKey             *mlkem768.PrivateKey // Last-resort ML-KEM-768 PreKey for PQXDH, nil disables PQXDH for new sessions
+	PQPreKeySigned       []byte               // SIG(IK_s, EncodeKEM(PQPK_p))
+	PQPreKeyID           uint32
+	// store holds every private key above and the sessions of the user's clients, the fields are the working copy
+	store ProtocolStore
 }
 
 func NewUser(name string, MAX_OPK_NUM int) (*User, error) {
-	user := &User{
-		name:       name,
-		KeyBundles: make(map[string]interface{}),
-		DrKeys:     make(map[string]interface{}),
+	return NewUserWithRandom(name, MAX_OPK_NUM, nil)
+}
+
+// NewUserWithRandom is NewUser with random as entropy source of all keys and signatures of the user, crypto/rand.Reader if nil.
+func NewUserWithRandom(name string, MAX_OPK_NUM int, random io.Reader) (*User, error) {
+	return NewUserWithStore(name, MAX_OPK_NUM, NewMemoryStore(), random)
+}
+
+// NewUserWithStore is NewUserWithRandom, which writes the new keys to store, so the user can be restored with LoadUser.
+// The store has to be empty, the identity of another user is never overwritten.
+func NewUserWithStore(name string, MAX_OPK_NUM int, store ProtocolStore, random io.Reader) (*User, error) {
+	if _, ok, err := store.LocalIdentity(); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, fmt.Errorf("%w: store already holds a user", ErrStoreInUse)
 	}
 
+	user := newUser(name, store)
+	user.Rand = random
+
 	var err error
-	user.IdentityKey, err = doubleratchet.GenerateDH()
+	user.IdentityKey, err = doubleratchet.GenerateDHWithRandom(user.random())
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.generateSignedPreKey(1)
+	if err != nil {
+		return nil, err
+	}
+
+	user.LastResortPreKey, err = doubleratchet.GenerateDHWithRandom(user.random())
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.generatePQPreKey(1)
 	if err != nil {
 		return nil, err
 	}
 
-	user.SignedPreKey, err = doubleratchet.GenerateDH()
+	_, err = user.GenerateOneTimePreKeys(MAX_OPK_NUM)
 	if err != nil {
 		return nil, err
 	}
 
-	user.SignedPreKeySigned = ed25519.Sign(user.IdentityKey.Bytes(), user.SignedPreKey.PublicKey().Bytes())
+	return user, nil
+}
 
-	for range MAX_OPK_NUM {
-		sk, err := doubleratchet.GenerateDH()
+// LoadUser restores the user, whose keys were written to store by NewUserWithStore.
+// It fails with ErrNoUser if the store is empty.
+func LoadUser(store ProtocolStore) (*User, error) {
+	local, ok, err := store.LocalIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w in store", ErrNoUser)
+	}
+
+	user := newUser(local.UserName, store)
+	user.IdentityKey = local.IdentityKey
+	user.LastResortPreKey = local.LastResortPreKey
+	user.PQPreKey = local.PQPreKey
+	user.PQPreKeySigned = local.PQPreKeySigned
+	user.PQPreKeyID = local.PQPreKeyID
+	user.nextOneTimePreKeyID = max(local.NextOneTimePreKeyID, 1)
+	user.signedPreKeyPending = local.SignedPreKeyPending
+	user.bundleSequence = local.BundleSequence
+	user.pendingPreKeyIDs = local.PendingOneTimePreKeyIDs
+	user.pendingPreKeysSigned = local.PendingOneTimePreKeysSigned
+
+	records, err := store.SignedPreKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if !record.RetiredAt.IsZero() {
+			user.retiredPreKeys = append(user.retiredPreKeys, record)
+			continue
+		}
+		user.SignedPreKey = record.Key
+		user.SignedPreKeySigned = record.Signature
+		user.SignedPreKeyID = record.ID
+		user.SignedPreKeyAt = record.CreatedAt
+	}
+	if user.SignedPreKey == nil {
+		return nil, fmt.Errorf("%w: store holds no signed prekey of %s", ErrNoUser, local.UserName)
+	}
+
+	ids, err := store.PreKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		key, ok, err := store.LoadPreKey(id)
 		if err != nil {
 			return nil, err
 		}
-		user.OKPs = append(user.OKPs, sk)
+		if ok {
+			user.OKPs[id] = key
+		}
+		user.nextOneTimePreKeyID = max(user.nextOneTimePreKeyID, id+1)
 	}
-
 	return user, nil
 }
 
-func (u *User) Publish() KeyBundleSending {
-	return KeyBundleSending{
+func newUser(name string, store ProtocolStore) *User {
+	return &User{
+		name:                name,
+		RotationInterval:    DefaultRotationInterval,
+		GracePeriod:         DefaultGracePeriod,
+		OKPs:                make(map[uint32]*ecdh.PrivateKey),
+		nextOneTimePreKeyID: 1,
+		now:                 time.Now,
+		store:               store,
+	}
+}
+
+// saveLocalIdentity writes the identity key, the last-resort prekeys, the next one-time prekey ID,
+// the pending uploads and the bundle sequence number to the store
+func (u *User) saveLocalIdentity() error {
+	return u.store.SaveLocalIdentity(LocalIdentity{
+		UserName:            u.name,
+		IdentityKey:         u.IdentityKey,
+		LastResortPreKey:    u.LastResortPreKey,
+		PQPreKey:            u.PQPreKey,
+		PQPreKeySigned:      u.PQPreKeySigned,
+		PQPreKeyID:          u.PQPreKeyID,
+		NextOneTimePreKeyID: u.nextOneTimePreKeyID,
+		SignedPreKeyPending: u.signedPreKeyPending,
+		BundleSequence:      u.bundleSequence,
+
+		PendingOneTimePreKeyIDs:     u.pendingPreKeyIDs,
+		PendingOneTimePreKeysSigned: u.pendingPreKeysSigned,
+	})
+}
+
+func (u *User) random() io.Reader {
+	if u.Rand == nil {
+		return rand.Reader
+	}
+	return u.Rand
+}
+
+func (u *User) Name() string {
+	return u.name
+}
+
+// Publish returns the key bundle of the user for an upload to the directory. Every bundle gets the next sequence
+// number and is signed with the identity key, so the directory accepts it only from the user and only once.
+func (u *User) Publish() (KeyBundleSending, error) {
+	// the bundle carries every one-time prekey, so a pending batch is published with it
+	pendingIDs, pendingSigned := u.pendingPreKeyIDs, u.pendingPreKeysSigned
+	u.bundleSequence++
+	u.pendingPreKeyIDs, u.pendingPreKeysSigned = nil, nil
+	if err := u.saveLocalIdentity(); err != nil {
+		u.bundleSequence--
+		u.pendingPreKeyIDs, u.pendingPreKeysSigned = pendingIDs, pendingSigned
+		return KeyBundleSending{}, err
+	}
+
+	bundle := KeyBundleSending{
 		IdentityKey:        u.IdentityKey.PublicKey(),
 		SignedPreKey:       u.SignedPreKey.PublicKey(),
 		SignedPreKeySigned: u.SignedPreKeySigned,
-		OneTimePreKeys:     getPublicKeysBytes(u.OKPs),
+		SignedPreKeyID:     u.SignedPreKeyID,
+		OneTimePreKeys:     u.oneTimePreKeys(),
+		LastResortPreKey:   u.LastResortPreKey.PublicKey(),
+		PQPreKey:           u.publishPQPreKey(),
+		Sequence:           u.bundleSequence,
+	}
+	signature, err := xeddsa.SignWithRandom(u.IdentityKey, bundleMessage(u.name, bundle), u.random())
+	if err != nil {
+		return KeyBundleSending{}, err
+	}
+	bundle.Signature = signature
+	return bundle, nil
+}
+
+// ProcessX3DHHello is Bob's side of the handshake.
+// It recomputes DH1-DH4 with his private keys, derives the shared secret, decrypts the initial message with
+// AD = Encode(IK_A) || Encode(IK_B) and deletes the consumed one-time prekey. The shared secret and the decrypted envelope are returned.
+// DH4 is omitted for PreKeyNone and the last-resort prekey is never deleted.
+// A hello whose envelope is addressed to another user fails with ErrInvalidMessage.
+// For PQXDH the shared secret decapsulated with the PQ prekey is appended to the DHs.
+func (u *User) ProcessX3DHHello(msg *InitialMessage) ([]byte, *Envelope, error) {
+	sk, envelope, err := u.processHello(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := u.consumePreKey(msg); err != nil {
+		return nil, nil, err
+	}
+	return sk, envelope, nil
+}
+
+// consumePreKey deletes the one-time prekey used by msg, the last-resort prekey is kept
+func (u *User) consumePreKey(msg *InitialMessage) error {
+	if msg.PreKeyType != PreKeyOneTime {
+		return nil
 	}
+	return u.removeOneTimePreKey(msg.OneTimePreKeyID)
 }
 
-func getPublicKeysBytes(keys []*ecdh.PrivateKey) []*ecdh.PublicKey {
-	publicKeys := make([]*ecdh.PublicKey, len(keys))
-	for i, key := range keys {
-		publicKeys[i] = key.PublicKey()
+// processHello is ProcessX3DHHello without deleting the one-time prekey
+func (u *User) processHello(msg *InitialMessage) ([]byte, *Envelope, error) {
+	if msg == nil || msg.IdentityKey == nil || msg.EphemeralKey == nil {
+		return nil, nil, fmt.Errorf("%w: incomplete initial message", ErrInvalidMessage)
+	}
+
+	var preKey *ecdh.PrivateKey
+	switch msg.PreKeyType {
+	case PreKeyNone:
+	case PreKeyOneTime:
+		opk, ok := u.OKPs[msg.OneTimePreKeyID]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: unknown one-time prekey %d", ErrBundleExhausted, msg.OneTimePreKeyID)
+		}
+		preKey = opk
+	case PreKeyLastResort:
+		if u.LastResortPreKey == nil {
+			return nil, nil, fmt.Errorf("%w: no last-resort prekey", ErrBundleExhausted)
+		}
+		preKey = u.LastResortPreKey
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown prekey type", ErrInvalidMessage)
+	}
+
+	signedPreKey, err := u.signedPreKeyByID(msg.SignedPreKeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	DH1, err := doubleratchet.DH(signedPreKey, msg.IdentityKey)
+	if err != nil {
+		return nil, nil, err
 	}
-	return publicKeys
+	DH2, err := doubleratchet.DH(u.IdentityKey, msg.EphemeralKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	DH3, err := doubleratchet.DH(signedPreKey, msg.EphemeralKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyMaterial := append(append(DH1, DH2...), DH3...)
+	if preKey != nil {
+		DH4, err := doubleratchet.DH(preKey, msg.EphemeralKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyMaterial = append(keyMaterial, DH4...)
+	}
+	if msg.PQCiphertext != nil {
+		SS, err := u.pqDecapsulate(msg.PQPreKeyID, msg.PQCiphertext)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyMaterial = append(keyMaterial, SS...)
+	}
+
+	sk, err := x3dhKDF(keyMaterial)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newHelloAEAD(sk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msg.Nonce) != aead.NonceSize() {
+		return nil, nil, fmt.Errorf("%w: invalid nonce size", ErrInvalidMessage)
+	}
+
+	ad := associatedData(msg.IdentityKey, u.IdentityKey.PublicKey())
+	plaintext, err := aead.Open(nil, msg.Nonce, msg.Ciphertext, ad)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: initial message", ErrAuthentication)
+	}
+	var envelope Envelope
+	if err := envelope.UnmarshalBinary(plaintext); err != nil {
+		return nil, nil, err
+	}
+	// a hello for another user, built with the keys of this one, is not accepted as addressed to this user
+	if envelope.To != u.name {
+		return nil, nil, fmt.Errorf("%w: hello is addressed to %s, not to %s", ErrInvalidMessage, envelope.To, u.name)
+	}
+
+	return sk, &envelope, nil
 }
@@ -0,0 +1,223 @@
+package x3dh
+
+import (
+	"bytes"
+	"errors"
+	"signal/internal/doubleratchet"
+	"testing"
+)
+
+func TestX3DHHandshakeIntegration(t *testing.T) {
+	bob, err := NewUser("bob", 5)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	alice := newTestClient(t, "alice")
+	prepareHandshake(t, alice, bob)
+
+	err = alice.GenerateSendSecretKey("bob")
+	if err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+
+	hello, err := alice.BuildX3DHHello("bob", "Hello Bob")
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+
+	sk, envelope, err := bob.ProcessX3DHHello(hello)
+	if err != nil {
+		t.Fatal("ProcessX3DHHello failed:", err.Error())
+	}
+
+	if !bytes.Equal(sk, alice.keyBundles["bob"].SecretKey) {
+		t.Fatal("secret key of bob is not same as secret key of alice")
+	}
+	if envelope.From != "alice" || envelope.To != "bob" || envelope.Message != "Hello Bob" {
+		t.Fatalf("unexpected envelope: %+v", envelope)
+	}
+	if len(bob.OKPs) != 4 {
+		t.Fatal("consumed one-time prekey was not deleted, remaining:", len(bob.OKPs))
+	}
+
+	// the one-time prekey is gone, so the same hello must not be accepted twice
+	if _, _, err := bob.ProcessX3DHHello(hello); !errors.Is(err, ErrBundleExhausted) {
+		t.Fatal("replayed hello should not be accepted, expected ErrBundleExhausted, Actual:", err)
+	}
+}
+
+func TestX3DHHelloForAnotherUser(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	alice := newTestClient(t, "alice")
+	prepareHandshake(t, alice, bob)
+	if err := alice.GenerateSendSecretKey("bob"); err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+
+	// the envelope names carol, but the hello is encrypted with the keys of bob
+	alice.keyBundles["carol"] = alice.keyBundles["bob"]
+	hello, err := alice.BuildX3DHHello("carol", "Hello Carol")
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+	if _, _, err := bob.ProcessX3DHHello(hello); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatal("Expected ErrInvalidMessage, Actual:", err)
+	}
+	if len(bob.OKPs) != 1 {
+		t.Fatal("one-time prekey must not be deleted by a misaddressed hello")
+	}
+}
+
+func TestX3DHHandshakeTamperedSignedPreKey(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	alice := newTestClient(t, "alice")
+	prepareHandshake(t, alice, bob)
+
+	alice.keyBundles["bob"].SignedPreKeySigned[0] ^= 0xff
+
+	if err := alice.GenerateSendSecretKey("bob"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatal("GenerateSendSecretKey should fail with a tampered signed prekey signature, Actual:", err)
+	}
+	if alice.keyBundles["bob"].SecretKey != nil {
+		t.Fatal("No secret key must be derived from an unverified signed prekey")
+	}
+}
+
+func TestX3DHHelloWithoutSecretKey(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	alice := newTestClient(t, "alice")
+	prepareHandshake(t, alice, bob)
+
+	if _, err := alice.BuildX3DHHello("bob", "Hello Bob"); !errors.Is(err, ErrNoSecretKey) {
+		t.Fatal("Expected ErrNoSecretKey, Actual:", err)
+	}
+	if _, err := alice.StartSession("bob", &InitialMessage{}); !errors.Is(err, ErrNoSecretKey) {
+		t.Fatal("Expected ErrNoSecretKey, Actual:", err)
+	}
+}
+
+func TestX3DHHandshakeMissingKeys(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	tests := []struct {
+		name     string
+		tamper   func(*Client)
+		expected error
+	}{
+		{"identity key of the client", func(c *Client) { c.IdentityKey = nil }, ErrNoUser},
+		{"ephemeral key", func(c *Client) { c.keyBundles["bob"].EphemeralKey = nil }, ErrNoEphemeralKey},
+		{"identity key of the bundle", func(c *Client) { c.keyBundles["bob"].IdentityKey = nil }, ErrInvalidBundle},
+		{"signed prekey", func(c *Client) { c.keyBundles["bob"].SignedPreKey = nil }, ErrInvalidBundle},
+		{"one-time prekey", func(c *Client) { c.keyBundles["bob"].OneTimePreKey = nil }, ErrInvalidBundle},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alice := newTestClient(t, "alice")
+			prepareHandshake(t, alice, bob)
+			test.tamper(alice)
+			if err := alice.GenerateSendSecretKey("bob"); !errors.Is(err, test.expected) {
+				t.Fatalf("Expected %v, Actual: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestX3DHHandshakeTamperedCiphertext(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	alice := newTestClient(t, "alice")
+	prepareHandshake(t, alice, bob)
+
+	if err := alice.GenerateSendSecretKey("bob"); err != nil {
+		t.Fatal("GenerateSendSecretKey failed:", err.Error())
+	}
+	hello, err := alice.BuildX3DHHello("bob", "Hello Bob")
+	if err != nil {
+		t.Fatal("BuildX3DHHello failed:", err.Error())
+	}
+
+	hello.Ciphertext[0] ^= 0xff
+	if _, _, err := bob.ProcessX3DHHello(hello); !errors.Is(err, ErrAuthentication) {
+		t.Fatal("tampered hello should not be accepted, expected ErrAuthentication, Actual:", err)
+	}
+	if len(bob.OKPs) != 1 {
+		t.Fatal("one-time prekey must not be deleted by a failed hello")
+	}
+}
+
+func TestEncodePublicKey(t *testing.T) {
+	key, err := doubleratchet.GenerateDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := EncodePublicKey(key.PublicKey())
+	if len(encoded) != 33 || encoded[0] != CurveX25519 || !bytes.Equal(encoded[1:], key.PublicKey().Bytes()) {
+		t.Fatalf("unexpected encoding %x", encoded)
+	}
+}
+
+// TestX3DHHelloIsBoundToIdentityKeys checks that AD = Encode(IK_A) || Encode(IK_B) authenticates the initial ciphertext
+// and is the associated data of the session.
+func TestX3DHHelloIsBoundToIdentityKeys(t *testing.T) {
+	bob, err := NewUser("bob", 1)
+	if err != nil {
+		t.Fatal("NewUser failed:", err.Error())
+	}
+	alice := newTestClient(t, "alice")
+	session := startTestSession(t, alice, bob)
+	hello := session.pendingHello
+
+	ad := append(EncodePublicKey(alice.IdentityKey.PublicKey()), EncodePublicKey(bob.IdentityKey.PublicKey())...)
+	if !bytes.Equal(session.AssociatedData, ad) {
+		t.Fatal("session has to use AD = Encode(IK_A) || Encode(IK_B)")
+	}
+
+	// mallory claims the hello of alice, the shared secret differs and so does AD
+	mallory := newTestClient(t, "mallory")
+	forged := *hello
+	forged.IdentityKey = mallory.IdentityKey.PublicKey()
+	if _, _, err := bob.ProcessX3DHHello(&forged); !errors.Is(err, ErrAuthentication) {
+		t.Fatal("Expected ErrAuthentication, Actual:", err)
+	}
+
+	sk, envelope, err := bob.ProcessX3DHHello(hello)
+	if err != nil {
+		t.Fatal("ProcessX3DHHello failed:", err.Error())
+	}
+	if !bytes.Equal(sk, alice.keyBundles["bob"].SecretKey) || envelope.From != "alice" || envelope.To != "bob" {
+		t.Fatalf("unexpected handshake result: %+v", envelope)
+	}
+}
+
+func TestEnvelopeEncoding(t *testing.T) {
+	envelope := &Envelope{From: "alice", To: "bob", Message: "Hello Bob"}
+	data, err := envelope.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Envelope
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal("UnmarshalBinary failed:", err.Error())
+	}
+	if decoded != *envelope {
+		t.Fatalf("Expected %+v, Actual: %+v", envelope, decoded)
+	}
+	for _, invalid := range [][]byte{data[:len(data)-1], append(bytes.Clone(data), 0x00), {0xff}} {
+		if err := decoded.UnmarshalBinary(invalid); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatal("Expected ErrInvalidMessage, Actual:", err)
+		}
+	}
+}
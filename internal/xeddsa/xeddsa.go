@@ -0,0 +1,196 @@
+// Package xeddsa is implemented as specified in https://signal.org/docs/specifications/xeddsa/
+// It allows X25519 key pairs to create and verify EdDSA-compatible signatures.
+package xeddsa
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+	"fmt"
+	"io"
+)
+
+const (
+	SignatureSize = 64
+	randomSize    = 64
+)
+
+// ErrInvalidKey is returned by Sign for a private key, which is not a X25519 key.
+var ErrInvalidKey = errors.New("xeddsa: invalid key")
+
+// hash1Prefix is the 32 byte little-endian encoding of 2^256 - 1 - 1, which is prepended for hash_1
+var hash1Prefix = append([]byte{0xfe}, bytes.Repeat([]byte{0xff}, 31)...)
+
+// Sign returns the XEdDSA signature of message with the X25519 private key.
+// Z is read from crypto/rand.
+func Sign(privateKey *ecdh.PrivateKey, message []byte) ([]byte, error) {
+	return SignWithRandom(privateKey, message, rand.Reader)
+}
+
+/*
+xeddsa_sign(k, M, Z):
+    A, a = calculate_key_pair(k)
+    r = hash1(a || M || Z) (mod q)
+    R = rB
+    h = hash(R || A || M) (mod q)
+    s = r + ha (mod q)
+    return R || s
+*/
+
+// SignWithRandom is Sign with the 64 bytes of Z read from random.
+func SignWithRandom(privateKey *ecdh.PrivateKey, message []byte, random io.Reader) ([]byte, error) {
+	if privateKey == nil || privateKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%w: private key has to be a X25519 key", ErrInvalidKey)
+	}
+
+	z := make([]byte, randomSize)
+	if _, err := io.ReadFull(random, z); err != nil {
+		return nil, err
+	}
+
+	A, a, err := calculateKeyPair(privateKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha512.New()
+	hash.Write(hash1Prefix)
+	hash.Write(a.Bytes())
+	hash.Write(message)
+	hash.Write(z)
+	r, err := edwards25519.NewScalar().SetUniformBytes(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	R := new(edwards25519.Point).ScalarBaseMult(r)
+
+	h, err := challenge(R.Bytes(), A, message)
+	if err != nil {
+		return nil, err
+	}
+
+	s := edwards25519.NewScalar().MultiplyAdd(h, a, r)
+
+	return append(R.Bytes(), s.Bytes()...), nil
+}
+
+/*
+xeddsa_verify(u, M, (R || s)):
+    if u >= p or R.y >= 2^|p| or s >= 2^|q|:
+        return false
+    A = convert_mont(u)
+    if not on_curve(A):
+        return false
+    h = hash(R || A || M) (mod q)
+    Rcheck = sB - hA
+    if bytes_equal(R, Rcheck):
+        return true
+    return false
+*/
+
+// Verify reports whether signature is a valid XEdDSA signature of message by the X25519 public key.
+// Signatures from libsignal, which stores the sign bit of the Edwards public key in the last bit of s, are accepted as well.
+func Verify(publicKey *ecdh.PublicKey, message, signature []byte) bool {
+	if publicKey == nil || publicKey.Curve() != ecdh.X25519() || len(signature) != SignatureSize {
+		return false
+	}
+
+	u := publicKey.Bytes()
+	var uElement field.Element
+	if _, err := uElement.SetBytes(u); err != nil || subtle.ConstantTimeCompare(uElement.Bytes(), u) != 1 {
+		// u >= p
+		return false
+	}
+
+	rBytes := signature[:32]
+	sBytes := make([]byte, 32)
+	copy(sBytes, signature[32:])
+	signBit := sBytes[31] >> 7
+	sBytes[31] &= 0x7f
+
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(sBytes)
+	if err != nil {
+		return false
+	}
+
+	A, err := convertMont(&uElement, signBit)
+	if err != nil {
+		return false
+	}
+
+	h, err := challenge(rBytes, A, message)
+	if err != nil {
+		return false
+	}
+
+	// Rcheck = sB - hA
+	minusA := new(edwards25519.Point).Negate(A)
+	rCheck := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(h, minusA, s)
+
+	return subtle.ConstantTimeCompare(rCheck.Bytes(), rBytes) == 1
+}
+
+/*
+calculate_key_pair(k):
+    E = kB
+    A.y = E.y
+    A.s = 0
+    if E.s == 1:
+        a = -k (mod q)
+    else:
+        a = k (mod q)
+    return A, a
+*/
+
+func calculateKeyPair(k []byte) (*edwards25519.Point, *edwards25519.Scalar, error) {
+	// X25519 clamps the private key before use, so the same has to be done here
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	E := new(edwards25519.Point).ScalarBaseMult(a)
+	if E.Bytes()[31]>>7 == 1 {
+		a.Negate(a)
+	}
+
+	A := new(edwards25519.Point).ScalarBaseMult(a)
+	return A, a, nil
+}
+
+/*
+convert_mont(u):
+    umasked = u (mod 2^|p|)
+    P.y = u_to_y(umasked)
+    P.s = 0
+    return P
+*/
+
+func convertMont(u *field.Element, signBit byte) (*edwards25519.Point, error) {
+	// y = (u - 1) / (u + 1)
+	one := new(field.Element).One()
+	numerator := new(field.Element).Subtract(u, one)
+	denominator := new(field.Element).Add(u, one)
+	y := new(field.Element).Multiply(numerator, new(field.Element).Invert(denominator))
+
+	yBytes := y.Bytes()
+	yBytes[31] |= signBit << 7
+
+	// SetBytes fails if the point is not on the curve
+	return new(edwards25519.Point).SetBytes(yBytes)
+}
+
+// challenge returns hash(R || A || M) (mod q)
+func challenge(R []byte, A *edwards25519.Point, message []byte) (*edwards25519.Scalar, error) {
+	hash := sha512.New()
+	hash.Write(R)
+	hash.Write(A.Bytes())
+	hash.Write(message)
+	return edwards25519.NewScalar().SetUniformBytes(hash.Sum(nil))
+}
@@ -0,0 +1,187 @@
+package xeddsa
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"filippo.io/edwards25519/field"
+	"testing"
+)
+
+// Vector from libsignal's Curve25519 signature test: Alice signs her serialized ephemeral key with her identity key.
+const (
+	vectorPrivateKey = "c097248412e58bf05df487968205132794178e367637f5818f81e0e6ce73e865"
+	vectorPublicKey  = "ab7e717d4a163b7d9a1d8071dfe9dcf8cdcd1cea3339b6356be84d887e322c64"
+	vectorMessage    = "05edce9d9c415ca78cb7252e72c2c4a554d3eb29485a0e1d503118d1a82d99fb4a"
+	vectorSignature  = "5de88ca9a89b4a115da79109c67c9c7464a3e4180274f1cb8c63c2984e286dfbede82deb9dcd9fae0bfbb821569b3d9001bd8130cd11d486cef047bd60b86e88"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal("hex decoding failed:", err.Error())
+	}
+	return b
+}
+
+func TestLibsignalVector(t *testing.T) {
+	privateKey, err := ecdh.X25519().NewPrivateKey(decodeHex(t, vectorPrivateKey))
+	if err != nil {
+		t.Fatal("NewPrivateKey failed:", err.Error())
+	}
+	if !bytes.Equal(privateKey.PublicKey().Bytes(), decodeHex(t, vectorPublicKey)) {
+		t.Fatal("public key does not match the vector")
+	}
+
+	message := decodeHex(t, vectorMessage)
+	signature := decodeHex(t, vectorSignature)
+	if !Verify(privateKey.PublicKey(), message, signature) {
+		t.Fatal("signature of the vector could not be verified")
+	}
+
+	for i := range signature {
+		tampered := bytes.Clone(signature)
+		tampered[i] ^= 0x01
+		if Verify(privateKey.PublicKey(), message, tampered) {
+			t.Fatalf("tampered signature (byte %d) was verified", i)
+		}
+	}
+
+	// our own signature over the same message has to verify as well
+	ownSignature, err := Sign(privateKey, message)
+	if err != nil {
+		t.Fatal("Sign failed:", err.Error())
+	}
+	if !Verify(privateKey.PublicKey(), message, ownSignature) {
+		t.Fatal("own signature of the vector could not be verified")
+	}
+}
+
+func TestSignAndVerifyIntegration(t *testing.T) {
+	for range 64 {
+		privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal("GenerateKey failed:", err.Error())
+		}
+		message := []byte("Message in a Bottle :)")
+
+		signature, err := Sign(privateKey, message)
+		if err != nil {
+			t.Fatal("Sign failed:", err.Error())
+		}
+		if len(signature) != SignatureSize {
+			t.Fatal("signature length isn't 64, Actual:", len(signature))
+		}
+		// the spec always uses A.s = 0, so s never carries a sign bit
+		if signature[63]&0x80 != 0 {
+			t.Fatal("sign bit of s is set")
+		}
+
+		if !Verify(privateKey.PublicKey(), message, signature) {
+			t.Fatal("signature could not be verified")
+		}
+		if Verify(privateKey.PublicKey(), []byte("Another Message in a Bottle :)"), signature) {
+			t.Fatal("signature was verified for a different message")
+		}
+
+		otherKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal("GenerateKey failed:", err.Error())
+		}
+		if Verify(otherKey.PublicKey(), message, signature) {
+			t.Fatal("signature was verified with a different public key")
+		}
+	}
+}
+
+func TestSignIsDeterministicForZ(t *testing.T) {
+	privateKey, err := ecdh.X25519().NewPrivateKey(decodeHex(t, vectorPrivateKey))
+	if err != nil {
+		t.Fatal("NewPrivateKey failed:", err.Error())
+	}
+	message := []byte("message")
+	z := bytes.Repeat([]byte{0x42}, 64)
+
+	first, err := SignWithRandom(privateKey, message, bytes.NewReader(z))
+	if err != nil {
+		t.Fatal("SignWithRandom failed:", err.Error())
+	}
+	second, err := SignWithRandom(privateKey, message, bytes.NewReader(z))
+	if err != nil {
+		t.Fatal("SignWithRandom failed:", err.Error())
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("signatures with the same Z differ")
+	}
+
+	if _, err := SignWithRandom(privateKey, message, bytes.NewReader(z[:10])); err == nil {
+		t.Fatal("SignWithRandom should fail with less than 64 bytes of Z")
+	}
+}
+
+func TestSignRejectsInvalidKey(t *testing.T) {
+	if _, err := Sign(nil, []byte("message")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey, Actual:", err)
+	}
+	p256Key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey failed:", err.Error())
+	}
+	if _, err := Sign(p256Key, []byte("message")); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("Expected ErrInvalidKey, Actual:", err)
+	}
+}
+
+func TestCalculateKeyPairMatchesConvertMont(t *testing.T) {
+	for range 64 {
+		privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal("GenerateKey failed:", err.Error())
+		}
+
+		A, _, err := calculateKeyPair(privateKey.Bytes())
+		if err != nil {
+			t.Fatal("calculateKeyPair failed:", err.Error())
+		}
+
+		var u field.Element
+		if _, err := u.SetBytes(privateKey.PublicKey().Bytes()); err != nil {
+			t.Fatal("SetBytes failed:", err.Error())
+		}
+		converted, err := convertMont(&u, 0)
+		if err != nil {
+			t.Fatal("convertMont failed:", err.Error())
+		}
+
+		if !bytes.Equal(A.Bytes(), converted.Bytes()) {
+			t.Fatal("A of calculate_key_pair is not the same as convert_mont(u)")
+		}
+	}
+}
+
+func TestVerifyRejectsNonCanonicalS(t *testing.T) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey failed:", err.Error())
+	}
+	message := []byte("message")
+
+	signature, err := Sign(privateKey, message)
+	if err != nil {
+		t.Fatal("Sign failed:", err.Error())
+	}
+
+	// s + q encodes the same scalar but is >= q
+	q, _ := hex.DecodeString("edd3f55c1a631258d69cf7a2def9de1400000000000000000000000000000010")
+	var carry uint16
+	for i := range 32 {
+		sum := uint16(signature[32+i]) + uint16(q[i]) + carry
+		signature[32+i] = byte(sum)
+		carry = sum >> 8
+	}
+	if signature[63]&0x80 == 0 && Verify(privateKey.PublicKey(), message, signature) {
+		t.Fatal("signature with s >= q was verified")
+	}
+}